@@ -0,0 +1,82 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// NewTrieWithAllocator constructs a new trie allocating its nodes using
+// newNode and handing the nodes no longer used by the trie to freeNode,
+// so the nodes can be backed by an arena or a pool.
+//
+// The root node is allocated using newNode as well and it is the only node
+// that is never freed. The nodes returned by newNode are reset by the trie,
+// the nodes passed to freeNode are reset before the call, so no references
+// to keys or items are retained in the pool.
+//
+// When newNode is nil, the nodes are allocated using new. When freeNode is nil,
+// the nodes no longer used are simply left to the garbage collector.
+// Clones of the trie do not use the allocator.
+func NewTrieWithAllocator(newNode func() *Trie, freeNode func(*Trie)) *Trie {
+	var trie *Trie
+	if newNode != nil {
+		trie = newNode()
+		*trie = Trie{}
+	} else {
+		trie = &Trie{}
+	}
+	trie.children = newSuperDenseChildList()
+
+	trie.opts = &trieOptions{
+		newNode:  newNode,
+		freeNode: freeNode,
+	}
+	return trie
+}
+
+// newNode returns a new empty node, trie must be the root.
+func (trie *Trie) newNode() *Trie {
+	if trie.opts == nil || trie.opts.newNode == nil {
+		return NewTrie()
+	}
+
+	node := trie.opts.newNode()
+	*node = Trie{
+		children: newSuperDenseChildList(),
+	}
+	return node
+}
+
+// freeNode hands node over to the allocator, trie must be the root.
+// The node must not be referenced by the trie any more.
+func (trie *Trie) freeNode(node *Trie) {
+	if trie.opts == nil || trie.opts.freeNode == nil {
+		return
+	}
+
+	*node = Trie{}
+	trie.opts.freeNode(node)
+}
+
+// freeSubtree frees node and all its descendants, trie must be the root.
+func (trie *Trie) freeSubtree(node *Trie) {
+	if trie.opts == nil || trie.opts.freeNode == nil {
+		return
+	}
+
+	for _, child := range node.children.getChildren() {
+		trie.freeSubtree(child)
+	}
+	trie.freeNode(node)
+}
+
+// freeChildren frees all the descendants of node, trie must be the root.
+func (trie *Trie) freeChildren(node *Trie) {
+	if trie.opts == nil || trie.opts.freeNode == nil {
+		return
+	}
+
+	for _, child := range node.children.getChildren() {
+		trie.freeSubtree(child)
+	}
+}
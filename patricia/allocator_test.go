@@ -0,0 +1,105 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+type countingAllocator struct {
+	t    *testing.T
+	live map[*Trie]bool
+}
+
+func newCountingAllocator(t *testing.T) *countingAllocator {
+	return &countingAllocator{t, make(map[*Trie]bool)}
+}
+
+func (alloc *countingAllocator) newNode() *Trie {
+	node := new(Trie)
+	alloc.live[node] = true
+	return node
+}
+
+func (alloc *countingAllocator) freeNode(node *Trie) {
+	if !alloc.live[node] {
+		alloc.t.Errorf("Freeing a node not allocated or already freed: %p", node)
+	}
+	delete(alloc.live, node)
+}
+
+func (alloc *countingAllocator) check(trie *Trie, op string) {
+	if count := trie.Stats().NodeCount; count != len(alloc.live) {
+		alloc.t.Errorf("Unexpected number of live nodes after %s, expected=%d, got=%d",
+			op, count, len(alloc.live))
+	}
+}
+
+func TestTrie_AllocatorNodeCount(t *testing.T) {
+	alloc := newCountingAllocator(t)
+	trie := NewTrieWithAllocator(alloc.newNode, alloc.freeNode)
+	alloc.check(trie, "construction")
+
+	data := []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek", "Pepanekovic"}
+	for _, key := range data {
+		trie.Insert(Prefix(key), struct{}{})
+		alloc.check(trie, "insert "+key)
+	}
+
+	if !trie.Delete(Prefix("Pepanek")) {
+		t.Fatal("Pepanek not deleted")
+	}
+	alloc.check(trie, "delete Pepanek")
+
+	if !trie.DeleteSubtree(Prefix("Jen")) {
+		t.Fatal("Jen subtree not deleted")
+	}
+	alloc.check(trie, "delete subtree Jen")
+
+	for _, key := range data {
+		trie.Delete(Prefix(key))
+		alloc.check(trie, "delete "+key)
+	}
+	if trie.Stats().NodeCount != 1 {
+		t.Errorf("Unexpected number of nodes of an empty trie, expected=1, got=%d", trie.Stats().NodeCount)
+	}
+}
+
+func TestTrie_AllocatorRandomized(t *testing.T) {
+	defer SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+	SetMaxPrefixPerNode(3)
+
+	alloc := newCountingAllocator(t)
+	trie := NewTrieWithAllocator(alloc.newNode, alloc.freeNode)
+
+	rng := rand.New(rand.NewSource(42))
+	randomKey := func() Prefix {
+		key := make(Prefix, 1+rng.Intn(8))
+		for i := range key {
+			key[i] = "abc"[rng.Intn(3)]
+		}
+		return key
+	}
+
+	for i := 0; i < 2000; i++ {
+		key := randomKey()
+		switch rng.Intn(5) {
+		case 0, 1:
+			trie.Insert(key, i)
+		case 2, 3:
+			trie.Delete(key)
+		default:
+			trie.DeleteSubtree(key[:1+rng.Intn(len(key))])
+		}
+		alloc.check(trie, "operation "+string(key))
+		if t.Failed() {
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const defaultBloomFalsePositiveRate = 0.01
+
+// NewTrieWithBloom constructs a new trie with a companion Bloom filter sized
+// for expectedItems keys and the given false positive rate.
+//
+// Every key inserted into the trie is added to the filter as well and Get
+// consults the filter first, so a lookup of an absent key usually returns
+// without traversing the trie at all. The filter only ever produces false
+// positives, never false negatives. Keep in mind that Delete does not clear
+// any bits in the filter, so deleted keys keep being reported as possibly
+// present and the filter degrades as keys are replaced over time.
+//
+// When fpRate is not in the (0, 1) interval, 1% is used.
+func NewTrieWithBloom(expectedItems int, fpRate float64) *Trie {
+	trie := NewTrie()
+	trie.opts = &trieOptions{
+		bloom: newBloomFilter(expectedItems, fpRate),
+	}
+	return trie
+}
+
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+func newBloomFilter(expectedItems int, fpRate float64) *bloomFilter {
+	if expectedItems < 1 {
+		expectedItems = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = defaultBloomFalsePositiveRate
+	}
+
+	n := float64(expectedItems)
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / n * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+func (filter *bloomFilter) add(key Prefix) {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(filter.bits)) * 64
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (filter *bloomFilter) mayContain(key Prefix) bool {
+	h1, h2 := bloomHashes(key)
+	size := uint64(len(filter.bits)) * 64
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % size
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *bloomFilter) clone() *bloomFilter {
+	if filter == nil {
+		return nil
+	}
+	return &bloomFilter{
+		bits:   append([]uint64(nil), filter.bits...),
+		hashes: filter.hashes,
+	}
+}
+
+// cleared returns an empty filter of the same size.
+func (filter *bloomFilter) cleared() *bloomFilter {
+	return &bloomFilter{
+		bits:   make([]uint64, len(filter.bits)),
+		hashes: filter.hashes,
+	}
+}
+
+// bloomHashes returns two independent hashes of key that are combined
+// to get all the bit positions, see Kirsch and Mitzenmacher.
+func bloomHashes(key Prefix) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+
+	g := fnv.New64()
+	g.Write(key)
+	h2 := g.Sum64() | 1
+
+	return h1, h2
+}
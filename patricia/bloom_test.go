@@ -0,0 +1,94 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"strconv"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_BloomGet(t *testing.T) {
+	const count = 1000
+	trie := NewTrieWithBloom(count, 0.01)
+
+	for i := 0; i < count; i++ {
+		if ok := trie.Insert(Prefix("key"+strconv.Itoa(i)), i); !ok {
+			t.Fatalf("Couldn't insert item %d", i)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		if item := trie.Get(Prefix("key" + strconv.Itoa(i))); item != i {
+			t.Errorf("Unexpected item, expected=%v, got=%v", i, item)
+		}
+	}
+
+	var falsePositives int
+	for i := count; i < 2*count; i++ {
+		key := Prefix("key" + strconv.Itoa(i))
+		if trie.opts.bloom.mayContain(key) {
+			falsePositives++
+		}
+		if item := trie.Get(key); item != nil {
+			t.Errorf("Unexpected item, expected=<nil>, got=%v", item)
+		}
+	}
+	if falsePositives > count/20 {
+		t.Errorf("Too many false positives: %d out of %d", falsePositives, count)
+	}
+
+	trie.Delete(Prefix("key0"))
+	if item := trie.Get(Prefix("key0")); item != nil {
+		t.Errorf("Unexpected item after delete, expected=<nil>, got=%v", item)
+	}
+}
+
+func TestTrie_BloomClone(t *testing.T) {
+	trie := NewTrieWithBloom(10, 0.01)
+	trie.Insert(Prefix("Pepan"), 0)
+
+	clone := trie.Clone()
+	clone.Insert(Prefix("Honza"), 1)
+
+	if item := clone.Get(Prefix("Honza")); item != 1 {
+		t.Errorf("Unexpected item, expected=1, got=%v", item)
+	}
+	if item := trie.Get(Prefix("Honza")); item != nil {
+		t.Errorf("Unexpected item, expected=<nil>, got=%v", item)
+	}
+	if trie.opts.bloom == clone.opts.bloom {
+		t.Error("Bloom filter shared between the trie and its clone")
+	}
+}
+
+// Benchmarks ------------------------------------------------------------------
+
+func benchmarkGetMiss(trie *Trie, b *testing.B) {
+	for i := 0; i < amountWords; i++ {
+		trie.Insert(Prefix(mrandBytes(wordLength)), struct{}{})
+	}
+
+	queries := make([]Prefix, 1024)
+	for i := range queries {
+		queries[i] = Prefix(mrandBytes(wordLength))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		trie.Get(queries[i%len(queries)])
+	}
+}
+
+func BenchmarkGetMiss(b *testing.B) {
+	benchmarkGetMiss(NewTrie(), b)
+}
+
+func BenchmarkGetMissBloom(b *testing.B) {
+	benchmarkGetMiss(NewTrieWithBloom(amountWords, 0.01), b)
+}
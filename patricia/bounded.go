@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"container/list"
+	"strings"
+)
+
+// NewBoundedTrie constructs a new trie holding at most maxItems items.
+//
+// Inserting a new key into a full trie evicts the least recently inserted
+// key first, onEvict is then called with the evicted key and item unless
+// it is nil. Replacing an item stored under an existing key does not count
+// as an insertion.
+func NewBoundedTrie(maxItems int, onEvict func(Prefix, Item)) *Trie {
+	if maxItems < 1 {
+		maxItems = 1
+	}
+
+	trie := NewTrie()
+	trie.opts = &trieOptions{
+		eviction: &evictionQueue{
+			maxItems: maxItems,
+			onEvict:  onEvict,
+			order:    list.New(),
+			elements: make(map[string]*list.Element),
+		},
+	}
+	return trie
+}
+
+// evictionQueue keeps track of the insertion order of the keys.
+type evictionQueue struct {
+	maxItems int
+	onEvict  func(Prefix, Item)
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func (queue *evictionQueue) inserted(key Prefix) {
+	queue.elements[string(key)] = queue.order.PushBack(string(key))
+}
+
+func (queue *evictionQueue) removed(key Prefix) {
+	if elem, ok := queue.elements[string(key)]; ok {
+		queue.order.Remove(elem)
+		delete(queue.elements, string(key))
+	}
+}
+
+func (queue *evictionQueue) clone() *evictionQueue {
+	if queue == nil {
+		return nil
+	}
+
+	clone := &evictionQueue{
+		maxItems: queue.maxItems,
+		onEvict:  queue.onEvict,
+		order:    list.New(),
+		elements: make(map[string]*list.Element, len(queue.elements)),
+	}
+	for elem := queue.order.Front(); elem != nil; elem = elem.Next() {
+		key := elem.Value.(string)
+		clone.elements[key] = clone.order.PushBack(key)
+	}
+	return clone
+}
+
+// cleared returns an empty queue with the same bounds.
+func (queue *evictionQueue) cleared() *evictionQueue {
+	if queue == nil {
+		return nil
+	}
+	return &evictionQueue{
+		maxItems: queue.maxItems,
+		onEvict:  queue.onEvict,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// rebased returns a copy of the queue keeping just the keys starting
+// with prefix, prefix being stripped from them.
+func (queue *evictionQueue) rebased(prefix Prefix) *evictionQueue {
+	if queue == nil {
+		return nil
+	}
+
+	rebased := &evictionQueue{
+		maxItems: queue.maxItems,
+		onEvict:  queue.onEvict,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+	for elem := queue.order.Front(); elem != nil; elem = elem.Next() {
+		key := elem.Value.(string)
+		if strings.HasPrefix(key, string(prefix)) {
+			key = key[len(prefix):]
+			rebased.elements[key] = rebased.order.PushBack(key)
+		}
+	}
+	return rebased
+}
+
+// evict deletes the least recently inserted keys until the trie fits its bounds.
+func (trie *Trie) evict() {
+	queue := trie.opts.eviction
+	for trie.count > queue.maxItems && queue.order.Len() != 0 {
+		key := Prefix(queue.order.Front().Value.(string))
+		item, _ := trie.get(key)
+		trie.Delete(key)
+		if queue.onEvict != nil {
+			queue.onEvict(key, item)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_BoundedEviction(t *testing.T) {
+	var evicted []string
+	trie := NewBoundedTrie(3, func(prefix Prefix, item Item) {
+		evicted = append(evicted, string(prefix))
+	})
+
+	for i, key := range []string{"Pepan", "Pepin", "Honza"} {
+		trie.Insert(Prefix(key), i)
+	}
+	trie.Set(Prefix("Pepan"), 42)
+	if len(evicted) != 0 {
+		t.Fatalf("Unexpected eviction of %v", evicted)
+	}
+
+	trie.Insert(Prefix("Pepanek"), 3)
+	if len(evicted) != 1 || evicted[0] != "Pepan" {
+		t.Fatalf("Unexpected evictions, expected=[Pepan], got=%v", evicted)
+	}
+	if trie.Len() != 3 {
+		t.Errorf("Unexpected number of items, expected=3, got=%d", trie.Len())
+	}
+	if trie.Match(Prefix("Pepan")) {
+		t.Error("Evicted item Pepan still present")
+	}
+	checkMasksRecursive(t, trie)
+
+	// Deleted keys must not be evicted anymore.
+	trie.Delete(Prefix("Pepin"))
+	trie.Insert(Prefix("Jenik"), 4)
+	trie.Insert(Prefix("Karel"), 5)
+	if len(evicted) != 2 || evicted[1] != "Honza" {
+		t.Fatalf("Unexpected evictions, expected=[Pepan Honza], got=%v", evicted)
+	}
+
+	trie.DeleteSubtree(Prefix("Pep"))
+	trie.Insert(Prefix("Jenak"), 6)
+	if len(evicted) != 2 {
+		t.Fatalf("Unexpected evictions, expected=[Pepan Honza], got=%v", evicted)
+	}
+	trie.Insert(Prefix("Pepa"), 7)
+	if len(evicted) != 3 || evicted[2] != "Jenik" {
+		t.Fatalf("Unexpected evictions, expected=[Pepan Honza Jenik], got=%v", evicted)
+	}
+	checkCountsRecursive(t, trie)
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ErrUnsortedInput is returned by LoadSorted, wrapped along with the line
+// number, when a key is not greater than the key on the previous line.
+var ErrUnsortedInput = errors.New("Input keys not sorted")
+
+// ConflictPolicy decides what is stored when the same key is added
+// to a Builder more than once, old being the item added earlier.
+type ConflictPolicy func(old, new Item) Item
+
+// FirstWins is the ConflictPolicy keeping the item added first.
+func FirstWins(old, new Item) Item {
+	return old
+}
+
+// LastWins is the ConflictPolicy keeping the item added last.
+func LastWins(old, new Item) Item {
+	return new
+}
+
+// Builder accumulates entries and builds a trie out of them at once.
+// The zero value is ready to use and resolves conflicts using LastWins.
+type Builder struct {
+	entries []Entry
+	policy  ConflictPolicy
+}
+
+// NewBuilder constructs a new builder resolving conflicts using policy.
+// LastWins is used when policy is nil.
+func NewBuilder(policy ConflictPolicy) *Builder {
+	return &Builder{policy: policy}
+}
+
+// Add adds an entry to the builder. The key is copied, so it can be reused.
+func (builder *Builder) Add(key Prefix, item Item) {
+	// Nil prefix not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+
+	stored := make(Prefix, len(key))
+	copy(stored, key)
+	builder.entries = append(builder.entries, Entry{stored, item})
+}
+
+// Build sorts the entries added so far, resolves the duplicate keys using
+// the conflict policy and builds the trie in a single pass, without inserting
+// the keys one by one. The builder is reset afterwards.
+func (builder *Builder) Build() *Trie {
+	policy := builder.policy
+	if policy == nil {
+		policy = LastWins
+	}
+
+	entries := builder.entries
+	builder.entries = nil
+
+	// The stable sort keeps the duplicate keys in the order they were added.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+
+	unique := entries[:0]
+	for _, entry := range entries {
+		if last := len(unique) - 1; last >= 0 && bytes.Equal(unique[last].Key, entry.Key) {
+			unique[last].Item = policy(unique[last].Item, entry.Item)
+			continue
+		}
+		unique = append(unique, entry)
+	}
+
+	if len(unique) == 0 {
+		return NewTrie()
+	}
+	return bulkLoad(unique, 0)
+}
+
+// bulkLoad builds the subtree holding the sorted unique entries, the first
+// offset bytes of all the keys being represented by the ancestors already.
+// The node prefixes are split the same way put splits them.
+func bulkLoad(entries []Entry, offset int) *Trie {
+	node := NewTrie()
+
+	// The entries are sorted, so the first and the last key share
+	// the longest common prefix of all the keys.
+	first, last := entries[0].Key[offset:], entries[len(entries)-1].Key[offset:]
+	common := 0
+	for common < len(first) && common < len(last) && first[common] == last[common] {
+		common++
+	}
+
+	if common > maxPrefixPerNode {
+		node.prefix = first[:maxPrefixPerNode:maxPrefixPerNode]
+		child := bulkLoad(entries, offset+maxPrefixPerNode)
+		node.children = node.children.add(child)
+		node.count = child.count
+		node.updateMask(nil)
+		return node
+	}
+
+	node.prefix = first[:common:common]
+	offset += common
+
+	// The key ending in this node sorts first.
+	if len(entries[0].Key) == offset {
+		node.item = entries[0].Item
+		node.hasItem = true
+		node.count++
+		entries = entries[1:]
+	}
+
+	// Group the rest of the entries by the byte following the prefix.
+	for len(entries) != 0 {
+		b := entries[0].Key[offset]
+		n := 1
+		for n < len(entries) && entries[n].Key[offset] == b {
+			n++
+		}
+
+		child := bulkLoad(entries[:n], offset)
+		node.children = node.children.add(child)
+		node.count += child.count
+		entries = entries[n:]
+	}
+
+	node.updateMask(nil)
+	return node
+}
+
+// LoadSorted builds a trie out of the lines read from r, parse turning every
+// line, without its trailing "\n" or "\r\n", into the key and the item
+// to be stored. The keys must be strictly ascending in the lexicographic order
+// of their bytes, ErrUnsortedInput is returned otherwise, so the keys must be
+// unique as well. The errors returned from parse and the sorting errors are
+// wrapped along with the number of the offending line.
+//
+// Only a single line is held in memory at a time apart from the trie itself.
+// Since the keys are sorted, every key is added next to the path to the
+// previous key, the trie is never searched from the root, and the item
+// counts and the masks are computed in a single pass at the end.
+func LoadSorted(r io.Reader, parse func(line []byte) (Prefix, Item, error)) (*Trie, error) {
+	loader := &sortedLoader{trie: NewTrie()}
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		key, item, parseErr := parse(line)
+		switch {
+		case parseErr != nil:
+			return nil, fmt.Errorf("line %d: %w", n, parseErr)
+		case key == nil:
+			return nil, fmt.Errorf("line %d: %w", n, ErrNilPrefix)
+		case !loader.add(key, item):
+			return nil, fmt.Errorf("line %d: %w", n, ErrUnsortedInput)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	loader.trie.finishLoaded(nil)
+	return loader.trie, nil
+}
+
+// sortedLoader adds the sorted keys to its trie, leaving the item counts
+// and the masks to be computed once all the keys are added. The children
+// are added the same way put adds them, so the options of the trie
+// bounding the fan-out are respected.
+type sortedLoader struct {
+	trie *Trie
+	// path holds the nodes on the path to the last key added
+	// with the offsets of their prefixes within the key.
+	path    []loadedNode
+	last    Prefix
+	started bool
+}
+
+type loadedNode struct {
+	node  *Trie
+	start int
+}
+
+// add adds the key unless it is not greater than the last key added.
+func (loader *sortedLoader) add(key Prefix, item Item) bool {
+	trie := loader.trie
+	if !loader.started {
+		loader.started = true
+		loader.last = append(loader.last[:0], key...)
+		if len(key) > maxPrefixPerNode {
+			trie.prefix = append(Prefix{}, key[:maxPrefixPerNode]...)
+		} else {
+			trie.prefix = append(Prefix{}, key...)
+		}
+		loader.path = append(loader.path, loadedNode{trie, 0})
+		loader.appendKey(key, len(trie.prefix), item)
+		return true
+	}
+
+	if bytes.Compare(key, loader.last) <= 0 {
+		return false
+	}
+
+	common := 0
+	for common < len(key) && common < len(loader.last) && key[common] == loader.last[common] {
+		common++
+	}
+	loader.last = append(loader.last[:0], key...)
+
+	// Find the node where the key leaves the path to the last key,
+	// the last node ends exactly where the last key does.
+	i := 0
+	for loader.path[i].start+len(loader.path[i].node.prefix) < common {
+		i++
+	}
+	loader.path = loader.path[:i+1]
+
+	// Split the node the same way put does.
+	node := loader.path[i].node
+	if split := common - loader.path[i].start; split < len(node.prefix) {
+		child := trie.newNode()
+		*child = *node
+		*node = *NewTrie()
+		node.opts, child.opts = child.opts, nil
+		node.prefix = child.prefix[:split]
+		child.prefix = child.prefix[split:]
+		if compacted := child.compact(); compacted != child {
+			trie.freeNode(child)
+			child = compacted
+		}
+		trie.addChild(node, child)
+	}
+
+	loader.appendKey(key, common, item)
+	return true
+}
+
+// appendKey appends the nodes holding key[offset:] to the last node of the path
+// and stores item in the last node appended.
+func (loader *sortedLoader) appendKey(key Prefix, offset int, item Item) {
+	node := loader.path[len(loader.path)-1].node
+	rest := append(Prefix{}, key[offset:]...)
+	for len(rest) != 0 {
+		child := loader.trie.newNode()
+		if len(rest) > maxPrefixPerNode {
+			child.prefix = rest[:maxPrefixPerNode]
+		} else {
+			child.prefix = rest
+		}
+		rest = rest[len(child.prefix):]
+		loader.trie.addChild(node, child)
+		loader.path = append(loader.path, loadedNode{child, offset})
+		offset += len(child.prefix)
+		node = child
+	}
+
+	node.item = item
+	node.hasItem = true
+}
+
+// finishLoaded computes the item counts and the masks of the subtree.
+func (trie *Trie) finishLoaded(masks *charmapMasks) {
+	trie.count = 0
+	if trie.hasItem {
+		trie.count++
+	}
+	for _, child := range trie.children.getChildren() {
+		child.finishLoaded(masks)
+		trie.count += child.count
+	}
+	trie.updateMask(masks)
+}
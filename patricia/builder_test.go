@@ -0,0 +1,198 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestBuilder_LastWins(t *testing.T) {
+	var builder Builder
+	for i, key := range []string{"Pepan", "Karel", "Pepin", "Pepan", "Honza", "Karel", "Pepanek", "Pepan"} {
+		builder.Add(Prefix(key), i)
+	}
+
+	trie := builder.Build()
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	want := []Entry{
+		{Prefix("Honza"), 4},
+		{Prefix("Karel"), 5},
+		{Prefix("Pepan"), 7},
+		{Prefix("Pepanek"), 6},
+		{Prefix("Pepin"), 2},
+	}
+	if got := trie.SortedEntries(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected entries, expected=%v, got=%v", want, got)
+	}
+
+	// The builder is reset.
+	if trie := builder.Build(); trie.Len() != 0 {
+		t.Errorf("Unexpected number of items, expected=0, got=%d", trie.Len())
+	}
+}
+
+func TestBuilder_FirstWins(t *testing.T) {
+	builder := NewBuilder(FirstWins)
+	builder.Add(Prefix("Pepan"), 1)
+	builder.Add(Prefix("Pepan"), 2)
+	builder.Add(Prefix(""), 3)
+
+	trie := builder.Build()
+	if item := trie.Get(Prefix("Pepan")); item != 1 {
+		t.Errorf("Unexpected item, expected=1, got=%v", item)
+	}
+	if item := trie.Get(Prefix("")); item != 3 {
+		t.Errorf("Unexpected item, expected=3, got=%v", item)
+	}
+}
+
+func TestBuilder_MatchesInsert(t *testing.T) {
+	defer SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+	SetMaxPrefixPerNode(4)
+
+	rng := rand.New(rand.NewSource(3))
+	builder := NewBuilder(nil)
+	inserted := NewTrie()
+	for i := 0; i < 2000; i++ {
+		key := make(Prefix, rng.Intn(20))
+		for j := range key {
+			key[j] = "abc"[rng.Intn(3)]
+		}
+		builder.Add(key, i)
+		inserted.Set(key, i)
+	}
+
+	trie := builder.Build()
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	if !trie.Equal(inserted, nil) {
+		t.Error("built trie differs from the trie built by inserting")
+	}
+	if built, want := trie.Stats().NodeCount, inserted.Stats().NodeCount; built > want {
+		t.Errorf("Unexpected node count, expected at most %d, got=%d", want, built)
+	}
+
+	// The built trie behaves just like any other trie.
+	inserted.Visit(func(prefix Prefix, item Item) error {
+		if len(prefix)%2 == 0 {
+			trie.Delete(prefix)
+		}
+		return nil
+	})
+	trie.Insert(Prefix("abcabcabcabcabcabcabcabc"), -1)
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+	if item := trie.Get(Prefix("abcabcabcabcabcabcabcabc")); item != -1 {
+		t.Errorf("Unexpected item, expected=-1, got=%v", item)
+	}
+}
+
+func TestLoadSorted(t *testing.T) {
+	defer SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+	SetMaxPrefixPerNode(4)
+
+	rng := rand.New(rand.NewSource(5))
+	items := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		key := make([]byte, rng.Intn(20))
+		for j := range key {
+			key[j] = "abc"[rng.Intn(3)]
+		}
+		items[string(key)] = i
+	}
+
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var input strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&input, "%s %d\r\n", key, items[key])
+	}
+
+	parse := func(line []byte) (Prefix, Item, error) {
+		i := strings.LastIndexByte(string(line), ' ')
+		if i == -1 {
+			return nil, nil, errors.New("no item")
+		}
+		item, err := strconv.Atoi(string(line[i+1:]))
+		return Prefix(line[:i]), item, err
+	}
+	trie, err := LoadSorted(strings.NewReader(input.String()), parse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	got := make(map[string]int)
+	trie.Visit(func(prefix Prefix, item Item) error {
+		got[string(prefix)] = item.(int)
+		return nil
+	})
+	if !reflect.DeepEqual(got, items) {
+		t.Errorf("Unexpected entries, expected %d entries, got %d", len(items), len(got))
+	}
+
+	// The nodes are split just like when inserting the keys in order.
+	inserted := NewTrie()
+	for _, key := range keys {
+		inserted.Insert(Prefix(key), items[key])
+	}
+	if loaded, want := trie.Stats().NodeCount, inserted.Stats().NodeCount; loaded != want {
+		t.Errorf("Unexpected node count, expected=%d, got=%d", want, loaded)
+	}
+
+	// The loaded trie behaves just like any other trie.
+	for _, key := range keys[:len(keys)/2] {
+		trie.Delete(Prefix(key))
+	}
+	trie.Insert(Prefix("abcabcabcabcabcabcabcabc"), -1)
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	// The last line need not be terminated.
+	trie, err = LoadSorted(strings.NewReader("a 1\nab 2"), parse)
+	if err != nil || trie.Len() != 2 || trie.Get(Prefix("ab")) != 2 {
+		t.Errorf("Unexpected result of loading unterminated input, err=%v", err)
+	}
+	if trie, err := LoadSorted(strings.NewReader(""), parse); err != nil || trie.Len() != 0 {
+		t.Errorf("Unexpected result of loading empty input, err=%v", err)
+	}
+}
+
+func TestLoadSortedErrors(t *testing.T) {
+	parse := func(line []byte) (Prefix, Item, error) {
+		if len(line) == 0 {
+			return nil, nil, errors.New("empty line")
+		}
+		return Prefix(line), nil, nil
+	}
+
+	for _, input := range []string{"b\na\n", "a\nb\nb\n", "ab\na"} {
+		if _, err := LoadSorted(strings.NewReader(input), parse); !errors.Is(err, ErrUnsortedInput) {
+			t.Errorf("Unexpected error for %q, expected=%v, got=%v", input, ErrUnsortedInput, err)
+		}
+	}
+
+	_, err := LoadSorted(strings.NewReader("a\n\nb\n"), parse)
+	if err == nil || err.Error() != "line 2: empty line" {
+		t.Errorf("Unexpected error, expected=line 2: empty line, got=%v", err)
+	}
+}
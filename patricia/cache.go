@@ -0,0 +1,182 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+)
+
+// QueryCacheStats reports how successful the query cache has been so far.
+type QueryCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// NewTrieWithQueryCache constructs a new trie that caches the results of
+// up to size most recently used VisitFuzzy queries.
+//
+// A repeated query is answered from the cache as long as the trie has not been
+// modified since the results were cached. Any modification of the trie
+// invalidates the whole cache. The results of a query whose visitor returned
+// SkipSubtree are incomplete and they are not cached. The cache is synchronized
+// internally, so it is still safe to run queries concurrently.
+func NewTrieWithQueryCache(size int) *Trie {
+	trie := NewTrie()
+	trie.opts = &trieOptions{
+		cache: newQueryCache(size),
+	}
+	return trie
+}
+
+// CacheStats returns the hit and miss counts of the query cache.
+// Zero stats are returned when the trie has no query cache.
+func (trie *Trie) CacheStats() QueryCacheStats {
+	if trie.opts == nil || trie.opts.cache == nil {
+		return QueryCacheStats{}
+	}
+	cache := trie.opts.cache
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.stats
+}
+
+type queryCacheKey struct {
+	query           string
+	caseInsensitive bool
+}
+
+type fuzzyResult struct {
+	key     Prefix
+	item    Item
+	skipped int
+}
+
+type queryCacheEntry struct {
+	key     queryCacheKey
+	results []fuzzyResult
+}
+
+type queryCache struct {
+	mu sync.Mutex
+
+	size    int
+	version uint64
+	order   *list.List
+	entries map[queryCacheKey]*list.Element
+	stats   QueryCacheStats
+}
+
+func newQueryCache(size int) *queryCache {
+	if size < 1 {
+		size = 1
+	}
+	return &queryCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[queryCacheKey]*list.Element),
+	}
+}
+
+func (cache *queryCache) get(key queryCacheKey, version uint64) ([]fuzzyResult, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.version != version {
+		cache.order.Init()
+		cache.entries = make(map[queryCacheKey]*list.Element)
+		cache.version = version
+	}
+
+	elem, ok := cache.entries[key]
+	if !ok {
+		cache.stats.Misses++
+		return nil, false
+	}
+
+	cache.stats.Hits++
+	cache.order.MoveToFront(elem)
+	return elem.Value.(*queryCacheEntry).results, true
+}
+
+func (cache *queryCache) put(key queryCacheKey, version uint64, results []fuzzyResult) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	// Results of a query that was running during a modification are stale.
+	if cache.version != version {
+		return
+	}
+
+	if elem, ok := cache.entries[key]; ok {
+		elem.Value.(*queryCacheEntry).results = results
+		cache.order.MoveToFront(elem)
+		return
+	}
+
+	cache.entries[key] = cache.order.PushFront(&queryCacheEntry{key, results})
+	if cache.order.Len() > cache.size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*queryCacheEntry).key)
+	}
+}
+
+func (cache *queryCache) clone() *queryCache {
+	if cache == nil {
+		return nil
+	}
+	return newQueryCache(cache.size)
+}
+
+func (trie *Trie) visitFuzzyCached(partial Prefix, caseInsensitive bool, visitor FuzzyVisitorFunc) error {
+	cache := trie.opts.cache
+	key := queryCacheKey{string(partial), caseInsensitive}
+
+	if results, ok := cache.get(key, trie.opts.version); ok {
+		// SkipSubtree skips the keys stored under the key visited, the same way
+		// the walk skips them when the results are not cached.
+		var skip Prefix
+		for _, r := range results {
+			if skip != nil && bytes.HasPrefix(r.key, skip) {
+				continue
+			}
+			skip = nil
+			if err := visitor(append(Prefix(nil), r.key...), r.item, r.skipped); err != nil {
+				if err == SkipSubtree {
+					skip = r.key
+					continue
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	var (
+		results    []fuzzyResult
+		incomplete bool
+	)
+	params := fuzzyParams{FuzzyOptions{CaseInsensitive: caseInsensitive}, -1}
+	err := trie.visitFuzzy(partial, params, func(prefix Prefix, item Item, skipped int) error {
+		results = append(results, fuzzyResult{append(Prefix(nil), prefix...), item, skipped})
+		err := visitor(prefix, item, skipped)
+		if err == SkipSubtree {
+			incomplete = true
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Skipping a subtree leaves some of the results out, they cannot be cached.
+	if !incomplete {
+		cache.put(key, trie.opts.version, results)
+	}
+	return nil
+}
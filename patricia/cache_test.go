@@ -0,0 +1,120 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_QueryCache(t *testing.T) {
+	trie := NewTrieWithQueryCache(8)
+	for _, key := range []string{"Pepan", "Pepin", "Honza", "Pepanek"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	collect := func(query string) map[string]int {
+		resultMap := make(map[string]int)
+		trie.VisitFuzzy(Prefix(query), false, func(prefix Prefix, item Item, skipped int) error {
+			resultMap[string(prefix)] = skipped
+			return nil
+		})
+		return resultMap
+	}
+
+	first := collect("Ppn")
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 0, Misses: 1}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+
+	second := collect("Ppn")
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 1, Misses: 1}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("Cached results differ, expected %v, got %v", first, second)
+	}
+
+	trie.Insert(Prefix("Pepino"), struct{}{})
+	third := collect("Ppn")
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 1, Misses: 2}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+	if _, ok := third["Pepino"]; !ok {
+		t.Errorf("item Pepino not found in result set %v", third)
+	}
+
+	trie.Delete(Prefix("Pepan"))
+	fourth := collect("Ppn")
+	if stats := trie.CacheStats(); stats.Misses != 3 {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+	if _, ok := fourth["Pepan"]; ok {
+		t.Errorf("deleted item Pepan found in result set %v", fourth)
+	}
+}
+
+func TestTrie_QueryCacheEviction(t *testing.T) {
+	trie := NewTrieWithQueryCache(1)
+	trie.Insert(Prefix("Honza"), struct{}{})
+
+	visitor := func(prefix Prefix, item Item, skipped int) error {
+		return nil
+	}
+	trie.VisitFuzzy(Prefix("Ha"), false, visitor)
+	trie.VisitFuzzy(Prefix("nz"), false, visitor)
+	trie.VisitFuzzy(Prefix("Ha"), false, visitor)
+
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 0, Misses: 3}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+}
+
+func TestTrie_QueryCacheSkipSubtree(t *testing.T) {
+	trie := NewTrieWithQueryCache(8)
+	for _, key := range []string{"Pepan", "Pepin", "Honza", "Pepanek"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	collect := func(skip bool) []string {
+		var keys []string
+		err := trie.VisitFuzzy(Prefix("Ppn"), false, func(prefix Prefix, item Item, skipped int) error {
+			keys = append(keys, string(prefix))
+			if skip && string(prefix) == "Pepan" {
+				return SkipSubtree
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Unexpected error, expected=<nil>, got=%v", err)
+		}
+		return keys
+	}
+
+	// The incomplete results of a run skipping a subtree are not cached.
+	want := []string{"Pepan", "Pepin"}
+	for i := 0; i < 2; i++ {
+		if keys := collect(true); !reflect.DeepEqual(keys, want) {
+			t.Errorf("Unexpected keys, expected=%v, got=%v", want, keys)
+		}
+	}
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 0, Misses: 2}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+
+	// The cached results skip the subtree the same way.
+	if keys, all := collect(false), []string{"Pepan", "Pepanek", "Pepin"}; !reflect.DeepEqual(keys, all) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", all, keys)
+	}
+	if keys := collect(true); !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", want, keys)
+	}
+	if stats := trie.CacheStats(); stats != (QueryCacheStats{Hits: 1, Misses: 3}) {
+		t.Errorf("Unexpected cache stats, got %+v", stats)
+	}
+}
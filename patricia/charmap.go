@@ -0,0 +1,108 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// ErrInvalidCharmap is the panic value of NewTrieWithCharmap when the charmap
+// is longer than 64 bytes or it contains some byte more than once.
+var ErrInvalidCharmap = errors.New("Invalid charmap")
+
+// otherBit is the mask bit shared by the bytes missing in a custom charmap.
+const otherBit = 63
+
+// NewTrieWithCharmap constructs a new trie computing the node masks used to
+// prune the searches out of charmap instead of the default alphanumeric one.
+// Every byte of charmap gets its own mask bit in the order given. When charmap
+// is shorter than 64 bytes, all the other bytes share the last bit, otherwise
+// they are not represented in the masks at all, just like with the default
+// charmap. Picking the bytes the keys are made of, e.g. "ACGT" for DNA, makes
+// the pruning more effective.
+//
+// NewTrieWithCharmap panics with ErrInvalidCharmap when charmap is longer than
+// 64 bytes or when it contains duplicate bytes.
+func NewTrieWithCharmap(charmap string, options ...Option) *Trie {
+	masks := newCharmapMasks(charmap)
+	trie := NewTrie(options...)
+	trie.options().charmap = masks
+	return trie
+}
+
+// charmapMasks holds the mask bits of a custom charmap.
+// The nil value stands for the default charmap.
+type charmapMasks struct {
+	// bits[b] is the mask bit of the byte b.
+	bits [256]uint64
+	// fold[i] are the bits of the other case of the letters having bit i.
+	fold [64]uint64
+}
+
+func newCharmapMasks(charmap string) *charmapMasks {
+	if len(charmap) > 64 {
+		panic(ErrInvalidCharmap)
+	}
+
+	masks := &charmapMasks{}
+	for i := 0; i < len(charmap); i++ {
+		if masks.bits[charmap[i]] != 0 {
+			panic(ErrInvalidCharmap)
+		}
+		masks.bits[charmap[i]] = uint64(1) << uint64(i)
+	}
+	if len(charmap) < 64 {
+		for b := range masks.bits {
+			if masks.bits[b] == 0 {
+				masks.bits[b] = uint64(1) << otherBit
+			}
+		}
+	}
+
+	for b := 'A'; b <= 'Z'; b++ {
+		upper, lower := masks.bits[b], masks.bits[b+'a'-'A']
+		if upper != 0 && lower != 0 {
+			masks.fold[bits.TrailingZeros64(upper)] |= lower
+			masks.fold[bits.TrailingZeros64(lower)] |= upper
+		}
+	}
+	return masks
+}
+
+// masks returns the charmap masks of the trie, nil for the default charmap.
+func (opts *trieOptions) masks() *charmapMasks {
+	if opts == nil {
+		return nil
+	}
+	return opts.charmap
+}
+
+// prefixMask works like makePrefixMask for the charmap.
+func (masks *charmapMasks) prefixMask(key Prefix) uint64 {
+	if masks == nil {
+		return makePrefixMask(key)
+	}
+
+	var mask uint64
+	for _, b := range key {
+		mask |= masks.bits[b]
+	}
+	return mask
+}
+
+// foldMask works like caseInsensitiveMask for the charmap.
+func (masks *charmapMasks) foldMask(mask uint64) uint64 {
+	if masks == nil {
+		return caseInsensitiveMask(mask)
+	}
+
+	folded := mask
+	for rest := mask; rest != 0; rest &= rest - 1 {
+		folded |= masks.fold[bits.TrailingZeros64(rest)]
+	}
+	return folded
+}
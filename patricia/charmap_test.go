@@ -0,0 +1,103 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_CharmapMasks(t *testing.T) {
+	trie := NewTrieWithCharmap("ACGT")
+	for _, key := range []string{"AAAA", "CCCC", "GGGG", "TTTT", "NNNN"} {
+		trie.Insert(Prefix(key), key)
+	}
+	checkMasksRecursive(t, trie)
+
+	// The default charmap gives all the bases their own bits too,
+	// but the custom charmap packs them into the lowest bits.
+	masks := make(map[uint64]string)
+	for _, child := range trie.children.getChildren() {
+		if other, ok := masks[child.mask]; ok {
+			t.Errorf("Keys %q and %q have the same mask %b", other, child.prefix, child.mask)
+		}
+		masks[child.mask] = string(child.prefix)
+	}
+
+	want := map[uint64]string{1: "AAAA", 2: "CCCC", 4: "GGGG", 8: "TTTT", 1 << otherBit: "NNNN"}
+	if !reflect.DeepEqual(masks, want) {
+		t.Errorf("Unexpected masks, expected=%v, got=%v", want, masks)
+	}
+}
+
+func TestTrie_CharmapSearches(t *testing.T) {
+	trie := NewTrieWithCharmap("ACGTacgt")
+	reference := NewTrie()
+	for _, key := range []string{"ACGTAC", "acgt", "GATTACA", "TTNA", "CCXG"} {
+		trie.Insert(Prefix(key), 0)
+		reference.Insert(Prefix(key), 0)
+	}
+	trie.Delete(Prefix("acgt"))
+	reference.Delete(Prefix("acgt"))
+	checkMasksRecursive(t, trie)
+
+	collect := func(trie *Trie, query string, caseInsensitive bool) []string {
+		var keys []string
+		trie.VisitFuzzy(Prefix(query), caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+			keys = append(keys, string(prefix))
+			return nil
+		})
+		trie.VisitSubstring(Prefix(query), caseInsensitive, func(prefix Prefix, item Item) error {
+			keys = append(keys, "substring "+string(prefix))
+			return nil
+		})
+		sort.Strings(keys)
+		return keys
+	}
+
+	for _, query := range []string{"GA", "ga", "TN", "AX", "CA", "N", "ACG"} {
+		for _, caseInsensitive := range []bool{false, true} {
+			got, want := collect(trie, query, caseInsensitive), collect(reference, query, caseInsensitive)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Unexpected result set for %q (case-insensitive %v), expected=%v, got=%v",
+					query, caseInsensitive, want, got)
+			}
+		}
+	}
+
+	// The compiled queries are recompiled for the charmap.
+	q := CompileFuzzyQuery(Prefix("GTC"), false)
+	var keys []string
+	trie.VisitCompiled(q, func(prefix Prefix, item Item, skipped int) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"ACGTAC", "GATTACA"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, keys)
+	}
+
+	// Rebuilding keeps the charmap.
+	checkMasksRecursive(t, trie.Rebuild())
+	if mask := trie.Rebuild().mask; mask != trie.mask {
+		t.Errorf("Unexpected mask of the rebuilt trie, expected=%b, got=%b", trie.mask, mask)
+	}
+}
+
+func TestTrie_CharmapInvalid(t *testing.T) {
+	for _, charmap := range []string{"ACGTA", string(make([]byte, 65))} {
+		func() {
+			defer func() {
+				if err := recover(); err != ErrInvalidCharmap {
+					t.Errorf("Unexpected panic for %q, expected=%v, got=%v", charmap, ErrInvalidCharmap, err)
+				}
+			}()
+			NewTrieWithCharmap(charmap)
+		}()
+	}
+}
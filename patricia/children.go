@@ -8,6 +8,7 @@ package patricia
 import (
 	"io"
 	"sort"
+	"unsafe"
 )
 
 type childList interface {
@@ -23,27 +24,21 @@ type childList interface {
 	print(w io.Writer, indent int)
 	clone() childList
 	total() int
-}
-
-type tries []*Trie
-
-func (t tries) Len() int {
-	return len(t)
-}
-
-func (t tries) Less(i, j int) bool {
-	strings := sort.StringSlice{string(t[i].prefix), string(t[j].prefix)}
-	return strings.Less(0, 1)
-}
-
-func (t tries) Swap(i, j int) {
-	t[i], t[j] = t[j], t[i]
+	// fanout is the largest number of entries in a single level of the list,
+	// the buckets of a bucketed list forming a level of their own.
+	fanout() int
+	// memoryUsage is the number of bytes taken by the list itself,
+	// not including the children.
+	memoryUsage() int64
 }
 
 type childContainer struct {
 	char byte
 	node *Trie
 }
+
+// superDenseChildList keeps the children sorted by their first byte,
+// so all the traversals visit the children in ascending order.
 type superDenseChildList struct {
 	children []childContainer
 }
@@ -65,12 +60,18 @@ func (list *superDenseChildList) head() *Trie {
 	return nil
 }
 
+// add inserts the child keeping the children sorted by their first byte.
 func (list *superDenseChildList) add(child *Trie) childList {
 	char := child.prefix[0]
-	list.children = append(list.children, childContainer{
+	i := sort.Search(len(list.children), func(i int) bool {
+		return list.children[i].char >= char
+	})
+	list.children = append(list.children, childContainer{})
+	copy(list.children[i+1:], list.children[i:])
+	list.children[i] = childContainer{
 		char,
 		child,
-	})
+	}
 	return list
 }
 
@@ -137,8 +138,8 @@ func (list *superDenseChildList) walk(prefix *Prefix, visitor VisitorFunc) error
 	for _, child := range list.children {
 		node := child.node
 		*prefix = append(*prefix, node.prefix...)
-		if node.item != nil {
-			if err := visitor(*prefix, node.item); err != nil {
+		if node.hasItem {
+			if err := visitor(append(Prefix{}, *prefix...), node.item); err != nil {
 				if err == SkipSubtree {
 					*prefix = (*prefix)[:len(*prefix)-len(node.prefix)]
 					continue
@@ -180,3 +181,131 @@ func (list *superDenseChildList) clone() childList {
 func (list *superDenseChildList) total() int {
 	return len(list.children)
 }
+
+func (list *superDenseChildList) fanout() int {
+	return len(list.children)
+}
+
+func (list *superDenseChildList) memoryUsage() int64 {
+	return int64(unsafe.Sizeof(*list)) + int64(cap(list.children))*int64(unsafe.Sizeof(childContainer{}))
+}
+
+// bucketedChildList spreads the children over 16 buckets keyed by the high
+// nibble of their first byte, so a lookup scans at most 16 children no matter
+// how many children there are, see MaxFanout.
+// The buckets are ordered, so the children are still sorted.
+type bucketedChildList struct {
+	buckets [16]superDenseChildList
+	count   int
+}
+
+func newBucketedChildList(list *superDenseChildList) *bucketedChildList {
+	bucketed := &bucketedChildList{}
+	for _, child := range list.children {
+		bucketed.add(child.node)
+	}
+	return bucketed
+}
+
+func (list *bucketedChildList) length() int {
+	return list.count
+}
+
+func (list *bucketedChildList) head() *Trie {
+	for i := range list.buckets {
+		if head := list.buckets[i].head(); head != nil {
+			return head
+		}
+	}
+	return nil
+}
+
+func (list *bucketedChildList) add(child *Trie) childList {
+	list.buckets[child.prefix[0]>>4].add(child)
+	list.count++
+	return list
+}
+
+func (list *bucketedChildList) remove(b byte) {
+	bucket := &list.buckets[b>>4]
+	before := bucket.length()
+	bucket.remove(b)
+	list.count -= before - bucket.length()
+}
+
+func (list *bucketedChildList) replace(b byte, child *Trie) {
+	list.buckets[b>>4].replace(b, child)
+}
+
+func (list *bucketedChildList) next(b byte) *Trie {
+	return list.buckets[b>>4].next(b)
+}
+
+func (list *bucketedChildList) combinedMask() uint64 {
+	var mask uint64
+	for i := range list.buckets {
+		mask |= list.buckets[i].combinedMask()
+	}
+	return mask
+}
+
+func (list *bucketedChildList) getChildren() []*Trie {
+	children := make([]*Trie, 0, list.count)
+	for i := range list.buckets {
+		for _, child := range list.buckets[i].children {
+			children = append(children, child.node)
+		}
+	}
+	return children
+}
+
+func (list *bucketedChildList) walk(prefix *Prefix, visitor VisitorFunc) error {
+	for i := range list.buckets {
+		if err := list.buckets[i].walk(prefix, visitor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (list *bucketedChildList) print(w io.Writer, indent int) {
+	for i := range list.buckets {
+		list.buckets[i].print(w, indent)
+	}
+}
+
+func (list *bucketedChildList) clone() childList {
+	clone := &bucketedChildList{count: list.count}
+	for i := range list.buckets {
+		clone.buckets[i] = *list.buckets[i].clone().(*superDenseChildList)
+	}
+	return clone
+}
+
+func (list *bucketedChildList) total() int {
+	return list.count
+}
+
+func (list *bucketedChildList) fanout() int {
+	buckets, fanout := 0, 0
+	for i := range list.buckets {
+		if n := list.buckets[i].length(); n != 0 {
+			buckets++
+			if n > fanout {
+				fanout = n
+			}
+		}
+	}
+	if buckets > fanout {
+		return buckets
+	}
+	return fanout
+}
+
+func (list *bucketedChildList) memoryUsage() int64 {
+	size := int64(unsafe.Sizeof(*list))
+	for i := range list.buckets {
+		size += int64(cap(list.buckets[i].children)) * int64(unsafe.Sizeof(childContainer{}))
+	}
+	return size
+}
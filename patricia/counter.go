@@ -0,0 +1,75 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bytes"
+	"sort"
+)
+
+// CounterTrie is a trie counting the occurrences of its keys, e.g. of events,
+// with the most frequent keys under a prefix readily available.
+//
+// CounterTrie is not thread-safe, the same rules as for Trie apply.
+type CounterTrie struct {
+	trie *Trie
+}
+
+// CounterEntry is a key and its count.
+type CounterEntry struct {
+	Key   Prefix
+	Count int64
+}
+
+// NewCounterTrie constructs a new counter trie, the options are passed on
+// to the underlying trie.
+func NewCounterTrie(options ...Option) *CounterTrie {
+	return &CounterTrie{NewTrie(options...)}
+}
+
+// Incr adds by to the count of key, the keys not counted yet starting at 0.
+func (counter *CounterTrie) Incr(key Prefix, by int64) {
+	counter.trie.InsertMerge(key, by, func(old, new Item) Item {
+		return old.(int64) + by
+	})
+}
+
+// Count returns the count of key, 0 when key was never counted.
+func (counter *CounterTrie) Count(key Prefix) int64 {
+	count, _ := counter.trie.Get(key).(int64)
+	return count
+}
+
+// Len returns the number of keys counted.
+func (counter *CounterTrie) Len() int {
+	return counter.trie.Len()
+}
+
+// TopN returns at most n keys starting with prefix with the highest counts,
+// the highest count first. The keys with the same count are returned
+// in lexicographic order.
+func (counter *CounterTrie) TopN(prefix Prefix, n int) []CounterEntry {
+	if n <= 0 {
+		return nil
+	}
+
+	var top []CounterEntry
+	counter.trie.VisitSubtree(prefix, func(key Prefix, item Item) error {
+		top = append(top, CounterEntry{key, item.(int64)})
+		return nil
+	})
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return bytes.Compare(top[i].Key, top[j].Key) < 0
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestCounterTrie(t *testing.T) {
+	counter := NewCounterTrie()
+	for key, times := range map[string]int{"click/button": 5, "click/link": 7, "view/page": 9, "click": 1} {
+		for i := 0; i < times; i++ {
+			counter.Incr(Prefix(key), 1)
+		}
+	}
+	counter.Incr(Prefix("click/link"), -3)
+	counter.Incr(Prefix("view/home"), 4)
+
+	for key, want := range map[string]int64{"click/button": 5, "click/link": 4, "view/page": 9, "view/home": 4, "view": 0} {
+		if got := counter.Count(Prefix(key)); got != want {
+			t.Errorf("Unexpected count of %q, expected=%d, got=%d", key, want, got)
+		}
+	}
+	if n := counter.Len(); n != 5 {
+		t.Errorf("Unexpected number of keys, expected=5, got=%d", n)
+	}
+
+	want := []CounterEntry{{Prefix("view/page"), 9}, {Prefix("click/button"), 5}}
+	if got := counter.TopN(Prefix(""), 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+
+	// The ties are broken by the keys.
+	want = []CounterEntry{{Prefix("view/page"), 9}, {Prefix("click/button"), 5}, {Prefix("click/link"), 4}, {Prefix("view/home"), 4}}
+	if got := counter.TopN(Prefix(""), 4); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+
+	want = []CounterEntry{{Prefix("click/button"), 5}, {Prefix("click/link"), 4}, {Prefix("click"), 1}}
+	if got := counter.TopN(Prefix("click"), 5); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+	want = []CounterEntry{{Prefix("view/page"), 9}, {Prefix("view/home"), 4}}
+	if got := counter.TopN(Prefix("view"), 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+	if got := counter.TopN(Prefix("x"), 2); got != nil {
+		t.Errorf("Unexpected top keys, expected=nil, got=%v", got)
+	}
+}
+
+func TestCounterTrie_LargeCounts(t *testing.T) {
+	counter := NewCounterTrie()
+	counter.Incr(Prefix("a"), 1<<53)
+	counter.Incr(Prefix("b"), 1<<53)
+	counter.Incr(Prefix("b"), 1)
+
+	// The counts differ by less than a float64 can tell apart.
+	want := []CounterEntry{{Prefix("b"), 1<<53 + 1}, {Prefix("a"), 1 << 53}}
+	if got := counter.TopN(Prefix(""), 2); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+)
+
+// The binary format starts with a header consisting of the magic bytes and
+// the format version, followed by the number of entries. Every entry is then
+// encoded as the key length, the key, the item length and the item, the lengths
+// being written as uvarints. The entries are written in sorted order.
+//
+// The items are encoded using encoding/gob, so the concrete types stored
+// in the trie other than the basic types must be registered using gob.Register.
+
+const (
+	encodingMagic   = "PTRI"
+	encodingVersion = 1
+)
+
+// ErrInvalidEncoding is returned when decoding data not produced by MarshalBinary.
+var ErrInvalidEncoding = errors.New("Invalid trie encoding")
+
+// MarshalBinary encodes all the entries stored in the trie into the binary format.
+func (trie *Trie) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := trie.encode(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary inserts all the entries encoded in data into the trie.
+// The error of the key validator is returned for a key it rejects,
+// see WithKeyValidator.
+func (trie *Trie) UnmarshalBinary(data []byte) error {
+	return trie.decode(bytes.NewReader(data))
+}
+
+// EncodedSize returns the number of bytes MarshalBinary would produce without
+// building the encoding in memory. The items are still encoded one by one
+// to learn their sizes, -1 is returned when any of them cannot be encoded.
+func (trie *Trie) EncodedSize() int64 {
+	var buf [binary.MaxVarintLen64]byte
+	uvarintSize := func(x uint64) int64 {
+		return int64(binary.PutUvarint(buf[:], x))
+	}
+
+	size := int64(len(encodingMagic)) + uvarintSize(encodingVersion) + uvarintSize(uint64(trie.Len()))
+
+	var counter countingWriter
+	err := trie.VisitSorted(func(prefix Prefix, item Item) error {
+		counter = 0
+		if err := encodeItem(&counter, item); err != nil {
+			return err
+		}
+		size += uvarintSize(uint64(len(prefix))) + int64(len(prefix))
+		size += uvarintSize(uint64(counter)) + int64(counter)
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// countingWriter counts the bytes written, discarding them.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// WriteCompressed writes the binary format of the trie into w compressed
+// using gzip. The level is the gzip compression level, i.e. any of the
+// compress/gzip constants from gzip.HuffmanOnly to gzip.BestCompression.
+func (trie *Trie) WriteCompressed(w io.Writer, level int) error {
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	// Closing the writer twice is harmless, the deferred close only releases
+	// the writer when encoding fails.
+	defer zw.Close()
+
+	bw := bufio.NewWriter(zw)
+	if err := trie.encode(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadCompressed reads a trie written using WriteCompressed.
+func ReadCompressed(r io.Reader) (*Trie, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	trie := NewTrie()
+	if err := trie.decode(bufio.NewReader(zr)); err != nil {
+		return nil, err
+	}
+	return trie, nil
+}
+
+func (trie *Trie) encode(w io.Writer) error {
+	var (
+		buf     [binary.MaxVarintLen64]byte
+		itemBuf bytes.Buffer
+	)
+
+	writeUvarint := func(x uint64) error {
+		_, err := w.Write(buf[:binary.PutUvarint(buf[:], x)])
+		return err
+	}
+
+	if _, err := io.WriteString(w, encodingMagic); err != nil {
+		return err
+	}
+	if err := writeUvarint(encodingVersion); err != nil {
+		return err
+	}
+	if err := writeUvarint(uint64(trie.Len())); err != nil {
+		return err
+	}
+
+	return trie.VisitSorted(func(prefix Prefix, item Item) error {
+		itemBuf.Reset()
+		if err := encodeItem(&itemBuf, item); err != nil {
+			return err
+		}
+
+		if err := writeUvarint(uint64(len(prefix))); err != nil {
+			return err
+		}
+		if _, err := w.Write(prefix); err != nil {
+			return err
+		}
+		if err := writeUvarint(uint64(itemBuf.Len())); err != nil {
+			return err
+		}
+		_, err := w.Write(itemBuf.Bytes())
+		return err
+	})
+}
+
+func (trie *Trie) decode(r io.ByteReader) error {
+	readBytes := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		// Do not trust the length too much when allocating.
+		capacity := n
+		if capacity > 4096 {
+			capacity = 4096
+		}
+		data := make([]byte, 0, capacity)
+		for i := uint64(0); i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, b)
+		}
+		return data, nil
+	}
+
+	for i := 0; i < len(encodingMagic); i++ {
+		if b, err := r.ReadByte(); err != nil || b != encodingMagic[i] {
+			return ErrInvalidEncoding
+		}
+	}
+	if version, err := binary.ReadUvarint(r); err != nil || version != encodingVersion {
+		return ErrInvalidEncoding
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ErrInvalidEncoding
+	}
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readBytes()
+		if err != nil {
+			return ErrInvalidEncoding
+		}
+		data, err := readBytes()
+		if err != nil {
+			return ErrInvalidEncoding
+		}
+
+		item, err := decodeItem(data)
+		if err != nil {
+			return err
+		}
+		if err := trie.checkKey(key); err != nil {
+			return err
+		}
+		trie.put(key, item, true, nil)
+	}
+
+	return nil
+}
+
+func encodeItem(w io.Writer, item Item) error {
+	return gob.NewEncoder(w).Encode(&item)
+}
+
+func decodeItem(data []byte) (item Item, err error) {
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&item)
+	return
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func populateEncodingTrie(t *testing.T) *Trie {
+	trie := NewTrie()
+	names := []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek"}
+	for i := 0; i < 1000; i++ {
+		for j, name := range names {
+			key := fmt.Sprintf("%s %d", name, i)
+			if ok := trie.Insert(Prefix(key), key+" Zdepan"); !ok {
+				t.Fatalf("Couldn't insert item %s", key)
+			}
+			if i == 0 {
+				trie.Insert(Prefix(name), j)
+			}
+		}
+	}
+	trie.Insert(Prefix(""), 3.5)
+	return trie
+}
+
+func checkSameEntries(t *testing.T, want, got *Trie) {
+	wantEntries, gotEntries := want.SortedEntries(), got.SortedEntries()
+	if len(wantEntries) != len(gotEntries) {
+		t.Fatalf("Unexpected number of entries, expected=%d, got=%d", len(wantEntries), len(gotEntries))
+	}
+	for i, entry := range wantEntries {
+		if !bytes.Equal(entry.Key, gotEntries[i].Key) || entry.Item != gotEntries[i].Item {
+			t.Errorf("Unexpected entry, expected=%q: %v, got=%q: %v",
+				entry.Key, entry.Item, gotEntries[i].Key, gotEntries[i].Item)
+		}
+	}
+}
+
+func TestTrie_MarshalBinary(t *testing.T) {
+	trie := populateEncodingTrie(t)
+
+	data, err := trie.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := NewTrie()
+	if err := decoded.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	checkSameEntries(t, trie, decoded)
+	checkMasksRecursive(t, decoded)
+
+	if err := NewTrie().UnmarshalBinary(data[:len(data)-1]); err != ErrInvalidEncoding {
+		t.Errorf("Unexpected error for truncated data, expected=%v, got=%v", ErrInvalidEncoding, err)
+	}
+	if err := NewTrie().UnmarshalBinary([]byte("garbage")); err != ErrInvalidEncoding {
+		t.Errorf("Unexpected error for garbage, expected=%v, got=%v", ErrInvalidEncoding, err)
+	}
+}
+
+func TestTrie_WriteCompressed(t *testing.T) {
+	trie := populateEncodingTrie(t)
+
+	raw, err := trie.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := trie.WriteCompressed(&buf, gzip.BestCompression); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() >= len(raw) {
+		t.Errorf("Compressed output not smaller, raw=%d, compressed=%d", len(raw), buf.Len())
+	}
+
+	decoded, err := ReadCompressed(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameEntries(t, trie, decoded)
+
+	if err := trie.WriteCompressed(&buf, 42); err == nil {
+		t.Error("Invalid compression level accepted")
+	}
+}
+
+func TestTrie_EncodedSize(t *testing.T) {
+	small := NewTrie()
+	small.Insert(Prefix("Pepan"), 1)
+	small.Insert(Prefix("Pepanek"), "Zdepan")
+
+	for _, trie := range []*Trie{NewTrie(), small, populateEncodingTrie(t)} {
+		data, err := trie.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := trie.EncodedSize(); size != int64(len(data)) {
+			t.Errorf("Unexpected encoded size, expected=%d, got=%d", len(data), size)
+		}
+	}
+
+	trie := NewTrie()
+	trie.Insert(Prefix("func"), func() {})
+	if size := trie.EncodedSize(); size != -1 {
+		t.Errorf("Unexpected encoded size of an item that cannot be encoded, expected=-1, got=%d", size)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"errors"
+)
+
+// WithByteEquivalence makes the lookups treat the bytes for which equal
+// returns true as the same byte, e.g. '-' and '_' in identifiers. The keys
+// are still stored as they were inserted, the equivalence is only consulted
+// at query time by Get, Match, GetWithDefault, GetEntry, NodeKind, MatchSubtree,
+// VisitSubtree and VisitPrefixes.
+//
+// A query can then match multiple stored keys, so the lookups can no longer
+// follow a single path down the trie and they are slower than exact matching.
+// When multiple keys match, Get and friends return the item stored under
+// the key equal to the query if there is one and the first key in the visiting
+// order otherwise. The visitors visit all the matching keys.
+//
+// Insert, Delete and the other modifying methods as well as the fuzzy and
+// substring searches keep matching the bytes exactly. This includes the keys
+// visited by DeleteSubtreeCollect, MovePrefix and ExpireUnder, which are
+// the keys they delete.
+func WithByteEquivalence(equal func(a, b byte) bool) Option {
+	return func(trie *Trie) {
+		trie.options().byteEquiv = equal
+	}
+}
+
+// errEquivalentFound stops the equivalent lookups once a match is found.
+var errEquivalentFound = errors.New("Equivalent key found")
+
+// visitEquivalent descends along key using the byte equivalence and calls
+// visit for every node matching the beginning of key. The path is the stored
+// key up to and including the whole node prefix, rest is the part of key not
+// matched yet and leftover is the part of the node prefix not matched by key.
+// Either rest or leftover is always empty.
+func (trie *Trie) visitEquivalent(key Prefix, caseInsensitive bool, visit func(node *Trie, path, rest, leftover Prefix) error) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	equal := trie.opts.byteEquiv
+	match := func(a, b byte) bool {
+		return a == b || equal(a, b) || (caseInsensitive && matchCaseInsensitive(a, b))
+	}
+
+	var descend func(node *Trie, path, key Prefix) error
+	descend = func(node *Trie, path, key Prefix) error {
+		common := 0
+		for common < len(key) && common < len(node.prefix) && match(node.prefix[common], key[common]) {
+			common++
+		}
+		path = append(path[:len(path):len(path)], node.prefix...)
+
+		// The whole key matched, the node is the last one to visit.
+		if common == len(key) {
+			return visit(node, path, nil, node.prefix[common:])
+		}
+
+		// Partial match means that there is no subtree matching key.
+		if common < len(node.prefix) {
+			return nil
+		}
+
+		key = key[common:]
+		if err := visit(node, path, key, nil); err != nil {
+			return err
+		}
+		for _, child := range node.children.getChildren() {
+			if match(child.prefix[0], key[0]) {
+				if err := descend(child, path, key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return descend(trie, nil, key)
+}
+
+// getEquivalent returns the entry stored under the key equivalent to key,
+// preferring the key equal to key.
+func (trie *Trie) getEquivalent(key Prefix) (storedKey Prefix, item Item, ok bool) {
+	if path, found, leftover := trie.findSubtreePath(key); found && len(leftover) == 0 && path[len(path)-1].hasItem {
+		return append(Prefix{}, key...), path[len(path)-1].item, true
+	}
+
+	trie.visitEquivalent(key, false, func(node *Trie, path, rest, leftover Prefix) error {
+		if len(rest) == 0 && len(leftover) == 0 && node.hasItem {
+			storedKey, item, ok = append(Prefix{}, path...), node.item, true
+			return errEquivalentFound
+		}
+		return nil
+	})
+	return
+}
+
+// nodeKindEquivalent works like NodeKind for a trie using the byte equivalence.
+func (trie *Trie) nodeKindEquivalent(prefix Prefix) NodeKind {
+	kind := NodeAbsent
+	trie.visitEquivalent(prefix, false, func(node *Trie, path, rest, leftover Prefix) error {
+		if len(rest) != 0 {
+			return nil
+		}
+		if len(leftover) == 0 && node.hasItem {
+			kind = NodeItem
+			return errEquivalentFound
+		}
+		kind = NodeInternal
+		return nil
+	})
+	return kind
+}
+
+// visitSubtreeEquivalent works like VisitSubtree for a trie using the byte equivalence.
+func (trie *Trie) visitSubtreeEquivalent(prefix Prefix, visitor VisitorFunc) error {
+	return trie.visitEquivalent(prefix, false, func(node *Trie, path, rest, leftover Prefix) error {
+		if len(rest) != 0 {
+			return nil
+		}
+		return node.walk(path, visitor)
+	})
+}
+
+// visitPrefixesEquivalent works like VisitPrefixesMinLen for a trie using the byte equivalence.
+func (trie *Trie) visitPrefixesEquivalent(key Prefix, minLen int, caseInsensitive bool, visitor VisitorFunc) error {
+	return trie.visitEquivalent(key, caseInsensitive, func(node *Trie, path, rest, leftover Prefix) error {
+		if len(leftover) != 0 || !node.hasItem || len(path) < minLen {
+			return nil
+		}
+		return visitor(append(Prefix{}, path...), node.item)
+	})
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func dashUnderscore(a, b byte) bool {
+	return (a == '-' || a == '_') && (b == '-' || b == '_')
+}
+
+func TestTrie_ByteEquivalenceGet(t *testing.T) {
+	trie := NewTrie(WithByteEquivalence(dashUnderscore))
+	trie.Insert(Prefix("a_b"), 1)
+	trie.Insert(Prefix("a_c_d"), 2)
+	trie.Insert(Prefix("x"), 3)
+
+	if item := trie.Get(Prefix("a-b")); item != 1 {
+		t.Errorf("Unexpected item, expected=1, got=%v", item)
+	}
+	if !trie.Match(Prefix("a-c-d")) {
+		t.Error("a-c-d not matched")
+	}
+	if trie.Match(Prefix("a-c")) {
+		t.Error("a-c matched")
+	}
+	if !trie.MatchSubtree(Prefix("a-c-")) {
+		t.Error("a-c- subtree not matched")
+	}
+	if kind := trie.NodeKind(Prefix("a-c")); kind != NodeInternal {
+		t.Errorf("Unexpected node kind, expected=%v, got=%v", NodeInternal, kind)
+	}
+	if item := trie.GetWithDefault(Prefix("a-x"), -1); item != -1 {
+		t.Errorf("Unexpected item, expected=-1, got=%v", item)
+	}
+
+	key, item, ok := trie.GetEntry(Prefix("a-c-d"))
+	if !ok || string(key) != "a_c_d" || item != 2 {
+		t.Errorf("Unexpected entry, expected=a_c_d 2 true, got=%s %v %v", key, item, ok)
+	}
+}
+
+func TestTrie_ByteEquivalencePrefersExactMatch(t *testing.T) {
+	trie := NewTrie(WithByteEquivalence(dashUnderscore))
+	trie.Insert(Prefix("a_b"), 1)
+	trie.Insert(Prefix("a-b"), 2)
+
+	if item := trie.Get(Prefix("a-b")); item != 2 {
+		t.Errorf("Unexpected item, expected=2, got=%v", item)
+	}
+	if item := trie.Get(Prefix("a_b")); item != 1 {
+		t.Errorf("Unexpected item, expected=1, got=%v", item)
+	}
+
+	// The first key in the visiting order wins otherwise.
+	trie.Delete(Prefix("a_b"))
+	trie.Insert(Prefix("a__"), 3)
+	trie.Insert(Prefix("a-_"), 4)
+	if item := trie.Get(Prefix("a--")); item != 4 {
+		t.Errorf("Unexpected item, expected=4, got=%v", item)
+	}
+}
+
+func TestTrie_ByteEquivalenceVisitors(t *testing.T) {
+	trie := NewTrie(WithByteEquivalence(dashUnderscore))
+	for _, key := range []string{"a", "a_b", "a-b-c", "a_b_c", "a_x", "ab"} {
+		trie.Insert(Prefix(key), key)
+	}
+
+	var keys []string
+	trie.VisitSubtree(Prefix("a-b"), func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"a-b-c", "a_b", "a_b_c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected subtree keys, expected=%v, got=%v", want, keys)
+	}
+
+	keys = nil
+	trie.VisitPrefixes(Prefix("a-b_c"), false, func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"a", "a-b-c", "a_b", "a_b_c"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected prefix keys, expected=%v, got=%v", want, keys)
+	}
+
+	// Modifications stay exact.
+	if trie.Delete(Prefix("a-x")) {
+		t.Error("a-x deleted")
+	}
+}
+
+func asciiCase(a, b byte) bool {
+	return toLower(a) == toLower(b)
+}
+
+func TestTrie_ByteEquivalenceVisitThenDelete(t *testing.T) {
+	newTrie := func() *Trie {
+		trie := NewTrie(WithByteEquivalence(asciiCase))
+		trie.Insert(Prefix("Abc"), 1)
+		trie.Insert(Prefix("abd"), 2)
+		return trie
+	}
+
+	trie := newTrie()
+	entries := trie.DeleteSubtreeCollect(Prefix("a"))
+	if want := []Entry{{Prefix("abd"), 2}}; !reflect.DeepEqual(entries, want) {
+		t.Errorf("Unexpected entries, expected=%v, got=%v", want, entries)
+	}
+	if n := trie.Len(); n != 1 || trie.Get(Prefix("Abc")) != 1 {
+		t.Errorf("Unexpected trie after DeleteSubtreeCollect, expected Abc only, got %v keys", n)
+	}
+
+	trie = newTrie()
+	if n := trie.MovePrefix(Prefix("a"), Prefix("z")); n != 1 {
+		t.Errorf("Unexpected number of keys moved, expected=1, got=%v", n)
+	}
+	var keys []string
+	trie.VisitSorted(func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"Abc", "zbd"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected keys after MovePrefix, expected=%v, got=%v", want, keys)
+	}
+
+	trie = newTrie()
+	expired := trie.ExpireUnder(Prefix("a"), time.Unix(1, 0), func(Item) time.Time {
+		return time.Unix(0, 0)
+	})
+	if expired != 1 || trie.Len() != 1 || trie.Get(Prefix("Abc")) != 1 {
+		t.Errorf("Unexpected ExpireUnder result, expected=1 expired and Abc kept, got=%v expired and %v keys", expired, trie.Len())
+	}
+
+	trie = NewTrie(WithByteEquivalence(asciiCase))
+	trie.Insert(Prefix("A"), 1)
+	trie.Insert(Prefix("abc"), 2)
+	if n := trie.DeletePrefixOrSubtree(Prefix("a"), true); n != 1 || trie.Get(Prefix("A")) != 1 {
+		t.Errorf("Unexpected DeletePrefixOrSubtree result, expected=1 deleted and A kept, got=%v deleted and %v keys", n, trie.Len())
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// WithStructureHooks makes the trie report the changes of its node structure,
+// so that indexes built over the nodes can be kept up to date. Any of the hooks
+// may be nil.
+//
+// onSplit is called when inserting a key splits a node, old being the key
+// of the node before the split and newParent the key of the new node holding
+// the common part, e.g. inserting "abd" into a trie holding just "abc" splits
+// "abc" with "ab" becoming the new parent. onMerge is called when a node is
+// merged with its only child, merged being the key of the resulting node.
+// Nodes are merged by Delete, by Compact, by Normalize and by Insert when
+// a split leaves a node that can be merged with its child.
+//
+// The keys passed to the hooks are copies. The hooks are called while the trie
+// is being modified, so they must not access the trie.
+func WithStructureHooks(onSplit func(old, newParent Prefix), onMerge func(merged Prefix)) Option {
+	return func(trie *Trie) {
+		opts := trie.options()
+		opts.onSplit = onSplit
+		opts.onMerge = onMerge
+	}
+}
+
+// split reports splitting the node with the key newParent + rest
+// at newParent, trie must be the root.
+func (trie *Trie) split(newParent, rest Prefix) {
+	if trie.opts == nil || trie.opts.onSplit == nil {
+		return
+	}
+	old := make(Prefix, 0, len(newParent)+len(rest))
+	old = append(append(old, newParent...), rest...)
+	trie.opts.onSplit(old, append(Prefix{}, newParent...))
+}
+
+// merged reports merging a node into the node with the key parentKey + prefix,
+// trie must be the root.
+func (trie *Trie) merged(parentKey, prefix Prefix) {
+	if trie.opts == nil || trie.opts.onMerge == nil {
+		return
+	}
+	merged := make(Prefix, 0, len(parentKey)+len(prefix))
+	trie.opts.onMerge(append(append(merged, parentKey...), prefix...))
+}
+
+// pathOffset returns the length of the key of the parent of node,
+// node being on path and path starting at the root.
+func pathOffset(path []*Trie, node *Trie) int {
+	offset := 0
+	for _, n := range path {
+		if n == node {
+			break
+		}
+		offset += len(n.prefix)
+	}
+	return offset
+}
+
+// WithAccessHook makes the lookups report the keys being looked up, so that
+// the access patterns can be analysed, e.g. to drive a cache or prefetching
+// layer on top of the trie. onAccess is called by Get, GetWithDefault, Match,
+// GetEntry and GetMany with the key passed to them and whether an item is
+// stored under it. The lookups done internally by the other methods are not
+// reported. Of the wrappers passing the option on to their trie, the reads
+// MultiTrie.GetAll, Set.Contains and CounterTrie.Count are reported the same
+// way, their modifying methods such as MultiTrie.DeleteValue are not.
+//
+// The key passed to the hook is the key passed to the lookup, not a copy.
+// The hook is called after the lookup is finished, so it may access the trie,
+// but it must not modify it.
+func WithAccessHook(onAccess func(prefix Prefix, hit bool)) Option {
+	return func(trie *Trie) {
+		trie.options().onAccess = onAccess
+	}
+}
+
+// accessed reports looking up key, trie must be the root.
+func (trie *Trie) accessed(key Prefix, hit bool) {
+	if trie.opts != nil && trie.opts.onAccess != nil {
+		trie.opts.onAccess(key, hit)
+	}
+}
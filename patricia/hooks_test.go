@@ -0,0 +1,146 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+type structureEvents struct {
+	splits [][2]string
+	merges []string
+}
+
+func newHookedTrie(options ...Option) (*Trie, *structureEvents) {
+	events := &structureEvents{}
+	options = append(options, WithStructureHooks(func(old, newParent Prefix) {
+		events.splits = append(events.splits, [2]string{string(old), string(newParent)})
+	}, func(merged Prefix) {
+		events.merges = append(events.merges, string(merged))
+	}))
+	return NewTrie(options...), events
+}
+
+func TestTrie_StructureHooksSplit(t *testing.T) {
+	trie, events := newHookedTrie()
+	trie.Insert(Prefix("abc"), 0)
+	if len(events.splits) != 0 {
+		t.Errorf("Unexpected splits, expected none, got=%v", events.splits)
+	}
+
+	trie.Insert(Prefix("abd"), 0)
+	if want := [][2]string{{"abc", "ab"}}; !reflect.DeepEqual(events.splits, want) {
+		t.Errorf("Unexpected splits, expected=%v, got=%v", want, events.splits)
+	}
+
+	// Extending existing nodes does not split anything.
+	trie.Insert(Prefix("abde"), 0)
+	trie.Insert(Prefix("ab"), 0)
+	if len(events.splits) != 1 || len(events.merges) != 0 {
+		t.Errorf("Unexpected events, expected one split, got=%v", events)
+	}
+}
+
+func TestTrie_StructureHooksMerge(t *testing.T) {
+	trie, events := newHookedTrie()
+	for _, key := range []string{"abcd", "abce", "abx", "z"} {
+		trie.Insert(Prefix(key), 0)
+	}
+
+	// "ab" is left with the single child "c", none of them holding an item.
+	trie.Delete(Prefix("abx"))
+	if want := []string{"abc"}; !reflect.DeepEqual(events.merges, want) {
+		t.Errorf("Unexpected merges, expected=%v, got=%v", want, events.merges)
+	}
+
+	// The empty root is merged with its remaining child.
+	trie.Delete(Prefix("z"))
+	if want := []string{"abc", "abc"}; !reflect.DeepEqual(events.merges, want) {
+		t.Errorf("Unexpected merges, expected=%v, got=%v", want, events.merges)
+	}
+
+	// Nodes holding items are never merged.
+	trie.Delete(Prefix("abcd"))
+	if want := []string{"abc", "abc"}; !reflect.DeepEqual(events.merges, want) {
+		t.Errorf("Unexpected merges, expected=%v, got=%v", want, events.merges)
+	}
+	if want := [][2]string{{"abcd", "abc"}, {"abc", "ab"}, {"ab", ""}}; !reflect.DeepEqual(events.splits, want) {
+		t.Errorf("Unexpected splits, expected=%v, got=%v", want, events.splits)
+	}
+}
+
+func TestTrie_StructureHooksMergeChildren(t *testing.T) {
+	trie, events := newHookedTrie()
+	for _, key := range []string{"z", "ab", "abcd", "abce"} {
+		trie.Insert(Prefix(key), 0)
+	}
+
+	// Deleting "ab" leaves the node with its single child "c".
+	trie.Delete(Prefix("ab"))
+	if want := []string{"abc"}; !reflect.DeepEqual(events.merges, want) {
+		t.Errorf("Unexpected merges, expected=%v, got=%v", want, events.merges)
+	}
+}
+
+func TestTrie_StructureHooksCompact(t *testing.T) {
+	trie, events := newHookedTrie(WithLazyDelete())
+	for _, key := range []string{"z", "abcd", "abce", "abx"} {
+		trie.Insert(Prefix(key), 0)
+	}
+	trie.Delete(Prefix("abx"))
+	if len(events.merges) != 0 {
+		t.Errorf("Unexpected merges, expected none, got=%v", events.merges)
+	}
+
+	trie.Compact()
+	if want := []string{"abc"}; !reflect.DeepEqual(events.merges, want) {
+		t.Errorf("Unexpected merges, expected=%v, got=%v", want, events.merges)
+	}
+}
+
+func TestTrie_AccessHook(t *testing.T) {
+	var accesses []string
+	trie := NewTrie(WithAccessHook(func(prefix Prefix, hit bool) {
+		accesses = append(accesses, fmt.Sprintf("%s:%v", prefix, hit))
+	}))
+	trie.Insert(Prefix("Pepa"), 1)
+	trie.Insert(Prefix("Pepik"), 2)
+	trie.Delete(Prefix("Pepik"))
+	if len(accesses) != 0 {
+		t.Errorf("Unexpected accesses reported by the modifications, got=%v", accesses)
+	}
+
+	trie.Get(Prefix("Pepa"))
+	trie.Get(Prefix("Pepik"))
+	trie.Match(Prefix("Pep"))
+	trie.GetWithDefault(Prefix("Pepa"), 0)
+	trie.GetEntry(Prefix("Honza"))
+
+	want := []string{"Pepa:true", "Pepik:false", "Pep:false", "Pepa:true", "Honza:false"}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("Unexpected accesses, expected=%v, got=%v", want, accesses)
+	}
+
+	// The wrappers report their reads only.
+	accesses = nil
+	multi := NewMultiTrie(WithAccessHook(func(prefix Prefix, hit bool) {
+		accesses = append(accesses, fmt.Sprintf("%s:%v", prefix, hit))
+	}))
+	multi.Insert(Prefix("Pepa"), 1)
+	multi.Insert(Prefix("Pepa"), 2)
+	multi.DeleteValue(Prefix("Pepa"), 1, nil)
+	multi.DeleteValue(Prefix("Honza"), 1, nil)
+	multi.GetAll(Prefix("Pepa"))
+
+	want = []string{"Pepa:true"}
+	if !reflect.DeepEqual(accesses, want) {
+		t.Errorf("Unexpected accesses of the multi trie, expected=%v, got=%v", want, accesses)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// WithInternedPrefixes makes the trie intern the key bytes stored in the nodes.
+// When a key is inserted, the part of it not shared with the keys already
+// stored becomes the prefix of the new nodes. That part is looked up in a pool
+// and identical parts then share a single backing array instead of each
+// getting its own copy. This saves memory when the same long segments keep
+// being stored below different branch points, e.g. paths with the same file
+// names appearing in many directories.
+//
+// This only pays off when the stored parts actually repeat. The pool keeps
+// its own copy of every distinct part as its map key, so the parts stored
+// only once take twice the memory, and every insertion creating new nodes
+// costs a map lookup. The pool is never shrunk, the parts stay in it even
+// after all the keys using them are deleted.
+//
+// The option has no effect on tries constructed using WithBorrowedKeys,
+// the caller's keys are retained as they are then.
+func WithInternedPrefixes() Option {
+	return func(trie *Trie) {
+		trie.options().interned = newInternPool()
+	}
+}
+
+// internPool maps the stored key parts to their shared copies.
+type internPool struct {
+	parts map[string]Prefix
+}
+
+func newInternPool() *internPool {
+	return &internPool{make(map[string]Prefix)}
+}
+
+func (pool *internPool) clone() *internPool {
+	if pool == nil {
+		return nil
+	}
+	return newInternPool()
+}
+
+// intern returns the shared copy of key, key itself is never retained.
+func (pool *internPool) intern(key Prefix) Prefix {
+	if stored, ok := pool.parts[string(key)]; ok {
+		return stored
+	}
+	stored := make(Prefix, len(key))
+	copy(stored, key)
+	pool.parts[string(stored)] = stored
+	return stored
+}
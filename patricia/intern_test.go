@@ -0,0 +1,95 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_InternedPrefixes(t *testing.T) {
+	trie := NewTrie(WithInternedPrefixes())
+	keys := []string{"a/x.txt", "a/readme.md", "b/x.txt", "b/readme.md", "c/readme.md"}
+	for i, key := range keys {
+		trie.Insert(Prefix(key), i)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	for i, key := range keys {
+		if item := trie.Get(Prefix(key)); item != i {
+			t.Errorf("Unexpected item of %q, expected=%v, got=%v", key, i, item)
+		}
+	}
+
+	// The "readme.md" nodes below "a/" and "b/" share their prefix.
+	var shared []Prefix
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if string(node.prefix) == "readme.md" {
+			shared = append(shared, node.prefix)
+		}
+		return nil
+	})
+	if len(shared) != 2 {
+		t.Fatalf("Unexpected number of readme.md nodes, expected=2, got=%d", len(shared))
+	}
+	if &shared[0][0] != &shared[1][0] {
+		t.Error("Identical prefixes do not share their storage")
+	}
+
+	// The inserted keys are never retained.
+	key := Prefix("d/readme.md")
+	trie.Insert(key, 5)
+	key[0] = 'e'
+	if item := trie.Get(Prefix("d/readme.md")); item != 5 {
+		t.Errorf("Unexpected item, expected=5, got=%v", item)
+	}
+}
+
+// Benchmarks ------------------------------------------------------------------
+
+func benchmarkInsertRepeatedSegments(options []Option, b *testing.B) {
+	// Long file names repeated in every directory.
+	names := make([]string, 50)
+	for i := range names {
+		name := make([]byte, 64)
+		for j := range name {
+			name[j] = byte(mrand.Intn(26) + 'a')
+		}
+		names[i] = string(name)
+	}
+	var keys []Prefix
+	for dir := 0; dir < 200; dir++ {
+		for _, name := range names {
+			keys = append(keys, Prefix(fmt.Sprintf("dir%d/%s", dir, name)))
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var bytes uint64
+	for i := 0; i < b.N; i++ {
+		before := heapAllocatedBytes()
+		trie := NewTrie(options...)
+		for _, key := range keys {
+			trie.Insert(key, struct{}{})
+		}
+		bytes += heapAllocatedBytes() - before
+		trie.Len()
+	}
+	b.ReportMetric(float64(bytes)/float64(b.N), "heap-B/trie")
+}
+
+func BenchmarkInsertRepeatedSegments(b *testing.B) {
+	benchmarkInsertRepeatedSegments(nil, b)
+}
+func BenchmarkInsertRepeatedSegmentsInterned(b *testing.B) {
+	benchmarkInsertRepeatedSegments([]Option{WithInternedPrefixes()}, b)
+}
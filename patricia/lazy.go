@@ -0,0 +1,72 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// WithLazyDelete makes Delete only clear the item of the node representing
+// the key, leaving the node in place as a tombstone instead of removing it and
+// merging its neighbours. Re-inserting a deleted key or a key sharing a prefix
+// with it then reuses the nodes, so churning keys does not keep splitting and
+// merging the same nodes.
+//
+// The tombstones keep the memory of the deleted keys, including their prefixes,
+// until Compact is called, so the trie can grow with every distinct key ever
+// inserted. Len and the other counts ignore the tombstones, the node counts
+// reported by Stats include them. DeleteSubtree still removes the nodes.
+func WithLazyDelete() Option {
+	return func(trie *Trie) {
+		trie.options().lazyDelete = true
+	}
+}
+
+// Compact removes the tombstones left by Delete in a trie constructed using
+// WithLazyDelete and merges the nodes the same way Delete does in tries that
+// do not delete lazily. The number of nodes removed is returned.
+func (trie *Trie) Compact() int {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return 0
+	}
+
+	before := trie.nodeCount()
+	trie.modified()
+	if trie.count == 0 {
+		trie.freeChildren(trie)
+		trie.reset()
+		return before - 1
+	}
+
+	masks := trie.opts.masks()
+	trie.compactChildren(trie, append(Prefix{}, trie.prefix...), masks)
+	if compacted := trie.compact(); compacted != trie {
+		compacted.opts = trie.opts
+		*trie = *compacted
+		trie.freeNode(compacted)
+		trie.merged(nil, trie.prefix)
+	}
+	trie.updateMask(masks)
+	return before - trie.nodeCount()
+}
+
+// compactChildren compacts the subtree of node having the key prefix,
+// trie must be the root.
+func (trie *Trie) compactChildren(node *Trie, prefix Prefix, masks *charmapMasks) {
+	for _, child := range node.children.getChildren() {
+		if child.count == 0 {
+			node.children.remove(child.prefix[0])
+			trie.freeSubtree(child)
+			continue
+		}
+
+		trie.compactChildren(child, append(prefix, child.prefix...), masks)
+		if compacted := child.compact(); compacted != child {
+			node.children.replace(child.prefix[0], compacted)
+			trie.freeNode(child)
+			child = compacted
+			trie.merged(prefix, child.prefix)
+		}
+		child.updateMask(masks)
+	}
+}
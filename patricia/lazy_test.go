@@ -0,0 +1,158 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_LazyDelete(t *testing.T) {
+	trie := NewTrie(WithLazyDelete())
+	for _, key := range []string{"Pepan", "Pepin", "Pepanek", "Honza"} {
+		trie.Insert(Prefix(key), key)
+	}
+	nodes := trie.Stats().NodeCount
+
+	trie.Delete(Prefix("Pepanek"))
+	trie.Delete(Prefix("Pepin"))
+	checkCountsRecursive(t, trie)
+	if trie.Len() != 2 {
+		t.Errorf("Unexpected number of items, expected=2, got=%d", trie.Len())
+	}
+	if count := trie.Stats().NodeCount; count != nodes {
+		t.Errorf("Unexpected node count, expected=%d, got=%d", nodes, count)
+	}
+
+	// The tombstones are invisible.
+	if trie.Match(Prefix("Pepin")) || trie.MatchSubtree(Prefix("Pepi")) {
+		t.Error("Pepin still matched")
+	}
+	if kind := trie.NodeKind(Prefix("Pepane")); kind != NodeAbsent {
+		t.Errorf("Unexpected node kind, expected=%v, got=%v", NodeAbsent, kind)
+	}
+	if fanout := trie.FanoutAt(Prefix("Pep")); fanout != 1 {
+		t.Errorf("Unexpected fanout, expected=1, got=%d", fanout)
+	}
+	var keys []string
+	trie.Visit(func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"Honza", "Pepan"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", want, keys)
+	}
+
+	// Re-inserting reuses the nodes.
+	trie.Insert(Prefix("Pepin"), "Pepin")
+	if count := trie.Stats().NodeCount; count != nodes {
+		t.Errorf("Unexpected node count, expected=%d, got=%d", nodes, count)
+	}
+
+	clone := trie.Clone()
+	clone.Delete(Prefix("Pepin"))
+	if removed := clone.Compact(); removed == 0 {
+		t.Error("No nodes removed by Compact")
+	}
+	checkMasksRecursive(t, clone)
+	checkCountsRecursive(t, clone)
+
+	eager := NewTrie()
+	for _, key := range []string{"Pepan", "Pepin", "Pepanek", "Honza"} {
+		eager.Insert(Prefix(key), key)
+	}
+	eager.Delete(Prefix("Pepanek"))
+	eager.Delete(Prefix("Pepin"))
+	if got, want := clone.Stats().NodeCount, eager.Stats().NodeCount; got != want {
+		t.Errorf("Unexpected node count after Compact, expected=%d, got=%d", want, got)
+	}
+	if !clone.Equal(eager, nil) {
+		t.Error("Compacted trie differs from the trie deleting eagerly")
+	}
+}
+
+func TestTrie_LazyDeleteCompactAll(t *testing.T) {
+	trie := NewTrie(WithLazyDelete())
+	trie.Insert(Prefix("Pepan"), 0)
+	trie.Insert(Prefix("Pepin"), 1)
+	trie.Delete(Prefix("Pepan"))
+	trie.Delete(Prefix("Pepin"))
+
+	if _, _, ok := trie.PopMin(); ok {
+		t.Error("Entry popped from a trie holding only tombstones")
+	}
+	trie.Compact()
+	if count := trie.Stats().NodeCount; count != 1 {
+		t.Errorf("Unexpected node count, expected=1, got=%d", count)
+	}
+	trie.Insert(Prefix("Karel"), 2)
+	if item := trie.Get(Prefix("Karel")); item != 2 {
+		t.Errorf("Unexpected item, expected=2, got=%v", item)
+	}
+}
+
+func TestTrie_LazyDeleteRandomized(t *testing.T) {
+	defer SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+	SetMaxPrefixPerNode(3)
+
+	lazy := NewTrie(WithLazyDelete())
+	eager := NewTrie()
+	rng := rand.New(rand.NewSource(7))
+	for i := 0; i < 3000; i++ {
+		key := make(Prefix, 1+rng.Intn(8))
+		for j := range key {
+			key[j] = "abc"[rng.Intn(3)]
+		}
+		if rng.Intn(2) == 0 {
+			lazy.Insert(key, i)
+			eager.Insert(key, i)
+		} else {
+			lazy.Delete(key)
+			eager.Delete(key)
+		}
+		if i%500 == 0 {
+			lazy.Compact()
+			checkMasksRecursive(t, lazy)
+		}
+		checkCountsRecursive(t, lazy)
+	}
+
+	if !lazy.Equal(eager, nil) {
+		t.Fatal("Lazy trie differs from the eager one")
+	}
+	lazy.Compact()
+	if got, want := lazy.Stats().NodeCount, eager.Stats().NodeCount; got > want {
+		t.Errorf("Unexpected node count after Compact, expected at most %d, got=%d", want, got)
+	}
+}
+
+// Benchmarks ------------------------------------------------------------------
+
+func benchmarkChurn(trie *Trie, b *testing.B) {
+	keys := make([]Prefix, 1024)
+	for i := range keys {
+		keys[i] = Prefix("/session/" + string(mrandBytes(wordLength)))
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		key := keys[i%len(keys)]
+		trie.Insert(key, struct{}{})
+		trie.Delete(key)
+	}
+}
+
+func BenchmarkChurnEagerDelete(b *testing.B) {
+	benchmarkChurn(NewTrie(), b)
+}
+
+func BenchmarkChurnLazyDelete(b *testing.B) {
+	benchmarkChurn(NewTrie(WithLazyDelete()), b)
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+)
+
+// MultiTrie is a trie storing multiple values under every key.
+// The values stored under a key are kept in the order they were inserted.
+//
+// MultiTrie is not thread-safe, the same rules as for Trie apply.
+type MultiTrie struct {
+	trie *Trie
+}
+
+// NewMultiTrie constructs a new multi-valued trie, the options are passed
+// on to the underlying trie.
+func NewMultiTrie(options ...Option) *MultiTrie {
+	return &MultiTrie{NewTrie(options...)}
+}
+
+// Insert appends item to the values stored under key.
+func (multi *MultiTrie) Insert(key Prefix, item Item) {
+	multi.trie.InsertMerge(key, []Item{item}, func(old, new Item) Item {
+		return append(old.([]Item), item)
+	})
+}
+
+// GetAll returns all the values stored under key in the order they were
+// inserted, nil when there are none. The slice returned is a copy.
+func (multi *MultiTrie) GetAll(key Prefix) []Item {
+	values, _ := multi.trie.Get(key).([]Item)
+	if len(values) == 0 {
+		return nil
+	}
+	return append([]Item(nil), values...)
+}
+
+// DeleteValue removes the first value stored under key that is equal to item
+// according to equal, reflect.DeepEqual being used when equal is nil.
+// The key itself is deleted along with its last value. True is returned
+// when a value was removed.
+func (multi *MultiTrie) DeleteValue(key Prefix, item Item, equal func(a, b Item) bool) (deleted bool) {
+	if equal == nil {
+		equal = func(a, b Item) bool {
+			return reflect.DeepEqual(a, b)
+		}
+	}
+
+	// Not reported as an access, see WithAccessHook.
+	stored, _ := multi.trie.get(key)
+	values, _ := stored.([]Item)
+	for i, value := range values {
+		if !equal(value, item) {
+			continue
+		}
+
+		if len(values) == 1 {
+			multi.trie.Delete(key)
+			return true
+		}
+
+		multi.trie.Set(key, append(values[:i:i], values[i+1:]...))
+		return true
+	}
+	return false
+}
+
+// Delete removes all the values stored under key.
+func (multi *MultiTrie) Delete(key Prefix) (deleted bool) {
+	return multi.trie.Delete(key)
+}
+
+// Len returns the number of keys stored in the trie.
+func (multi *MultiTrie) Len() int {
+	return multi.trie.Len()
+}
+
+// Visit calls visitor on every value stored in the trie, the keys being
+// visited in alphabetical order. The error handling works like in Trie.Visit,
+// SkipSubtree skips the remaining values of the key as well.
+func (multi *MultiTrie) Visit(visitor VisitorFunc) error {
+	return multi.trie.Visit(multiVisitor(visitor))
+}
+
+// VisitSubtree works much like Visit, but it only visits the keys
+// matching prefix.
+func (multi *MultiTrie) VisitSubtree(prefix Prefix, visitor VisitorFunc) error {
+	return multi.trie.VisitSubtree(prefix, multiVisitor(visitor))
+}
+
+// VisitPrefixes calls visitor on every value stored under the prefixes
+// of key, see Trie.VisitPrefixes.
+func (multi *MultiTrie) VisitPrefixes(key Prefix, caseInsensitive bool, visitor VisitorFunc) error {
+	return multi.trie.VisitPrefixes(key, caseInsensitive, multiVisitor(visitor))
+}
+
+// multiVisitor turns a visitor of the values into a visitor of the slices
+// of values stored in the underlying trie.
+func multiVisitor(visitor VisitorFunc) VisitorFunc {
+	return func(prefix Prefix, item Item) error {
+		for _, value := range item.([]Item) {
+			// Every call gets its own copy of the key.
+			if err := visitor(append(Prefix{}, prefix...), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
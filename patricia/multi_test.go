@@ -0,0 +1,81 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestMultiTrie_InsertGetDelete(t *testing.T) {
+	multi := NewMultiTrie()
+	multi.Insert(Prefix("abc"), 1)
+	multi.Insert(Prefix("abc"), 2)
+	multi.Insert(Prefix("abc"), 3)
+	multi.Insert(Prefix("abd"), 4)
+
+	if got, want := multi.GetAll(Prefix("abc")), []Item{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected values, expected=%v, got=%v", want, got)
+	}
+	if got := multi.GetAll(Prefix("ab")); got != nil {
+		t.Errorf("Unexpected values, expected=[], got=%v", got)
+	}
+
+	if !multi.DeleteValue(Prefix("abc"), 2, nil) {
+		t.Error("value 2 not deleted")
+	}
+	if multi.DeleteValue(Prefix("abc"), 5, nil) {
+		t.Error("value 5 deleted")
+	}
+	if got, want := multi.GetAll(Prefix("abc")), []Item{1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected values, expected=%v, got=%v", want, got)
+	}
+
+	// Deleting the last value deletes the key.
+	if !multi.DeleteValue(Prefix("abd"), 4, func(a, b Item) bool { return a == b }) {
+		t.Error("value 4 not deleted")
+	}
+	if multi.Len() != 1 {
+		t.Errorf("Unexpected number of keys, expected=1, got=%d", multi.Len())
+	}
+}
+
+func TestMultiTrie_Visit(t *testing.T) {
+	multi := NewMultiTrie()
+	multi.Insert(Prefix("abc"), 1)
+	multi.Insert(Prefix("ab"), 2)
+	multi.Insert(Prefix("abc"), 3)
+	multi.Insert(Prefix("x"), 4)
+
+	var got []Item
+	multi.VisitSubtree(Prefix("ab"), func(prefix Prefix, item Item) error {
+		got = append(got, item)
+		return nil
+	})
+	if want := []Item{2, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected values, expected=%v, got=%v", want, got)
+	}
+
+	got = nil
+	multi.Visit(func(prefix Prefix, item Item) error {
+		got = append(got, item)
+		return nil
+	})
+	if want := []Item{2, 1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected values, expected=%v, got=%v", want, got)
+	}
+
+	got = nil
+	multi.VisitPrefixes(Prefix("abcd"), false, func(prefix Prefix, item Item) error {
+		got = append(got, item)
+		return nil
+	})
+	if want := []Item{2, 1, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected values, expected=%v, got=%v", want, got)
+	}
+}
@@ -10,7 +10,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"strings"
+	"time"
+	"unicode/utf8"
+	"unsafe"
 )
 
 //------------------------------------------------------------------------------
@@ -19,6 +26,7 @@ import (
 
 const (
 	defaultMaxPrefixPerNode = 10
+	defaultMaxStringNodes   = 256
 )
 
 var (
@@ -34,32 +42,236 @@ type (
 	VisitorFunc func(prefix Prefix, item Item) error
 	// FuzzyVisitorFunc additionaly returns how many characters were skipped which can be sorted on
 	FuzzyVisitorFunc func(prefix Prefix, item Item, skipped int) error
+	// FuzzyDetailedVisitorFunc additionaly returns how many query characters were matched
+	FuzzyDetailedVisitorFunc func(prefix Prefix, item Item, skipped, matched int) error
+	// NodeVisitorFunc is the type of functions passed to VisitNodes
+	NodeVisitorFunc func(prefix Prefix, hasItem bool, childCount int, mask uint64) error
 )
 
+// NodeKind tells what is stored in the trie under a prefix, see Trie.NodeKind.
+type NodeKind int
+
+const (
+	// NodeAbsent means that no key starts with the prefix.
+	NodeAbsent NodeKind = iota
+	// NodeInternal means that the prefix is a path to some keys,
+	// but no item is stored under the prefix itself.
+	NodeInternal
+	// NodeItem means that an item is stored under the prefix.
+	NodeItem
+)
+
+// Relation tells how a key is related to the query of VisitRelated.
+type Relation int
+
+const (
+	// Ancestor means that the key is a proper prefix of the query.
+	Ancestor Relation = iota
+	// Exact means that the key is the query itself.
+	Exact
+	// Descendant means that the query is a proper prefix of the key.
+	Descendant
+)
+
+// Entry is a key and the item stored under that key.
+type Entry struct {
+	Key  Prefix
+	Item Item
+}
+
 // Trie is a generic patricia trie that allows fast retrieval of items by prefix.
 // and other funky stuff.
 //
-// Trie is not thread-safe.
+// Trie is not thread-safe. However, the methods not modifying the trie do not
+// modify any shared state either, so they can be called concurrently from
+// multiple goroutines as long as no goroutine is modifying the trie.
+//
+// All the visiting methods traverse the children of every node in ascending
+// order of their first byte, independently of the order the keys were inserted
+// in. This is a stable contract, the visiting order is always deterministic
+// and unless documented otherwise, the keys are visited in lexicographic order.
+//
+// Every call of a visitor receives its own copy of the key, so it is safe
+// to retain the key or modify it, also after the visiting method returns.
 type Trie struct {
 	prefix Prefix
 	item   Item
 	mask   uint64
 
+	// hasItem is set when an item is stored in the node, which may be nil.
+	hasItem bool
+
+	// weight is the weight of the key stored in the node, see AddWeight.
+	weight float64
+
+	// count is the number of items stored in the subtree.
+	count int
+
 	children childList
+
+	// opts is only set on the root node of a trie that has been constructed
+	// with some optional features enabled.
+	opts *trieOptions
+}
+
+// trieOptions holds the optional per-trie state.
+type trieOptions struct {
+	bloom    *bloomFilter
+	cache    *queryCache
+	eviction *evictionQueue
+	profile  *queryProfiles
+	refs     *refCounter
+	wal      *walWriter
+
+	// interned is the pool of the stored key parts, see WithInternedPrefixes.
+	interned *internPool
+
+	// newNode and freeNode are the allocator hooks, see NewTrieWithAllocator.
+	newNode  func() *Trie
+	freeNode func(*Trie)
+
+	// charmap holds the mask bits for NewTrieWithCharmap, nil for the default charmap.
+	charmap *charmapMasks
+
+	// byteEquiv is the byte equivalence used by the lookups, see WithByteEquivalence.
+	byteEquiv func(a, b byte) bool
+
+	// onSplit and onMerge are the structure hooks, see WithStructureHooks.
+	onSplit func(old, newParent Prefix)
+	onMerge func(merged Prefix)
+
+	// onAccess is the lookup hook, see WithAccessHook.
+	onAccess func(prefix Prefix, hit bool)
+
+	// validateKey checks the inserted keys, see WithKeyValidator.
+	validateKey func(Prefix) error
+
+	// maxFanout is the number of children above which the children
+	// are bucketed, see MaxFanout. Zero means no limit.
+	maxFanout int
+
+	borrowKeys bool
+	foldCase   bool
+	lazyDelete bool
+
+	// version is incremented on every modification of the trie.
+	version uint64
+}
+
+func (opts *trieOptions) clone() *trieOptions {
+	if opts == nil {
+		return nil
+	}
+	return &trieOptions{
+		bloom:       opts.bloom.clone(),
+		charmap:     opts.charmap,
+		cache:       opts.cache.clone(),
+		eviction:    opts.eviction.clone(),
+		interned:    opts.interned.clone(),
+		byteEquiv:   opts.byteEquiv,
+		borrowKeys:  opts.borrowKeys,
+		foldCase:    opts.foldCase,
+		lazyDelete:  opts.lazyDelete,
+		maxFanout:   opts.maxFanout,
+		validateKey: opts.validateKey,
+	}
+}
+
+// cloneEmpty works much like clone, but the Bloom filter and the eviction
+// order are cleared, so that the options can be used for a trie populated
+// with other keys.
+func (opts *trieOptions) cloneEmpty() *trieOptions {
+	clone := opts.clone()
+	if clone == nil {
+		return nil
+	}
+	if clone.bloom != nil {
+		clone.bloom = clone.bloom.cleared()
+	}
+	clone.eviction = clone.eviction.cleared()
+	return clone
 }
 
 // Public API ------------------------------------------------------------------
 
+// Option is a functional option that can be passed to NewTrie.
+type Option func(*Trie)
+
 // NewTrie constructs a new trie.
-func NewTrie() *Trie {
+func NewTrie(options ...Option) *Trie {
 	trie := &Trie{}
 
 	trie.children = newSuperDenseChildList()
 
 	trie.mask = 0
+
+	for _, opt := range options {
+		opt(trie)
+	}
+	return trie
+}
+
+// NewCaseInsensitiveTrie constructs a new trie that folds all the keys
+// to lower case, so keys differing only in case represent the same entry.
+//
+// The keys are folded when inserting as well as when looking them up, so the
+// original casing of the inserted keys is lost. Store it as part of the item
+// when it is needed. Only ASCII letters are folded.
+func NewCaseInsensitiveTrie(options ...Option) *Trie {
+	trie := NewTrie(options...)
+	trie.options().foldCase = true
 	return trie
 }
 
+// WithKeyValidator makes the trie check every key inserted using Insert, Set,
+// InsertMerge, InsertWithSplit and InsertChecked with validate before inserting
+// it. The keys validate returns an error for are not inserted, InsertChecked
+// returns the error, Insert and the others just return false or do nothing.
+// The keys are validated as passed in, before any folding. Lookups and
+// deletions never consult the validator. MovePrefix moves nothing when any
+// of the re-keyed keys is rejected, UnmarshalBinary stops at the first key
+// rejected and returns the error. Builder and LoadSorted construct new tries
+// without any options, so there is no validator to run.
+func WithKeyValidator(validate func(Prefix) error) Option {
+	return func(trie *Trie) {
+		trie.options().validateKey = validate
+	}
+}
+
+// MaxFanout bounds the number of children looked through when descending
+// from a node, so that a node with a huge fan-out, e.g. created by keys
+// diverging at the same position, does not degrade the lookups into a long
+// linear scan. Once a node gets more than n children, its children are spread
+// over an intermediate layer of 16 buckets keyed by the high nibble of their
+// first byte, every bucket holding at most 16 children. The lookups then scan
+// at most 16 children.
+//
+// The bucketing is internal to the child storage, the nodes and the keys are
+// not affected. Values of n below 16 are raised to 16, since the buckets can
+// hold up to 16 children. Stats reports the resulting fan-out. The tries built
+// using Builder do not bucket the children.
+func MaxFanout(n int) Option {
+	if n < 16 {
+		n = 16
+	}
+	return func(trie *Trie) {
+		trie.options().maxFanout = n
+	}
+}
+
+// WithBorrowedKeys makes the trie retain the key slices passed into Insert,
+// Set and friends instead of copying them, which saves an allocation
+// for every inserted key.
+//
+// The caller must not modify the inserted keys afterwards. Keys longer than
+// the maximum prefix length end up split into multiple nodes, but the nodes
+// still share the caller's backing array.
+func WithBorrowedKeys() Option {
+	return func(trie *Trie) {
+		trie.options().borrowKeys = true
+	}
+}
+
 // SetMaxPrefixPerNode sets the maximum length of a prefix before it is split into two nodes
 func SetMaxPrefixPerNode(value int) {
 	maxPrefixPerNode = value
@@ -68,11 +280,108 @@ func SetMaxPrefixPerNode(value int) {
 // Clone makes a copy of an existing trie.
 // Items stored in both tries become shared, obviously.
 func (trie *Trie) Clone() *Trie {
+	// Keep the empty root prefix non-nil, nil marks an empty trie.
+	var prefix Prefix
+	if trie.prefix != nil {
+		prefix = make(Prefix, len(trie.prefix))
+		copy(prefix, trie.prefix)
+	}
+
 	return &Trie{
-		prefix:   append(Prefix(nil), trie.prefix...),
+		prefix:   prefix,
 		item:     trie.item,
+		hasItem:  trie.hasItem,
+		weight:   trie.weight,
+		mask:     trie.mask,
+		count:    trie.count,
 		children: trie.children.clone(),
+		opts:     trie.opts.clone(),
+	}
+}
+
+// ReplaceWith swaps the contents of the tries, so trie ends up holding
+// what used to be stored in other and the other way around. The optional
+// features the tries were constructed with are swapped along with the contents.
+//
+// ReplaceWith modifies both tries, so it must not be called concurrently
+// with any other method of either trie.
+func (trie *Trie) ReplaceWith(other *Trie) {
+	*trie, *other = *other, *trie
+}
+
+// Rebuild returns a fresh trie holding the same entries, bulk loaded in sorted
+// order the same way LoadSorted loads them, so the structure carries
+// no leftovers of the past modifications. The optional features the trie was
+// constructed with are kept, except for the allocator, the same way Clone
+// keeps them. The weights are not kept.
+func (trie *Trie) Rebuild() *Trie {
+	rebuilt := NewTrie()
+	rebuilt.opts = trie.opts.clone()
+	loader := &sortedLoader{trie: rebuilt}
+	trie.VisitSorted(func(prefix Prefix, item Item) error {
+		loader.add(prefix, item)
+		return nil
+	})
+	rebuilt.finishLoaded(rebuilt.opts.masks())
+	return rebuilt
+}
+
+// Subtree returns a copy of the subtree matching prefix as an independent
+// trie, the keys being stripped of prefix, e.g. "dir/a" becomes "a" for prefix
+// "dir/". False is returned when there is no key matching prefix.
+//
+// The prefix is matched exactly, the byte equivalence classes are not applied.
+// The optional features the trie was constructed with are kept the same way
+// Clone keeps them, the Bloom filter and the eviction order are restricted
+// to the keys of the subtree.
+func (trie *Trie) Subtree(prefix Prefix) (*Trie, bool) {
+	// Nil prefix not allowed.
+	if prefix == nil {
+		panic(ErrNilPrefix)
+	}
+	prefix = trie.foldKey(prefix)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil, false
+	}
+
+	_, root, found, leftover := trie.findSubtree(prefix)
+	if !found || root.count == 0 {
+		return nil, false
+	}
+
+	subtree := root.Clone()
+	subtree.prefix = append(Prefix{}, leftover...)
+	subtree.opts = trie.opts.clone()
+	if subtree.opts != nil {
+		if subtree.opts.bloom != nil {
+			subtree.opts.bloom = subtree.opts.bloom.cleared()
+			subtree.walk(nil, func(key Prefix, item Item) error {
+				subtree.opts.bloom.add(key)
+				return nil
+			})
+		}
+		subtree.opts.eviction = subtree.opts.eviction.rebased(prefix)
 	}
+	subtree.updateMask(subtree.opts.masks())
+	return subtree, true
+}
+
+// String renders the trie as an indented tree of node prefixes, marking the
+// nodes holding an item with an asterisk. At most 256 nodes are rendered,
+// use StringLimit to change the limit.
+func (trie *Trie) String() string {
+	return trie.StringLimit(defaultMaxStringNodes)
+}
+
+// StringLimit works much like String, but it renders at most maxNodes nodes.
+// The rest of the trie is replaced with an ellipsis.
+func (trie *Trie) StringLimit(maxNodes int) string {
+	writer := &bytes.Buffer{}
+	budget := maxNodes
+	trie.printLimit(writer, 0, &budget)
+	return writer.String()
 }
 
 // Item returns the item stored in the root of this trie.
@@ -82,43 +391,235 @@ func (trie *Trie) Item() Item {
 
 // Insert inserts a new item into the trie using the given prefix. Insert does
 // not replace existing items. It returns false if an item was already in place.
+//
+// The empty key is a valid key as well, its item is stored in the root node.
 func (trie *Trie) Insert(key Prefix, item Item) (inserted bool) {
-	return trie.put(key, item, false)
+	if trie.checkKey(key) != nil {
+		return false
+	}
+	inserted, _ = trie.put(key, item, false, nil)
+	return
+}
+
+// InsertChecked works exactly like Insert, but it returns the error
+// of the key validator when the key is rejected, see WithKeyValidator.
+func (trie *Trie) InsertChecked(key Prefix, item Item) (inserted bool, err error) {
+	if err := trie.checkKey(key); err != nil {
+		return false, err
+	}
+	inserted, _ = trie.put(key, item, false, nil)
+	return inserted, nil
+}
+
+// InsertWithSplit works exactly like Insert, but it also returns the length
+// of the common prefix of the new key and the node prefix that had to be split
+// to insert it, i.e. where along the existing edge the key diverged. splitAt
+// is -1 when no node was split, e.g. when the key was appended as a new child.
+func (trie *Trie) InsertWithSplit(key Prefix, item Item) (ok bool, splitAt int) {
+	if trie.checkKey(key) != nil {
+		return false, -1
+	}
+	return trie.put(key, item, false, nil)
 }
 
 // Set works much like Insert, but it always sets the item, possibly replacing
 // the item previously inserted.
 func (trie *Trie) Set(key Prefix, item Item) {
-	trie.put(key, item, true)
+	if trie.checkKey(key) != nil {
+		return
+	}
+	trie.put(key, item, true, nil)
+}
+
+// InsertMerge works much like Insert, but when an item is already stored
+// under key, it is replaced with merge(old, item) and true is returned.
+// Otherwise item is inserted as it is and false is returned.
+func (trie *Trie) InsertMerge(key Prefix, item Item, merge func(old, new Item) Item) (merged bool) {
+	if trie.checkKey(key) != nil {
+		return false
+	}
+	trie.put(key, item, false, func(old, new Item) Item {
+		merged = true
+		return merge(old, new)
+	})
+	return
 }
 
 // Get returns the item located at key.
 //
-// This method is a bit dangerous, because Get can as well end up in an internal
-// node that is not really representing any user-defined value. So when nil is
-// a valid value being used, it is not possible to tell if the value was inserted
-// into the tree by the user or not. A possible workaround for this is not to use
-// nil interface as a valid value, even using zero value of any type is enough
-// to prevent this bad behaviour.
+// Nil is returned both when there is no item stored under key and when the item
+// stored is nil. Use Match or GetWithDefault to tell these cases apart.
 func (trie *Trie) Get(key Prefix) (item Item) {
-	_, node, found, leftover := trie.findSubtree(key)
-	if !found || len(leftover) != 0 {
-		return nil
+	item, ok := trie.get(key)
+	trie.accessed(key, ok)
+	return
+}
+
+// GetWithDefault works much like Get, but it returns def when there is no item
+// stored under key. A nil item stored under key is returned as it is.
+func (trie *Trie) GetWithDefault(key Prefix, def Item) Item {
+	item, ok := trie.get(key)
+	trie.accessed(key, ok)
+	if ok {
+		return item
 	}
-	return node.item
+	return def
 }
 
-// Match returns what Get(prefix) != nil would return. The same warning as for
-// Get applies here as well.
+// Match returns true when an item is stored under prefix, even a nil item.
 func (trie *Trie) Match(prefix Prefix) (matchedExactly bool) {
-	return trie.Get(prefix) != nil
+	_, matchedExactly = trie.get(prefix)
+	trie.accessed(prefix, matchedExactly)
+	return
+}
+
+// GetEntry works much like Get, but it also returns the key as stored in
+// the trie, i.e. folded to lower case for a case-insensitive trie, and whether
+// an item is stored under the key at all. The key returned is a copy.
+func (trie *Trie) GetEntry(prefix Prefix) (storedKey Prefix, item Item, ok bool) {
+	storedKey, item, ok = trie.getEntry(prefix)
+	trie.accessed(prefix, ok)
+	return
+}
+
+func (trie *Trie) getEntry(prefix Prefix) (storedKey Prefix, item Item, ok bool) {
+	prefix = trie.foldKey(prefix)
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		return trie.getEquivalent(prefix)
+	}
+
+	path, found, leftover := trie.findSubtreePath(prefix)
+	if !found || len(leftover) != 0 || !path[len(path)-1].hasItem {
+		return nil, nil, false
+	}
+
+	storedKey = make(Prefix, 0, len(prefix))
+	for _, node := range path {
+		storedKey = append(storedKey, node.prefix...)
+	}
+	return storedKey, path[len(path)-1].item, true
+}
+
+// GetMany works much like calling Get for every key, the items being returned
+// in the order of the keys, nil for the keys not present in the trie.
+//
+// Every key is looked up continuing from the nodes matching the part it shares
+// with the previous key, so sorting the keys saves descending from the root
+// for the keys sharing their prefixes.
+func (trie *Trie) GetMany(keys []Prefix) []Item {
+	items := make([]Item, len(keys))
+	if trie.prefix == nil || trie.opts != nil && trie.opts.byteEquiv != nil {
+		for i, key := range keys {
+			items[i] = trie.Get(key)
+		}
+		return items
+	}
+
+	// path holds the nodes matching the last key
+	// with the offsets of their prefixes within the key.
+	path := []loadedNode{{trie, 0}}
+	var last Prefix
+	for i, key := range keys {
+		folded := trie.foldKey(key)
+		common := 0
+		for common < len(folded) && common < len(last) && folded[common] == last[common] {
+			common++
+		}
+		last = folded
+
+		// Keep the nodes matching the shared part, the root always stays.
+		j := len(path) - 1
+		for j > 0 && path[j].start+len(path[j].node.prefix) > common {
+			j--
+		}
+		path = path[:j+1]
+
+		node := path[j].node
+		offset := path[j].start + len(node.prefix)
+		found := j > 0 || bytes.HasPrefix(folded, node.prefix)
+		for found && offset < len(folded) {
+			child := node.children.next(folded[offset])
+			if child == nil || !bytes.HasPrefix(folded[offset:], child.prefix) {
+				found = false
+				break
+			}
+			path = append(path, loadedNode{child, offset})
+			offset += len(child.prefix)
+			node = child
+		}
+
+		found = found && node.hasItem
+		if found {
+			items[i] = node.item
+		}
+		trie.accessed(key, found)
+	}
+	return items
+}
+
+// get returns the item located at key and whether it is present at all.
+func (trie *Trie) get(key Prefix) (item Item, ok bool) {
+	key = trie.foldKey(key)
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		_, item, ok = trie.getEquivalent(key)
+		return
+	}
+	if trie.opts != nil && trie.opts.bloom != nil && !trie.opts.bloom.mayContain(key) {
+		return nil, false
+	}
+
+	_, node, found, leftover := trie.findSubtree(key)
+	if !found || len(leftover) != 0 {
+		return nil, false
+	}
+	return node.item, node.hasItem
 }
 
 // MatchSubtree returns true when there is a subtree representing extensions
 // to key, that is if there are any keys in the tree which have key as prefix.
 func (trie *Trie) MatchSubtree(key Prefix) (matched bool) {
-	_, _, matched, _ = trie.findSubtree(key)
-	return
+	key = trie.foldKey(key)
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		return trie.nodeKindEquivalent(key) != NodeAbsent
+	}
+	_, node, matched, _ := trie.findSubtree(key)
+	// The subtree may only hold the tombstones of lazily deleted keys.
+	return matched && node.count != 0
+}
+
+// NodeKind tells whether an item is stored under prefix, prefix is only
+// a part of the path to some stored keys or it is not present at all.
+// A prefix ending in the middle of a node prefix is internal as well.
+func (trie *Trie) NodeKind(prefix Prefix) NodeKind {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return NodeAbsent
+	}
+
+	prefix = trie.foldKey(prefix)
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		return trie.nodeKindEquivalent(prefix)
+	}
+	return trie.nodeKindExact(prefix)
+}
+
+// nodeKindExact works like NodeKind, but it ignores the byte equivalence,
+// so that the modifying methods can tell what they are going to delete.
+func (trie *Trie) nodeKindExact(prefix Prefix) NodeKind {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return NodeAbsent
+	}
+
+	_, node, found, leftover := trie.findSubtree(prefix)
+	switch {
+	case !found || node.count == 0:
+		return NodeAbsent
+	case len(leftover) == 0 && node.hasItem:
+		return NodeItem
+	default:
+		return NodeInternal
+	}
 }
 
 // Visit calls visitor on every node containing a non-nil item
@@ -132,465 +633,2542 @@ func (trie *Trie) Visit(visitor VisitorFunc) error {
 	return trie.walk(nil, visitor)
 }
 
-func (trie *Trie) size() int {
-	n := 0
+// VisitSorted works much like Visit, but it always visits the items
+// in ascending lexicographic order of their keys.
+func (trie *Trie) VisitSorted(visitor VisitorFunc) error {
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	return trie.walkSorted(&prefix, visitor)
+}
 
-	err := trie.walk(nil, func(prefix Prefix, item Item) error {
-		n++
+// VisitNodes calls visitor on every node of the trie, including the internal
+// nodes that do not hold any item, in the same order as Visit does.
+// The structural details of the nodes are passed to visitor as well.
+//
+// Returning SkipSubtree from visitor skips the subtree of the current node.
+func (trie *Trie) VisitNodes(visitor NodeVisitorFunc) error {
+	return trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		return visitor(append(Prefix{}, prefix...), node.hasItem, node.children.length(), node.mask)
+	})
+}
+
+// VisitNodesSized works much like VisitNodes, but it passes the number
+// of items stored in the subtree of each node to visitor.
+func (trie *Trie) VisitNodesSized(visitor func(prefix Prefix, hasItem bool, subtreeSize int) error) error {
+	return trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		return visitor(append(Prefix{}, prefix...), node.hasItem, node.count)
+	})
+}
+
+// VisitDepthLimited calls visitor on every node that is at most maxDepth
+// levels below the root node, the root node being at level 0. Item is nil for
+// the internal nodes not holding any item. The nodes at level maxDepth that
+// have any children are reported as truncated.
+func (trie *Trie) VisitDepthLimited(maxDepth int, visitor func(prefix Prefix, item Item, truncated bool) error) error {
+	return trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		truncated := depth >= maxDepth && node.children.length() != 0
+		if err := visitor(append(Prefix{}, prefix...), node.item, truncated); err != nil {
+			return err
+		}
+		if truncated {
+			return SkipSubtree
+		}
 		return nil
 	})
+}
 
-	if err != nil {
-		panic(err)
+// VisitWithDepth works much like Visit, but it passes the depth of every key
+// to visitor as well. The depth is the number of edges between the empty key
+// and the key, i.e. the number of nodes with a non-empty prefix on the path
+// to the key, so the empty key is at depth 0 and with single-byte edges
+// the depth is the length of the key.
+func (trie *Trie) VisitWithDepth(visitor func(prefix Prefix, item Item, depth int) error) error {
+	// The root node is an edge of its own unless it represents the empty key.
+	rootEdges := 0
+	if len(trie.prefix) != 0 {
+		rootEdges = 1
 	}
+	return trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if !node.hasItem {
+			return nil
+		}
+		return visitor(append(Prefix{}, prefix...), node.item, depth+rootEdges)
+	})
+}
 
-	return n
+// TrimToDepth deletes all the keys that require more than maxDepth nodes
+// to be reached, the root node included, and returns the number of keys
+// deleted.
+func (trie *Trie) TrimToDepth(maxDepth int) int {
+	var prefixes []Prefix
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if depth+1 > maxDepth {
+			prefixes = append(prefixes, append(Prefix{}, prefix...))
+			return SkipSubtree
+		}
+		return nil
+	})
+
+	before := trie.Len()
+	for _, prefix := range prefixes {
+		trie.DeleteSubtree(prefix)
+	}
+	return before - trie.Len()
 }
 
-func (trie *Trie) total() int {
-	return 1 + trie.children.total()
+// Retain deletes all the keys for which pred returns false, keeping only
+// the keys pred accepts, and returns the number of keys deleted. pred is
+// called on every key first and the keys are deleted afterwards, so the nodes
+// are merged and the masks updated the same way Delete does it.
+func (trie *Trie) Retain(pred func(prefix Prefix, item Item) bool) int {
+	var rejected []Prefix
+	trie.walk(nil, func(prefix Prefix, item Item) error {
+		if !pred(prefix, item) {
+			rejected = append(rejected, prefix)
+		}
+		return nil
+	})
+
+	for _, key := range rejected {
+		trie.Delete(key)
+	}
+	return len(rejected)
 }
 
-// VisitSubtree works much like Visit, but it only visits nodes matching prefix.
-func (trie *Trie) VisitSubtree(prefix Prefix, visitor VisitorFunc) error {
+// MapItems replaces every item stored in the trie with the value fn returns
+// for it, visiting the keys in the same order as Visit does. Only the items
+// are replaced, the trie is never restructured, so fn must not modify it.
+func (trie *Trie) MapItems(fn func(prefix Prefix, item Item) Item) {
+	trie.modified()
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if !node.hasItem {
+			return nil
+		}
+
+		old := node.item
+		node.item = fn(append(Prefix{}, prefix...), old)
+		if trie.opts != nil && trie.opts.wal != nil {
+			trie.opts.wal.set(prefix, node.item)
+		}
+		// Acquire the new item first, so mapping an item to itself
+		// does not release it.
+		if trie.opts != nil && trie.opts.refs != nil {
+			trie.opts.refs.acquire(node.item)
+			trie.opts.refs.release(old)
+		}
+		return nil
+	})
+}
+
+// ExpireUnder deletes the keys starting with prefix whose items expired before
+// now, expiry returning the expiry time of an item, and returns the number of
+// keys deleted. Only the subtree of prefix is walked, so a namespace can be
+// expired without touching the rest of the trie.
+func (trie *Trie) ExpireUnder(prefix Prefix, now time.Time, expiry func(Item) time.Time) int {
 	// Nil prefix not allowed.
 	if prefix == nil {
 		panic(ErrNilPrefix)
 	}
 
-	// Empty trie must be handled explicitly.
-	if trie.prefix == nil {
+	var expired []Prefix
+	trie.visitSubtreeExact(trie.foldKey(prefix), func(key Prefix, item Item) error {
+		if expiry(item).Before(now) {
+			expired = append(expired, key)
+		}
 		return nil
+	})
+
+	for _, key := range expired {
+		trie.Delete(key)
 	}
+	return len(expired)
+}
 
-	// Locate the relevant subtree.
-	_, root, found, leftover := trie.findSubtree(prefix)
-	if !found {
+// SortedEntries returns all the entries stored in the trie in ascending
+// lexicographic order of their keys.
+func (trie *Trie) SortedEntries() []Entry {
+	entries := make([]Entry, 0, trie.Len())
+	trie.VisitSorted(func(prefix Prefix, item Item) error {
+		entries = append(entries, Entry{append(Prefix(nil), prefix...), item})
 		return nil
+	})
+	return entries
+}
+
+// SortedEntriesLimit works much like SortedEntries, but it returns at most
+// maxResults entries, the first ones in the order, so that a huge trie is not
+// materialized at once. truncated tells that there are more entries left,
+// Page can be used to fetch them.
+func (trie *Trie) SortedEntriesLimit(maxResults int) (entries []Entry, truncated bool) {
+	if maxResults < 0 {
+		maxResults = 0
 	}
-	prefix = append(prefix, leftover...)
+	entries, _, done := trie.Page(nil, maxResults)
+	return entries, !done
+}
 
-	// Visit it.
-	return root.walk(prefix, visitor)
+// MemoryUsage estimates the number of heap bytes taken by the nodes of the trie.
+// Every node is counted as the size of the node struct, the length of its prefix
+// and the size of its child list, including the capacity of the backing arrays
+// of the list. The items are opaque, so their payloads are not included,
+// neither is the state of the optional features such as the Bloom filter.
+//
+// The prefixes are counted by their lengths, the spare capacity of their
+// backing arrays is ignored, and the allocator overhead is not included either,
+// so the actual heap usage is somewhat higher.
+func (trie *Trie) MemoryUsage() int64 {
+	var size int64
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		size += int64(unsafe.Sizeof(*node)) + int64(len(node.prefix)) + node.children.memoryUsage()
+		return nil
+	})
+	if trie.prefix == nil {
+		// The empty root node is still allocated.
+		size = int64(unsafe.Sizeof(*trie)) + trie.children.memoryUsage()
+	}
+	return size
 }
 
-type potentialSubtree struct {
-	idx     int
-	skipped int
-	prefix  Prefix
-	node    *Trie
+// Stats describes the structure of a trie.
+type Stats struct {
+	// NodeCount is the number of nodes including the root node,
+	// which is present even in an empty trie.
+	NodeCount int
+	// MaxFanout is the largest fan-out of a node, i.e. the largest number
+	// of children of a node, or of its buckets or the children in a bucket
+	// when the children are bucketed, see MaxFanout.
+	MaxFanout int
 }
 
-// VisitFuzzy visits every node that is succesfully matched via fuzzy matching
-func (trie *Trie) VisitFuzzy(partial Prefix, caseInsensitive bool, visitor FuzzyVisitorFunc) error {
-	if len(partial) == 0 {
-		return trie.VisitPrefixes(partial, caseInsensitive, func(prefix Prefix, item Item) error {
-			return visitor(prefix, item, 0)
-		})
+// Stats returns the structural statistics of the trie.
+func (trie *Trie) Stats() Stats {
+	stats := Stats{
+		NodeCount: trie.nodeCount(),
 	}
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if fanout := node.children.fanout(); fanout > stats.MaxFanout {
+			stats.MaxFanout = fanout
+		}
+		return nil
+	})
+	return stats
+}
 
-	var (
-		m   uint64
-		cmp uint64
-		i   int
-		p   potentialSubtree
-	)
+func (trie *Trie) nodeCount() int {
+	count := 1
+	for _, child := range trie.children.getChildren() {
+		count += child.nodeCount()
+	}
+	return count
+}
 
-	potential := []potentialSubtree{potentialSubtree{node: trie, prefix: Prefix(""), idx: 0}}
-	for l := len(potential); l > 0; l = len(potential) {
-		i = l - 1
-		p = potential[i]
+// RootFanout returns the number of distinct first bytes of the keys.
+func (trie *Trie) RootFanout() int {
+	return trie.FanoutAt(Prefix{})
+}
 
-		potential = potential[:i]
-		m = makePrefixMask(partial[p.idx:])
+// FanoutAt returns the number of distinct bytes following prefix
+// in the keys starting with prefix.
+func (trie *Trie) FanoutAt(prefix Prefix) int {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return 0
+	}
 
-		if caseInsensitive {
-			cmp = caseInsensitiveMask(p.node.mask)
-		} else {
-			cmp = p.node.mask
-		}
+	prefix = trie.foldKey(prefix)
+	_, node, found, leftover := trie.findSubtree(prefix)
+	switch {
+	case !found || node.count == 0:
+		return 0
+	case len(leftover) != 0:
+		return 1
+	}
 
-		if (cmp & m) != m {
-			continue
+	// Skip the tombstones of lazily deleted keys.
+	fanout := 0
+	for _, child := range node.children.getChildren() {
+		if child.count != 0 {
+			fanout++
 		}
+	}
+	return fanout
+}
 
-		matchCount, skipped := fuzzyMatchCount(p.node.prefix,
-			partial[p.idx:], p.idx, caseInsensitive)
-		p.idx += matchCount
-		if p.idx != 0 {
-			p.skipped += skipped
-		}
+// Len returns the number of items stored in the trie.
+func (trie *Trie) Len() int {
+	return trie.count
+}
 
-		if p.idx == len(partial) {
-			fullPrefix := append(p.prefix, p.node.prefix...)
+// EstimateSubtreeCount returns the number of keys starting with prefix.
+// The count is exact and it is taken from the item counts kept in the nodes,
+// so no keys are visited.
+func (trie *Trie) EstimateSubtreeCount(prefix Prefix) int {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return 0
+	}
+
+	prefix = trie.foldKey(prefix)
+	_, node, found, _ := trie.findSubtree(prefix)
+	if !found {
+		return 0
+	}
+	return node.count
+}
+
+// EstimateFuzzyMatches returns an upper bound of the number of keys matching
+// the case-sensitive fuzzy query, i.e. of the keys VisitFuzzy would visit.
+// Only the node masks are consulted, the descent stops as soon as the path
+// contains all the query characters or the mask of a subtree rules the query
+// out, so it is much cheaper than the search itself.
+func (trie *Trie) EstimateFuzzyMatches(query Prefix) int {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return 0
+	}
+	masks := trie.opts.masks()
+	return trie.estimateFuzzyMatches(masks, masks.prefixMask(query), 0)
+}
 
-			err := p.node.walk(Prefix(""), func(prefix Prefix, item Item) error {
-				key := make([]byte, len(fullPrefix), len(fullPrefix)+len(prefix))
-				copy(key, fullPrefix)
-				key = append(key, prefix...)
+func (trie *Trie) estimateFuzzyMatches(masks *charmapMasks, queryMask, pathMask uint64) int {
+	if (pathMask|trie.mask)&queryMask != queryMask {
+		return 0
+	}
 
-				err := visitor(key, item, p.skipped)
-				if err != nil {
-					return err
-				}
+	// All the query characters are on the path, any key may match.
+	pathMask |= masks.prefixMask(trie.prefix)
+	if pathMask&queryMask == queryMask {
+		return trie.count
+	}
+
+	// The key stored in this node lacks some query characters.
+	var estimate int
+	for _, child := range trie.children.getChildren() {
+		estimate += child.estimateFuzzyMatches(masks, queryMask, pathMask)
+	}
+	return estimate
+}
+
+// VisitContainsAll visits the keys containing every byte of chars in any order
+// and at any position, a byte repeated in chars must be repeated in the key
+// as many times. E.g. "an" matches "Honza" and "Pepan", "aa" matches neither.
+//
+// The subtrees are pruned using the node masks, so only the subtrees containing
+// all the query characters the masks cover are walked, then every key is
+// checked byte by byte. The error handling works like in Visit.
+func (trie *Trie) VisitContainsAll(chars Prefix, visitor VisitorFunc) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	var needed [256]int
+	for _, b := range chars {
+		needed[b]++
+	}
+
+	masks := trie.opts.masks()
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	return trie.visitContainsAll(&prefix, masks, masks.prefixMask(chars), 0, &needed, visitor)
+}
+
+func (trie *Trie) visitContainsAll(prefix *Prefix, masks *charmapMasks, queryMask, pathMask uint64, needed *[256]int, visitor VisitorFunc) error {
+	if (pathMask|trie.mask)&queryMask != queryMask {
+		return nil
+	}
+	pathMask |= masks.prefixMask(trie.prefix)
 
+	if trie.hasItem && containsAll(*prefix, needed) {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item); err != nil {
+			if err == SkipSubtree {
 				return nil
-			})
-			if err != nil {
-				return err
 			}
-
-			continue
+			return err
 		}
+	}
 
-		for _, c := range p.node.children.getChildren() {
-			if c != nil {
-				newPrefix := make(Prefix, len(p.prefix), len(p.prefix)+len(p.node.prefix))
-				copy(newPrefix, p.prefix)
-				newPrefix = append(newPrefix, p.node.prefix...)
-				potential = append(potential, potentialSubtree{
-					node:    c,
-					prefix:  newPrefix,
-					idx:     p.idx,
-					skipped: p.skipped,
-				})
-			} else {
-				fmt.Println("warning, child isn il")
-			}
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		err := child.visitContainsAll(prefix, masks, queryMask, pathMask, needed, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		if err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func fuzzyMatchCount(prefix, query Prefix, idx int, caseInsensitive bool) (count, skipped int) {
-	for i := 0; i < len(prefix); i++ {
-		var match bool
-
-		if caseInsensitive {
-			match = matchCaseInsensitive(prefix[i], query[count])
-		} else {
-			match = prefix[i] == query[count]
+// containsAll checks that key contains every byte at least as many times
+// as needed tells.
+func containsAll(key Prefix, needed *[256]int) bool {
+	var counts [256]int
+	for _, b := range key {
+		counts[b]++
+	}
+	for b, n := range needed {
+		if counts[b] < n {
+			return false
 		}
+	}
+	return true
+}
 
-		if !match {
-			if count+idx > 0 {
-				skipped++
-			}
-			continue
+// KeyLengthHistogram returns the number of stored keys per key length.
+func (trie *Trie) KeyLengthHistogram() map[int]int {
+	histogram := make(map[int]int)
+	trie.Visit(func(prefix Prefix, item Item) error {
+		histogram[len(prefix)]++
+		return nil
+	})
+	return histogram
+}
+
+// Alphabet returns the sorted set of distinct bytes used in the stored keys.
+// The bytes are collected from the node prefixes, not from the masks,
+// so the set is exact. The tombstones left by Delete, see WithLazyDelete,
+// do not contribute.
+func (trie *Trie) Alphabet() []byte {
+	var used [256]bool
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		if node.count == 0 {
+			return SkipSubtree
 		}
+		for _, b := range node.prefix {
+			used[b] = true
+		}
+		return nil
+	})
 
-		count++
-		if count >= len(query) {
-			return
+	var alphabet []byte
+	for b, ok := range used {
+		if ok {
+			alphabet = append(alphabet, byte(b))
 		}
 	}
-	return
+	return alphabet
 }
 
-// VisitSubstring takes a substring and visits all the nodes that whos prefix contains this substring
-func (trie *Trie) VisitSubstring(substring Prefix, caseInsensitive bool, visitor VisitorFunc) error {
-	if len(substring) == 0 {
-		return trie.VisitSubtree(substring, visitor)
+// Sample returns up to n distinct keys chosen uniformly at random from all
+// the keys stored in the trie, using rng as the source of randomness.
+//
+// Distinct positions in the sorted order of the keys are drawn using Floyd's
+// algorithm, which makes every subset of n keys equally likely. The keys at
+// these positions are then located using the subtree item counts, so the keys
+// are found without walking the whole trie.
+func (trie *Trie) Sample(n int, rng *rand.Rand) []Prefix {
+	total := trie.count
+	if n > total {
+		n = total
+	}
+	if n <= 0 {
+		return nil
 	}
 
-	var (
-		m            uint64
-		cmp          uint64
-		i            int
-		p            potentialSubtree
-		suffixLen    int
-		maxSuffixLen = len(substring) - 1
-	)
-
-	potential := []potentialSubtree{potentialSubtree{node: trie, prefix: nil}}
-	for l := len(potential); l > 0; l = len(potential) {
-		i = l - 1
-		p = potential[i]
+	chosen := make(map[int]bool, n)
+	keys := make([]Prefix, 0, n)
+	for j := total - n; j < total; j++ {
+		i := rng.Intn(j + 1)
+		if chosen[i] {
+			i = j
+		}
+		chosen[i] = true
 
-		potential = potential[:i]
+		key, _ := trie.entryAt(i)
+		keys = append(keys, key)
+	}
+	return keys
+}
 
-		if len(p.prefix) < maxSuffixLen {
-			suffixLen = len(p.prefix)
-		} else {
-			suffixLen = maxSuffixLen
-		}
+// Rank returns the number of stored keys strictly less than key in the order
+// Visit visits them. key need not be stored. The rank is computed from the
+// subtree item counts while descending along key, so it takes time
+// proportional to the length of key rather than to the number of keys.
+func (trie *Trie) Rank(key Prefix) int {
+	// Nil prefix not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+	key = trie.foldKey(key)
 
-		searchBytes := append(p.prefix[len(p.prefix)-suffixLen:], p.node.prefix...)
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return 0
+	}
 
-		contains := false
+	rank := 0
+	node := trie
+	for {
+		common := node.longestCommonPrefixLength(key, false)
+		if common < len(node.prefix) {
+			// The keys in the subtree are all either less or greater than key.
+			if common < len(key) && key[common] > node.prefix[common] {
+				rank += node.count
+			}
+			return rank
+		}
 
-		if caseInsensitive {
-			contains = bytes.Contains(bytes.ToUpper(searchBytes), bytes.ToUpper(substring))
-		} else {
-			contains = bytes.Contains(searchBytes, substring)
+		key = key[common:]
+		if len(key) == 0 {
+			return rank
+		}
+		if node.hasItem {
+			rank++
 		}
 
-		if contains {
-			fullPrefix := append(p.prefix, p.node.prefix...)
-			err := p.node.walk(Prefix(""), func(prefix Prefix, item Item) error {
-				key := make([]byte, len(fullPrefix), len(fullPrefix)+len(prefix))
-				copy(key, fullPrefix)
-				key = append(key, prefix...)
-				copy(key, append(fullPrefix, prefix...))
-
-				err := visitor(key, item)
-				if err != nil {
-					return err
+		// The children are sorted, those before the matching one are less than key.
+		var next *Trie
+		for _, child := range node.children.getChildren() {
+			if child.prefix[0] >= key[0] {
+				if child.prefix[0] == key[0] {
+					next = child
 				}
-
-				return nil
-			})
-			if err != nil {
-				return err
+				break
 			}
+			rank += child.count
 		}
+		if next == nil {
+			return rank
+		}
+		node = next
+	}
+}
 
-		newPrefix := make(Prefix, len(p.prefix), len(p.prefix)+len(p.node.prefix))
-		copy(newPrefix, p.prefix)
-		newPrefix = append(newPrefix, p.node.prefix...)
+// Select returns the i-th smallest stored key, counting from 0, and its item.
+// False is returned when i is out of range. Select is the inverse of Rank
+// for the stored keys and it takes time proportional to the depth of the trie.
+func (trie *Trie) Select(i int) (key Prefix, item Item, ok bool) {
+	if i < 0 || i >= trie.count {
+		return nil, nil, false
+	}
+	key, item = trie.entryAt(i)
+	return key, item, true
+}
 
-		overLap := overlapLength(newPrefix, substring, caseInsensitive)
-		m = makePrefixMask(substring[overLap:])
+// Reduce calls fn on every item in the same order as Visit does, threading
+// the accumulator through the calls. It returns the final accumulator value,
+// which is init for an empty trie.
+func (trie *Trie) Reduce(init interface{}, fn func(acc interface{}, prefix Prefix, item Item) interface{}) interface{} {
+	acc := init
+	trie.walk(nil, func(prefix Prefix, item Item) error {
+		acc = fn(acc, prefix, item)
+		return nil
+	})
+	return acc
+}
 
-		for _, c := range p.node.children.getChildren() {
-			if caseInsensitive {
-				cmp = caseInsensitiveMask(c.mask)
-			} else {
-				cmp = c.mask
-			}
-			if c != nil && (cmp&m == m) {
-				potential = append(potential, potentialSubtree{
-					node:   c,
-					prefix: newPrefix,
-				})
-			}
-		}
+func (trie *Trie) size() int {
+	n := 0
+
+	err := trie.walk(nil, func(prefix Prefix, item Item) error {
+		n++
+		return nil
+	})
+
+	if err != nil {
+		panic(err)
 	}
 
-	return nil
+	return n
 }
 
-func overlapLength(prefix, query Prefix, caseInsensitive bool) int {
-	startLength := len(query) - 1
-	if len(prefix) < startLength {
-		startLength = len(prefix)
+func (trie *Trie) total() int {
+	return 1 + trie.children.total()
+}
+
+// VisitSubtree works much like Visit, but it only visits nodes matching prefix.
+func (trie *Trie) VisitSubtree(prefix Prefix, visitor VisitorFunc) error {
+	// Nil prefix not allowed.
+	if prefix == nil {
+		panic(ErrNilPrefix)
 	}
-	for i := startLength; i > 0; i-- {
-		suffix := prefix[len(prefix)-i:]
-		queryPrefix := query[:i]
-		if caseInsensitive {
-			if bytes.EqualFold(suffix, queryPrefix) {
-				return i
-			}
-		} else if bytes.Equal(suffix, queryPrefix) {
-			return i
-		}
+	prefix = trie.foldKey(prefix)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
 	}
 
-	return 0
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		return trie.visitSubtreeEquivalent(prefix, visitor)
+	}
+	return trie.visitSubtreeExact(prefix, visitor)
+}
+
+// visitSubtreeExact works like VisitSubtree, but it ignores the byte
+// equivalence, so that the methods visiting the subtree before deleting it
+// visit the same keys DeleteSubtree deletes. The prefix must be folded already.
+func (trie *Trie) visitSubtreeExact(prefix Prefix, visitor VisitorFunc) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	// Locate the relevant subtree.
+	_, root, found, leftover := trie.findSubtree(prefix)
+	if !found {
+		return nil
+	}
+	prefix = append(prefix[:len(prefix):len(prefix)], leftover...)
+
+	// Visit it.
+	return root.walk(prefix, visitor)
+}
+
+// VisitSubtreeIncludeRoot works much like VisitSubtree, but the item stored
+// under prefix itself is only visited when includeRoot is set, so the keys
+// nested under a key holding an item can be listed without that item.
+func (trie *Trie) VisitSubtreeIncludeRoot(prefix Prefix, includeRoot bool, visitor VisitorFunc) error {
+	if includeRoot {
+		return trie.VisitSubtree(prefix, visitor)
+	}
+	return trie.VisitSubtree(prefix, func(key Prefix, item Item) error {
+		// The keys in the subtree are longer than prefix except for the root.
+		if len(key) == len(prefix) {
+			return nil
+		}
+		return visitor(key, item)
+	})
+}
+
+// VisitSubtreeE works exactly like VisitSubtree, but any error returned from
+// visitor, except for SkipSubtree, is wrapped in a *VisitError carrying
+// the key of the item that was being visited.
+func (trie *Trie) VisitSubtreeE(prefix Prefix, visitor VisitorFunc) error {
+	return trie.VisitSubtree(prefix, func(key Prefix, item Item) error {
+		err := visitor(key, item)
+		if err == nil || err == SkipSubtree {
+			return err
+		}
+		return &VisitError{
+			Key: append(Prefix(nil), key...),
+			Err: err,
+		}
+	})
+}
+
+type potentialSubtree struct {
+	idx     int
+	skipped int
+	prefix  Prefix
+	node    *Trie
+}
+
+// VisitFuzzy visits every node that is succesfully matched via fuzzy matching
+func (trie *Trie) VisitFuzzy(partial Prefix, caseInsensitive bool, visitor FuzzyVisitorFunc) error {
+	if trie.opts != nil && trie.opts.cache != nil {
+		return trie.visitFuzzyCached(partial, caseInsensitive, visitor)
+	}
+	return trie.visitFuzzy(partial, fuzzyParams{FuzzyOptions{CaseInsensitive: caseInsensitive}, -1}, visitor)
+}
+
+// FuzzyOptions modify the behaviour of VisitFuzzyWithOptions.
+type FuzzyOptions struct {
+	// CaseInsensitive makes letters match regardless of their case.
+	CaseInsensitive bool
+	// AnchorStart requires the first query character to match
+	// the first character of the key.
+	AnchorStart bool
+	// SkipQueryPrefix allows dropping up to this many leading query characters
+	// when the whole query cannot be matched, so a leading typo does not make
+	// the search find nothing. Every key is matched with the fewest dropped
+	// characters possible and the dropped characters are added to the number
+	// of skipped characters passed to the visitor, so these matches rank lower.
+	// AnchorStart then applies to the first query character not dropped.
+	SkipQueryPrefix int
+	// MaxGap, when positive, rejects the keys that can only be matched with
+	// more than MaxGap key characters between two consecutive query characters.
+	// The number of skipped characters passed to the visitor is then the one
+	// of the tightest match respecting the limit.
+	MaxGap int
+	// IgnoreLeadingSkips does not count the key characters skipped before
+	// the second query character is matched, only the later gaps are counted.
+	// A query matching the start of a key and then a character deep inside it,
+	// e.g. "Ha" matching "Honza", is then not penalized for the jump, the number
+	// of skipped characters passed to the visitor being 0 instead of 3 in this
+	// case. The key characters before the first query character matched are
+	// never counted.
+	IgnoreLeadingSkips bool
+	// RuneAware makes the matching advance by whole UTF-8 encoded runes, so the
+	// skipped characters and the gaps are counted in runes and a match never
+	// splits a multi-byte rune. The keys that are not valid UTF-8 are matched
+	// byte by byte. Only ASCII letters are matched case-insensitively.
+	RuneAware bool
+}
+
+// VisitFuzzyWithOptions works much like VisitFuzzy, but the matching can be
+// tweaked using opts. The query cache is never used.
+func (trie *Trie) VisitFuzzyWithOptions(partial Prefix, opts FuzzyOptions, visitor FuzzyVisitorFunc) error {
+	return trie.visitFuzzy(partial, fuzzyParams{opts, -1}, visitor)
+}
+
+// VisitFuzzyBudget works much like VisitFuzzy, but it only visits the nodes
+// that can be matched skipping at most maxSkipped characters. The paths
+// exceeding the budget are pruned as soon as the budget is used up.
+func (trie *Trie) VisitFuzzyBudget(partial Prefix, caseInsensitive bool, maxSkipped int, visitor FuzzyVisitorFunc) error {
+	if maxSkipped < 0 {
+		return nil
+	}
+	return trie.visitFuzzy(partial, fuzzyParams{FuzzyOptions{CaseInsensitive: caseInsensitive}, maxSkipped}, visitor)
+}
+
+// closeMatchSkipped is the most characters a close match of VisitFuzzyTiered
+// may skip.
+const closeMatchSkipped = 3
+
+// VisitFuzzyTiered works much like VisitFuzzy, but instead of the number of
+// skipped characters the visitor gets the quality tier of the match: 0 for
+// the keys matching the query with no characters skipped, i.e. the keys
+// containing the query as it is, 1 for the close matches skipping at most 3
+// characters and 2 for all the looser matches. The keys are visited in the
+// same order as VisitFuzzy visits them, not grouped by the tiers.
+func (trie *Trie) VisitFuzzyTiered(partial Prefix, caseInsensitive bool, visitor func(prefix Prefix, item Item, tier int) error) error {
+	return trie.VisitFuzzy(partial, caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+		tier := 2
+		switch {
+		case skipped == 0:
+			tier = 0
+		case skipped <= closeMatchSkipped:
+			tier = 1
+		}
+		return visitor(prefix, item, tier)
+	})
+}
+
+// VisitFuzzyMinMatched visits the keys matching at least minMatched characters
+// of the query, unlike VisitFuzzy not requiring all of them to match.
+// The matched characters must appear in the key in the query order, the number
+// of them passed to the visitor being the length of the longest subsequence
+// of the query contained in the key, e.g. "Pxyz" matches 2 characters
+// of "Pyx". No key matches when minMatched exceeds the query length.
+//
+// The subtrees are pruned using the node masks, the subtrees not containing
+// enough query characters are not walked. The error handling works like in Visit.
+func (trie *Trie) VisitFuzzyMinMatched(partial Prefix, minMatched int, caseInsensitive bool, visitor func(prefix Prefix, item Item, matched int) error) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil || minMatched > len(partial) {
+		return nil
+	}
+
+	masks := trie.opts.masks()
+	q := &minMatchedQuery{
+		partial:         partial,
+		masks:           masks,
+		charMasks:       make([]uint64, len(partial)),
+		minMatched:      minMatched,
+		caseInsensitive: caseInsensitive,
+	}
+	for i := range partial {
+		q.charMasks[i] = masks.prefixMask(partial[i : i+1])
+	}
+
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	return trie.visitFuzzyMinMatched(&prefix, 0, make([]int, len(partial)+1), q, visitor)
+}
+
+// minMatchedQuery holds the state of VisitFuzzyMinMatched.
+type minMatchedQuery struct {
+	partial Prefix
+	masks   *charmapMasks
+	// charMasks[i] is the mask of partial[i], zero for the characters
+	// not covered by the masks.
+	charMasks       []uint64
+	minMatched      int
+	caseInsensitive bool
+}
+
+// visitFuzzyMinMatched walks the subtree, row being the last row of the table
+// of the longest common subsequences of the query and the key of the parent.
+func (trie *Trie) visitFuzzyMinMatched(prefix *Prefix, pathMask uint64, row []int, q *minMatchedQuery, visitor func(prefix Prefix, item Item, matched int) error) error {
+	available := pathMask | trie.mask
+	if q.caseInsensitive {
+		available = q.masks.foldMask(available)
+	}
+	possible := 0
+	for _, mask := range q.charMasks {
+		if mask == 0 || mask&available != 0 {
+			possible++
+		}
+	}
+	if possible < q.minMatched {
+		return nil
+	}
+	pathMask |= q.masks.prefixMask(trie.prefix)
+	row = q.advance(row, trie.prefix)
+
+	if matched := row[len(q.partial)]; trie.hasItem && matched >= q.minMatched {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item, matched); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		err := child.visitFuzzyMinMatched(prefix, pathMask, row, q, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// advance returns the row of the longest common subsequences table
+// following row after appending key.
+func (q *minMatchedQuery) advance(row []int, key Prefix) []int {
+	next := append([]int(nil), row...)
+	for _, b := range key {
+		// diagonal is the value of next[j-1] before b was appended.
+		diagonal := 0
+		for j := 1; j < len(next); j++ {
+			current := next[j]
+			if matchByte(b, q.partial[j-1], q.caseInsensitive) {
+				next[j] = diagonal + 1
+			} else if next[j-1] > next[j] {
+				next[j] = next[j-1]
+			}
+			diagonal = current
+		}
+	}
+	return next
+}
+
+// fuzzyParams are all the parameters of a fuzzy search.
+type fuzzyParams struct {
+	FuzzyOptions
+	// maxSkipped limits the skipped characters, negative means there is no limit.
+	maxSkipped int
+}
+
+// lead returns the number of query characters to be matched before
+// the skipped characters start being counted.
+func (params fuzzyParams) lead() int {
+	if params.IgnoreLeadingSkips {
+		return 1
+	}
+	return 0
+}
+
+// visitFuzzyDropping runs the fuzzy search for the query with 0 up to
+// params.SkipQueryPrefix leading characters dropped, visiting every key once.
+func (trie *Trie) visitFuzzyDropping(partial Prefix, params fuzzyParams, visitor FuzzyVisitorFunc) error {
+	maxDropped := params.SkipQueryPrefix
+	params.SkipQueryPrefix = 0
+	if maxDropped > len(partial)-1 {
+		maxDropped = len(partial) - 1
+	}
+
+	visited := make(map[string]bool)
+	for dropped := 0; dropped <= maxDropped; dropped++ {
+		dropParams := params
+		if params.maxSkipped >= 0 {
+			if dropped > params.maxSkipped {
+				break
+			}
+			dropParams.maxSkipped -= dropped
+		}
+
+		err := trie.visitFuzzy(partial[dropped:], dropParams, func(prefix Prefix, item Item, skipped int) error {
+			if visited[string(prefix)] {
+				return nil
+			}
+			visited[string(prefix)] = true
+			return visitor(prefix, item, skipped+dropped)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// visitFuzzy implements all the fuzzy visiting methods.
+func (trie *Trie) visitFuzzy(partial Prefix, params fuzzyParams, visitor FuzzyVisitorFunc) error {
+	if params.SkipQueryPrefix > 0 && len(partial) > 1 {
+		return trie.visitFuzzyDropping(partial, params, visitor)
+	}
+	if (params.MaxGap > 0 || params.RuneAware) && len(partial) > 1 {
+		// Every match respecting the gap limit or the rune boundaries is
+		// a plain byte match as well, so the keys matched are just filtered here.
+		filteredVisitor := visitor
+		runeQuery, byteQuery := fuzzyUnits(partial, params.RuneAware), fuzzyUnits(partial, false)
+		visitor = func(prefix Prefix, item Item, _ int) error {
+			key, query := fuzzyUnits(prefix, runeQuery.runes), runeQuery
+			if !key.runes {
+				query = byteQuery
+			}
+			var (
+				skipped int
+				ok      bool
+			)
+			if params.MaxGap > 0 {
+				skipped, ok = fuzzyMatchGap(key.units, query.units, params)
+			} else {
+				skipped, ok = fuzzyMatchGreedy(key.units, query.units, params)
+			}
+			if !ok {
+				return nil
+			}
+			return filteredVisitor(prefix, item, skipped)
+		}
+	}
+
+	return trie.visitFuzzyCompiled(compileFuzzyQuery(partial, params, trie.opts.masks()), visitor)
+}
+
+// FuzzyQuery is a fuzzy query compiled using CompileFuzzyQuery, holding
+// the state computed out of the query, so that it can be reused.
+// It can be used by multiple goroutines and with multiple tries at once.
+type FuzzyQuery struct {
+	partial Prefix
+	params  fuzzyParams
+	// masks[i] is the mask of partial[i:] computed using charmap.
+	masks   []uint64
+	charmap *charmapMasks
+}
+
+// CompileFuzzyQuery prepares the fuzzy query partial, so that it can be run
+// repeatedly using VisitCompiled without recomputing its state every time.
+// The query is copied.
+func CompileFuzzyQuery(partial Prefix, caseInsensitive bool) *FuzzyQuery {
+	return compileFuzzyQuery(partial, fuzzyParams{FuzzyOptions{CaseInsensitive: caseInsensitive}, -1}, nil)
+}
+
+func compileFuzzyQuery(partial Prefix, params fuzzyParams, charmap *charmapMasks) *FuzzyQuery {
+	q := &FuzzyQuery{
+		partial: append(Prefix{}, partial...),
+		params:  params,
+		masks:   make([]uint64, len(partial)+1),
+		charmap: charmap,
+	}
+	for i := len(partial) - 1; i >= 0; i-- {
+		q.masks[i] = q.masks[i+1] | charmap.prefixMask(partial[i:i+1])
+	}
+	return q
+}
+
+// VisitCompiled works exactly like VisitFuzzy with the query compiled into q,
+// except that the query cache is never used.
+func (trie *Trie) VisitCompiled(q *FuzzyQuery, visitor FuzzyVisitorFunc) error {
+	return trie.visitFuzzyCompiled(q, visitor)
+}
+
+// visitFuzzyCompiled runs the fuzzy search itself.
+func (trie *Trie) visitFuzzyCompiled(q *FuzzyQuery, visitor FuzzyVisitorFunc) error {
+	// The query masks are only valid for the charmap they were computed with.
+	if charmap := trie.opts.masks(); q.charmap != charmap {
+		q = compileFuzzyQuery(q.partial, q.params, charmap)
+	}
+
+	partial, params := q.partial, q.params
+	caseInsensitive := params.CaseInsensitive
+	counters := trie.fuzzyCounters()
+	counters.query()
+	if len(partial) == 0 {
+		return trie.VisitPrefixes(partial, caseInsensitive, func(prefix Prefix, item Item) error {
+			counters.visitorCall()
+			return visitor(prefix, item, 0)
+		})
+	}
+
+	var (
+		m   uint64
+		cmp uint64
+		i   int
+		p   potentialSubtree
+	)
+
+	potential := []potentialSubtree{potentialSubtree{node: trie, prefix: Prefix(""), idx: 0}}
+	for l := len(potential); l > 0; l = len(potential) {
+		i = l - 1
+		p = potential[i]
+
+		potential = potential[:i]
+		counters.nodeVisited()
+
+		// The first byte of the key is the first byte of the first non-empty prefix.
+		if params.AnchorStart && len(p.prefix) == 0 && len(p.node.prefix) != 0 &&
+			!matchByte(p.node.prefix[0], partial[0], caseInsensitive) {
+			continue
+		}
+
+		m = q.masks[p.idx]
+
+		if caseInsensitive {
+			cmp = q.charmap.foldMask(p.node.mask)
+		} else {
+			cmp = p.node.mask
+		}
+
+		if (cmp & m) != m {
+			counters.pruneHit()
+			continue
+		}
+
+		matchCount, skipped := fuzzyMatchCount(p.node.prefix,
+			partial[p.idx:], p.idx, params.lead(), caseInsensitive)
+		p.idx += matchCount
+		if p.idx != 0 {
+			p.skipped += skipped
+		}
+
+		if params.maxSkipped >= 0 && p.skipped > params.maxSkipped {
+			continue
+		}
+
+		if p.idx == len(partial) {
+			fullPrefix := append(p.prefix, p.node.prefix...)
+
+			err := p.node.walk(fullPrefix, func(key Prefix, item Item) error {
+				counters.visitorCall()
+				return visitor(key, item, p.skipped)
+			})
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		// Push the children in reverse, so that they are popped in ascending order.
+		children := p.node.children.getChildren()
+		for j := len(children) - 1; j >= 0; j-- {
+			if c := children[j]; c != nil {
+				newPrefix := make(Prefix, len(p.prefix), len(p.prefix)+len(p.node.prefix))
+				copy(newPrefix, p.prefix)
+				newPrefix = append(newPrefix, p.node.prefix...)
+				potential = append(potential, potentialSubtree{
+					node:    c,
+					prefix:  newPrefix,
+					idx:     p.idx,
+					skipped: p.skipped,
+				})
+			} else {
+				fmt.Println("warning, child isn il")
+			}
+		}
+	}
+
+	return nil
+}
+
+// fuzzyMatchCount matches the query characters in prefix, idx query characters
+// being matched already. The characters skipped are counted once more than
+// lead query characters are matched, see fuzzyParams.lead.
+func fuzzyMatchCount(prefix, query Prefix, idx, lead int, caseInsensitive bool) (count, skipped int) {
+	for i := 0; i < len(prefix); i++ {
+		var match bool
+
+		if caseInsensitive {
+			match = matchCaseInsensitive(prefix[i], query[count])
+		} else {
+			match = prefix[i] == query[count]
+		}
+
+		if !match {
+			if count+idx > lead {
+				skipped++
+			}
+			continue
+		}
+
+		count++
+		if count >= len(query) {
+			return
+		}
+	}
+	return
+}
+
+// unitString is a key split into the units of fuzzy matching,
+// either bytes or runes.
+type unitString struct {
+	units []rune
+	runes bool
+}
+
+// fuzzyUnits splits s into runes when runes is set and s is valid UTF-8,
+// otherwise into bytes.
+func fuzzyUnits(s Prefix, runes bool) unitString {
+	if runes && utf8.Valid(s) {
+		return unitString{[]rune(string(s)), true}
+	}
+
+	units := make([]rune, len(s))
+	for i, b := range s {
+		units[i] = rune(b)
+	}
+	return unitString{units, false}
+}
+
+func matchUnit(a, b rune, caseInsensitive bool) bool {
+	if a < utf8.RuneSelf && b < utf8.RuneSelf {
+		return matchByte(byte(a), byte(b), caseInsensitive)
+	}
+	return a == b
+}
+
+// fuzzyMatchGreedy matches query in key the same way the fuzzy search
+// matches the bytes, returning the number of skipped units.
+func fuzzyMatchGreedy(key, query []rune, params fuzzyParams) (skipped int, ok bool) {
+	if params.AnchorStart && (len(key) == 0 || !matchUnit(key[0], query[0], params.CaseInsensitive)) {
+		return 0, false
+	}
+
+	matched := 0
+	for _, k := range key {
+		if matchUnit(k, query[matched], params.CaseInsensitive) {
+			matched++
+			if matched == len(query) {
+				return skipped, true
+			}
+		} else if matched > params.lead() {
+			skipped++
+		}
+	}
+	return 0, false
+}
+
+// fuzzyMatchGap finds the tightest match of query in key with at most
+// params.MaxGap key units between consecutive query units.
+// The number of skipped units of that match is returned.
+func fuzzyMatchGap(key, query []rune, params fuzzyParams) (skipped int, ok bool) {
+	// start[j] is the position where the tightest match of the query
+	// units processed so far ending at position j starts, or -1.
+	// When the leading skips are ignored, the match starts with the second
+	// query unit.
+	start := make([]int, len(key))
+	next := make([]int, len(key))
+	for j := range key {
+		start[j] = -1
+		if matchUnit(key[j], query[0], params.CaseInsensitive) && (j == 0 || !params.AnchorStart) {
+			start[j] = j
+		}
+	}
+
+	for i, q := range query[1:] {
+		for j := range key {
+			next[j] = -1
+			if !matchUnit(key[j], q, params.CaseInsensitive) {
+				continue
+			}
+			for k := j - 1; k >= 0 && k >= j-1-params.MaxGap; k-- {
+				if i == 0 && params.IgnoreLeadingSkips && start[k] != -1 {
+					next[j] = j
+					break
+				}
+				if start[k] > next[j] {
+					next[j] = start[k]
+				}
+			}
+		}
+		start, next = next, start
+	}
+
+	// A single unit query has no second unit the match could start with.
+	matched := len(query)
+	if matched > 1 {
+		matched -= params.lead()
+	}
+	best := -1
+	for j, s := range start {
+		if s != -1 && (best == -1 || j-s+1-matched < best) {
+			best = j - s + 1 - matched
+		}
+	}
+	return best, best != -1
+}
+
+// VisitFuzzyTokens splits query into tokens separated by sep and visits every
+// key matching all the tokens fuzzily, each token on its own, so the tokens
+// may appear in the key in any order, e.g. "novak honza" matches "Honza Novak".
+// The tokens may overlap in the key. All the keys are visited when query
+// contains no tokens.
+func (trie *Trie) VisitFuzzyTokens(query Prefix, sep byte, caseInsensitive bool, visitor VisitorFunc) error {
+	var tokens []Prefix
+	for _, token := range bytes.Split(query, []byte{sep}) {
+		if len(token) != 0 {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return trie.Visit(visitor)
+	}
+
+	// The longest token prunes the search the most,
+	// the keys matching it are checked against the rest.
+	longest := 0
+	for i, token := range tokens {
+		if len(token) > len(tokens[longest]) {
+			longest = i
+		}
+	}
+	first := tokens[longest]
+	tokens = append(tokens[:longest], tokens[longest+1:]...)
+
+	return trie.VisitFuzzy(first, caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+		for _, token := range tokens {
+			if !isSubsequence(prefix, token, caseInsensitive) {
+				return nil
+			}
+		}
+		return visitor(prefix, item)
+	})
+}
+
+// isSubsequence returns true when all the bytes of sub appear in s in order.
+func isSubsequence(s, sub Prefix, caseInsensitive bool) bool {
+	for i := 0; i < len(s) && len(sub) != 0; i++ {
+		if matchByte(s[i], sub[0], caseInsensitive) {
+			sub = sub[1:]
+		}
+	}
+	return len(sub) == 0
+}
+
+// VisitFuzzyDetailed works much like VisitFuzzy, but it also visits keys that
+// match the query only partially. Query characters that cannot be found in the
+// rest of the key are left unmatched, so matched + unmatched == len(partial).
+// Every key matching at least one query character is visited along with the
+// number of skipped key characters and the number of matched query characters.
+func (trie *Trie) VisitFuzzyDetailed(partial Prefix, caseInsensitive bool, visitor FuzzyDetailedVisitorFunc) error {
+	if len(partial) == 0 {
+		return trie.VisitPrefixes(partial, caseInsensitive, func(prefix Prefix, item Item) error {
+			return visitor(prefix, item, 0, 0)
+		})
+	}
+
+	masks := trie.opts.masks()
+	m := masks.prefixMask(partial)
+	cmp := trie.mask
+	if caseInsensitive {
+		cmp = masks.foldMask(cmp)
+	}
+	if cmp&m == 0 && m != 0 {
+		return nil
+	}
+
+	return trie.walk(nil, func(prefix Prefix, item Item) error {
+		skipped, matched := fuzzyMatchPartial(prefix, partial, caseInsensitive)
+		if matched == 0 {
+			return nil
+		}
+
+		key := make(Prefix, len(prefix))
+		copy(key, prefix)
+		return visitor(key, item, skipped, matched)
+	})
+}
+
+func fuzzyMatchPartial(key, query Prefix, caseInsensitive bool) (skipped, matched int) {
+	pos := 0
+	for _, q := range query {
+		for i := pos; i < len(key); i++ {
+			var match bool
+
+			if caseInsensitive {
+				match = matchCaseInsensitive(key[i], q)
+			} else {
+				match = key[i] == q
+			}
+
+			if match {
+				if matched > 0 {
+					skipped += i - pos
+				}
+				matched++
+				pos = i + 1
+				break
+			}
+		}
+	}
+	return
+}
+
+// VisitSubstring takes a substring and visits all the nodes that whos prefix contains this substring
+func (trie *Trie) VisitSubstring(substring Prefix, caseInsensitive bool, visitor VisitorFunc) error {
+	counters := trie.substringCounters()
+	counters.query()
+	if len(substring) == 0 {
+		return trie.VisitSubtree(substring, func(prefix Prefix, item Item) error {
+			counters.visitorCall()
+			return visitor(prefix, item)
+		})
+	}
+
+	var (
+		m            uint64
+		cmp          uint64
+		i            int
+		p            potentialSubtree
+		suffixLen    int
+		maxSuffixLen = len(substring) - 1
+		masks        = trie.opts.masks()
+	)
+
+	potential := []potentialSubtree{potentialSubtree{node: trie, prefix: nil}}
+	for l := len(potential); l > 0; l = len(potential) {
+		i = l - 1
+		p = potential[i]
+
+		potential = potential[:i]
+		counters.nodeVisited()
+
+		if len(p.prefix) < maxSuffixLen {
+			suffixLen = len(p.prefix)
+		} else {
+			suffixLen = maxSuffixLen
+		}
+
+		searchBytes := append(p.prefix[len(p.prefix)-suffixLen:], p.node.prefix...)
+
+		contains := false
+
+		if caseInsensitive {
+			contains = bytes.Contains(bytes.ToUpper(searchBytes), bytes.ToUpper(substring))
+		} else {
+			contains = bytes.Contains(searchBytes, substring)
+		}
+
+		if contains {
+			fullPrefix := append(p.prefix, p.node.prefix...)
+			err := p.node.walk(fullPrefix, func(key Prefix, item Item) error {
+				counters.visitorCall()
+				return visitor(key, item)
+			})
+			if err != nil {
+				return err
+			}
+
+			// The whole subtree has been visited already.
+			continue
+		}
+
+		newPrefix := make(Prefix, len(p.prefix), len(p.prefix)+len(p.node.prefix))
+		copy(newPrefix, p.prefix)
+		newPrefix = append(newPrefix, p.node.prefix...)
+
+		overLap := overlapLength(newPrefix, substring, caseInsensitive)
+		m = masks.prefixMask(substring[overLap:])
+
+		// Push the children in reverse, so that they are popped in ascending order.
+		children := p.node.children.getChildren()
+		for j := len(children) - 1; j >= 0; j-- {
+			c := children[j]
+			if caseInsensitive {
+				cmp = masks.foldMask(c.mask)
+			} else {
+				cmp = c.mask
+			}
+			if c != nil && (cmp&m == m) {
+				potential = append(potential, potentialSubtree{
+					node:   c,
+					prefix: newPrefix,
+				})
+			} else {
+				counters.pruneHit()
+			}
+		}
+	}
+
+	return nil
+}
+
+// VisitSubstringWord works much like VisitSubstring, but it only visits
+// the keys containing query as a whole word, i.e. an occurrence of query
+// preceded and followed by one of delims or by the start or the end of the key.
+func (trie *Trie) VisitSubstringWord(query Prefix, delims []byte, visitor VisitorFunc) error {
+	return trie.VisitSubstring(query, false, func(prefix Prefix, item Item) error {
+		if !containsWord(prefix, query, delims) {
+			return nil
+		}
+		return visitor(prefix, item)
+	})
+}
+
+func containsWord(key, word Prefix, delims []byte) bool {
+	for offset := 0; offset+len(word) <= len(key); {
+		i := bytes.Index(key[offset:], word)
+		if i == -1 {
+			return false
+		}
+		start, end := offset+i, offset+i+len(word)
+
+		if (start == 0 || bytes.IndexByte(delims, key[start-1]) != -1) &&
+			(end == len(key) || bytes.IndexByte(delims, key[end]) != -1) {
+			return true
+		}
+		offset = start + 1
+	}
+	return false
+}
+
+// Span is a part of a key, see VisitSubstringSpans.
+type Span struct {
+	Start, End int
+	Match      bool
+}
+
+// VisitSubstringSpans works much like VisitSubstring, but it additionally
+// partitions every visited key into spans, marking the non-overlapping
+// occurrences of substring in the key as matching.
+func (trie *Trie) VisitSubstringSpans(substring Prefix, caseInsensitive bool, visitor func(prefix Prefix, item Item, spans []Span) error) error {
+	return trie.VisitSubstring(substring, caseInsensitive, func(prefix Prefix, item Item) error {
+		return visitor(prefix, item, substringSpans(prefix, substring, caseInsensitive))
+	})
+}
+
+func substringSpans(key, substring Prefix, caseInsensitive bool) []Span {
+	if len(substring) == 0 {
+		if len(key) == 0 {
+			return nil
+		}
+		return []Span{{0, len(key), false}}
+	}
+
+	var spans []Span
+	start := 0
+	for i := 0; i+len(substring) <= len(key); {
+		var match bool
+		if caseInsensitive {
+			match = bytes.EqualFold(key[i:i+len(substring)], substring)
+		} else {
+			match = bytes.Equal(key[i:i+len(substring)], substring)
+		}
+
+		if !match {
+			i++
+			continue
+		}
+
+		if start < i {
+			spans = append(spans, Span{start, i, false})
+		}
+		spans = append(spans, Span{i, i + len(substring), true})
+		i += len(substring)
+		start = i
+	}
+	if start < len(key) {
+		spans = append(spans, Span{start, len(key), false})
+	}
+	return spans
+}
+
+func overlapLength(prefix, query Prefix, caseInsensitive bool) int {
+	startLength := len(query) - 1
+	if len(prefix) < startLength {
+		startLength = len(prefix)
+	}
+	for i := startLength; i > 0; i-- {
+		suffix := prefix[len(prefix)-i:]
+		queryPrefix := query[:i]
+		if caseInsensitive {
+			if bytes.EqualFold(suffix, queryPrefix) {
+				return i
+			}
+		} else if bytes.Equal(suffix, queryPrefix) {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// VisitGlob visits every item whose key matches pattern, where '?' matches
+// any single byte and '*' matches any sequence of bytes, including the empty
+// one. All the other bytes must match exactly.
+//
+// The subtrees that cannot match the pattern are never entered, so a literal
+// prefix of pattern narrows the search down to the matching subtree only.
+func (trie *Trie) VisitGlob(pattern Prefix, visitor VisitorFunc) error {
+	// Nil pattern not allowed.
+	if pattern == nil {
+		panic(ErrNilPrefix)
+	}
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	states := make([]bool, len(pattern)+1)
+	states[0] = true
+	globClosure(pattern, states)
+
+	prefix := make(Prefix, 0, 32)
+	return trie.visitGlob(&prefix, pattern, states, visitor)
+}
+
+func (trie *Trie) visitGlob(prefix *Prefix, pattern Prefix, states []bool, visitor VisitorFunc) error {
+	for _, b := range trie.prefix {
+		var alive bool
+		if states, alive = globStep(pattern, states, b); !alive {
+			return nil
+		}
+	}
+
+	*prefix = append(*prefix, trie.prefix...)
+	defer func() {
+		*prefix = (*prefix)[:len(*prefix)-len(trie.prefix)]
+	}()
+
+	if trie.hasItem && states[len(pattern)] {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range trie.children.getChildren() {
+		if err := child.visitGlob(prefix, pattern, states, visitor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// globStep returns the set of pattern positions reachable from states
+// by consuming b and whether the set is non-empty.
+func globStep(pattern Prefix, states []bool, b byte) (next []bool, alive bool) {
+	next = make([]bool, len(states))
+	for i, c := range pattern {
+		if !states[i] {
+			continue
+		}
+		switch c {
+		case '*':
+			next[i] = true
+		case '?', b:
+			next[i+1] = true
+		default:
+			continue
+		}
+		alive = true
+	}
+	globClosure(pattern, next)
+	return
+}
+
+// globClosure adds the positions following any '*' in states,
+// since '*' matches the empty sequence as well.
+func globClosure(pattern Prefix, states []bool) {
+	for i, c := range pattern {
+		if states[i] && c == '*' {
+			states[i+1] = true
+		}
+	}
+}
+
+// VisitRegexp visits every item whose key matches re, using the semantics
+// of re.Match, so the regexp must be anchored to match the whole key.
+//
+// When re is anchored at the beginning of the key and starts with a literal
+// prefix, only the subtree matching that prefix is visited. Otherwise all
+// the keys are matched against re, which takes O(n) time.
+func (trie *Trie) VisitRegexp(re *regexp.Regexp, visitor VisitorFunc) error {
+	return trie.VisitSubtree(regexpLiteralPrefix(re), func(prefix Prefix, item Item) error {
+		if !re.Match(prefix) {
+			return nil
+		}
+		return visitor(prefix, item)
+	})
+}
+
+// regexpLiteralPrefix returns the literal prefix every key matching re
+// must start with, possibly empty.
+func regexpLiteralPrefix(re *regexp.Regexp) Prefix {
+	// The literal prefix only begins the match, not the key,
+	// unless the match is anchored at the beginning of the key.
+	parsed, err := syntax.Parse(re.String(), syntax.Perl)
+	if err != nil {
+		return Prefix{}
+	}
+	if parsed.Op == syntax.OpConcat && len(parsed.Sub) != 0 {
+		parsed = parsed.Sub[0]
+	}
+	if parsed.Op != syntax.OpBeginText {
+		return Prefix{}
+	}
+
+	prefix, _ := re.LiteralPrefix()
+	return Prefix(prefix)
+}
+
+// VisitHamming visits every item whose key has the same length as query
+// and differs from it in at most maxDist positions, the Hamming distance
+// being passed to visitor. The subtrees are pruned as soon as the mismatches
+// along the path exceed maxDist, so this is much cheaper than a fuzzy search
+// for fixed-length keys like codes.
+func (trie *Trie) VisitHamming(query Prefix, maxDist int, visitor func(prefix Prefix, item Item, dist int) error) error {
+	// Nil query not allowed.
+	if query == nil {
+		panic(ErrNilPrefix)
+	}
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil || maxDist < 0 {
+		return nil
+	}
+
+	prefix := make(Prefix, 0, len(query))
+	return trie.visitHamming(&prefix, query, maxDist, 0, visitor)
+}
+
+func (trie *Trie) visitHamming(prefix *Prefix, query Prefix, maxDist, dist int, visitor func(prefix Prefix, item Item, dist int) error) error {
+	offset := len(*prefix)
+	if offset+len(trie.prefix) > len(query) {
+		return nil
+	}
+	for i, b := range trie.prefix {
+		if b != query[offset+i] {
+			if dist++; dist > maxDist {
+				return nil
+			}
+		}
+	}
+
+	*prefix = append(*prefix, trie.prefix...)
+	defer func() {
+		*prefix = (*prefix)[:offset]
+	}()
+
+	if len(*prefix) == len(query) {
+		if !trie.hasItem {
+			return nil
+		}
+		if err := visitor(append(Prefix{}, *prefix...), trie.item, dist); err != nil && err != SkipSubtree {
+			return err
+		}
+		return nil
+	}
+
+	for _, child := range trie.children.getChildren() {
+		if err := child.visitHamming(prefix, query, maxDist, dist, visitor); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// VisitPrefixes visits only nodes that represent prefixes of key.
+// To say the obvious, returning SkipSubtree from visitor makes no sense here.
+func (trie *Trie) VisitPrefixes(key Prefix, caseInsensitive bool, visitor VisitorFunc) error {
+	return trie.VisitPrefixesMinLen(key, 0, caseInsensitive, visitor)
+}
+
+// ResolvePath folds the items stored under all the prefixes of query,
+// query itself included, starting with init and going from the shortest
+// prefix to the longest one, so the more specific items can be overlaid
+// over the less specific ones.
+func (trie *Trie) ResolvePath(query Prefix, fold func(acc, item Item) Item, init Item) Item {
+	acc := init
+	trie.VisitPrefixes(query, false, func(prefix Prefix, item Item) error {
+		acc = fold(acc, item)
+		return nil
+	})
+	return acc
+}
+
+// PrefixChain returns the entries stored under all the prefixes of query,
+// query itself included, ordered from the longest prefix to the shortest one,
+// so the most specific entry comes first. This is the chain of fallbacks
+// of hierarchical lookups, e.g. routing or configuration inheritance.
+// Nil is returned when no prefix of query is stored.
+func (trie *Trie) PrefixChain(query Prefix) []Entry {
+	var chain []Entry
+	trie.VisitPrefixes(query, false, func(prefix Prefix, item Item) error {
+		chain = append(chain, Entry{prefix, item})
+		return nil
+	})
+
+	// The prefixes are visited from the shortest one.
+	for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+		chain[i], chain[j] = chain[j], chain[i]
+	}
+	return chain
+}
+
+// VisitPrefixesMinLen works much like VisitPrefixes, but it does not call
+// visitor for prefixes of key that are shorter than minLen.
+func (trie *Trie) VisitPrefixesMinLen(key Prefix, minLen int, caseInsensitive bool, visitor VisitorFunc) error {
+	// Nil key not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+	key = trie.foldKey(key)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		return trie.visitPrefixesEquivalent(key, minLen, caseInsensitive, visitor)
+	}
+
+	// Walk the path matching key prefixes.
+	node := trie
+	prefix := key
+	offset := 0
+	for {
+		// Compute what part of prefix matches.
+		common := node.longestCommonPrefixLength(key, caseInsensitive)
+		key = key[common:]
+		offset += common
+
+		// Partial match means that there is no subtree matching prefix.
+		if common < len(node.prefix) {
+			return nil
+		}
+
+		// Call the visitor.
+		if node.hasItem && offset >= minLen {
+			if err := visitor(append(Prefix{}, prefix[:offset]...), node.item); err != nil {
+				return err
+			}
+		}
+
+		if len(key) == 0 {
+			// This node represents key, we are finished.
+			return nil
+		}
+
+		// There is some key suffix left, move to the children.
+		child := node.children.next(key[0])
+		if child == nil {
+			// There is nowhere to continue, return.
+			return nil
+		}
+
+		node = child
+	}
+}
+
+// VisitRelated visits all the keys related to query, i.e. the prefixes of query
+// the same way VisitPrefixes does, query itself and the keys starting with query
+// the same way VisitSubtree does, telling the relation of every key to query.
+// The ancestors are visited first, from the shortest one, then the subtree
+// of query in a single walk down the trie.
+//
+// Returning SkipSubtree from the visitor skips the subtree of the key visited,
+// for an ancestor that is the rest of the related keys. The error handling
+// works like in Visit otherwise.
+func (trie *Trie) VisitRelated(query Prefix, visitor func(prefix Prefix, item Item, relation Relation) error) error {
+	// Nil query not allowed.
+	if query == nil {
+		panic(ErrNilPrefix)
+	}
+	query = trie.foldKey(query)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	descendants := func(prefix Prefix, item Item) error {
+		if len(prefix) == len(query) {
+			return visitor(prefix, item, Exact)
+		}
+		return visitor(prefix, item, Descendant)
+	}
+
+	if trie.opts != nil && trie.opts.byteEquiv != nil {
+		err := trie.VisitPrefixes(query, false, func(prefix Prefix, item Item) error {
+			if len(prefix) == len(query) {
+				return nil
+			}
+			return visitor(prefix, item, Ancestor)
+		})
+		if err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+		return trie.VisitSubtree(query, descendants)
+	}
+
+	// Walk the path matching query, visiting the ancestors.
+	node := trie
+	key := query
+	offset := 0
+	for {
+		// Compute what part of key matches.
+		common := node.longestCommonPrefixLength(key, false)
+		key = key[common:]
+		offset += common
+
+		// The query is used up, visit the subtree.
+		if len(key) == 0 {
+			prefix := append(query[:offset:offset], node.prefix[common:]...)
+			return node.walk(prefix, descendants)
+		}
+
+		// Partial match means that there is no subtree matching query.
+		if common < len(node.prefix) {
+			return nil
+		}
+
+		if node.hasItem {
+			if err := visitor(append(Prefix{}, query[:offset]...), node.item, Ancestor); err != nil {
+				if err == SkipSubtree {
+					return nil
+				}
+				return err
+			}
+		}
+
+		// There is some query suffix left, move to the children.
+		child := node.children.next(key[0])
+		if child == nil {
+			// There is nowhere to continue, return.
+			return nil
+		}
+
+		node = child
+	}
+}
+
+// FindAllIn visits every occurrence of any stored key in text, passing
+// the position in text where the key occurs to visitor. The occurrences are
+// visited ordered by position, shorter keys first. The empty key is never
+// reported since it occurs everywhere.
+//
+// Every position in text is tried, so this runs in O(len(text) * L) time,
+// L being the length of the longest stored key.
+func (trie *Trie) FindAllIn(text Prefix, visitor func(key Prefix, item Item, pos int) error) error {
+	for pos := range text {
+		err := trie.VisitPrefixesMinLen(text[pos:], 1, false, func(prefix Prefix, item Item) error {
+			return visitor(prefix, item, pos)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete deletes the item represented by the given prefix.
+//
+// True is returned if the matching node was found and deleted.
+func (trie *Trie) Delete(key Prefix) (deleted bool) {
+	// Nil prefix not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+	key = trie.foldKey(key)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return false
+	}
+
+	// Find the relevant node.
+	path, found, leftover := trie.findSubtreePath(key)
+	if !found || len(leftover) != 0 {
+		return false
+	}
+	return trie.deletePath(key, path)
+}
+
+// deletePath deletes the item stored in the last node of path, path leading
+// from the root to the node representing key.
+func (trie *Trie) deletePath(key Prefix, path []*Trie) (deleted bool) {
+	node := path[len(path)-1]
+	var parent *Trie
+	if len(path) != 1 {
+		parent = path[len(path)-2]
+	}
+
+	// If there is no item stored, there is nothing to do.
+	if !node.hasItem {
+		return false
+	}
+
+	// Delete the item.
+	item := node.item
+	node.item = nil
+	node.hasItem = false
+	node.weight = 0
+	trie.modified()
+	for _, n := range path {
+		n.count--
+	}
+	if trie.opts != nil && trie.opts.eviction != nil {
+		trie.opts.eviction.removed(key)
+	}
+	if trie.opts != nil && trie.opts.refs != nil {
+		trie.opts.refs.release(item)
+	}
+	if trie.opts != nil && trie.opts.wal != nil {
+		trie.opts.wal.delete(key)
+	}
+
+	// The node is kept as a tombstone until Compact is called.
+	if trie.opts != nil && trie.opts.lazyDelete {
+		return true
+	}
+
+	// Initialise i before goto.
+	// Will be used later in a loop.
+	i := len(path) - 1
+
+	// In case there are some child nodes, we cannot drop the whole subtree.
+	// We can try to compact nodes, though.
+	if node.children.length() != 0 {
+		goto Compact
+	}
+
+	// In case we are at the root, just reset it and we are done.
+	if parent == nil {
+		node.reset()
+		return true
+	}
+
+	// We can drop a subtree.
+	// Find the first ancestor that has its value set or it has 2 or more child nodes.
+	// That will be the node where to drop the subtree at.
+	for ; i >= 0; i-- {
+		if current := path[i]; current.hasItem || current.children.length() >= 2 {
+			break
+		}
+	}
+
+	// Handle the case when there is no such node.
+	// In other words, we can reset the whole tree.
+	if i == -1 {
+		trie.freeChildren(path[0])
+		path[0].reset()
+		return true
+	}
+
+	// We can just remove the subtree here.
+	node = path[i]
+	if i == 0 {
+		parent = nil
+	} else {
+		parent = path[i-1]
+	}
+	// i+1 is always a valid index since i is never pointing to the last node.
+	// The loop above skips at least the last node since we are sure that the item
+	// is set to nil and it has no children, othewise we would be compacting instead.
+	node.children.remove(path[i+1].prefix[0])
+	trie.freeSubtree(path[i+1])
+
+	// lastly, the bitmasks of all of the parent nodes have to be updated again, since
+	// a child node of all of them has bin removed
+	for ; i >= 0; i-- {
+		path[i].updateMask(trie.opts.masks())
+	}
+
+Compact:
+	// The node is set to the first non-empty ancestor,
+	// so try to compact since that might be possible now.
+	if compacted := node.compact(); compacted != node {
+		if parent == nil {
+			compacted.opts = node.opts
+			*node = *compacted
+			trie.freeNode(compacted)
+			trie.merged(nil, node.prefix)
+		} else {
+			parent.children.replace(node.prefix[0], compacted)
+			trie.freeNode(node)
+			trie.merged(key[:pathOffset(path, node)], compacted.prefix)
+			if compacted := parent.compact(); compacted != parent {
+				compacted.opts = parent.opts
+				*parent = *compacted
+				trie.freeNode(compacted)
+				trie.merged(key[:pathOffset(path, parent)], parent.prefix)
+			}
+		}
+	}
+
+	return true
+}
+
+// DeleteSubtree finds the subtree exactly matching prefix and deletes it.
+//
+// True is returned if the subtree was found and deleted.
+func (trie *Trie) DeleteSubtree(prefix Prefix) (deleted bool) {
+	// Nil prefix not allowed.
+	if prefix == nil {
+		panic(ErrNilPrefix)
+	}
+	prefix = trie.foldKey(prefix)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return false
+	}
+
+	// Locate the relevant subtree.
+	parent, root, found, leftover := trie.findSubtree(prefix)
+	path, _, _ := trie.findSubtreePath(prefix)
+	if !found {
+		return false
+	}
+	trie.modified()
+	if trie.opts != nil && trie.opts.wal != nil {
+		trie.opts.wal.deleteSubtree(prefix)
+	}
+
+	if trie.opts != nil && trie.opts.eviction != nil {
+		root.walk(append(prefix[:len(prefix):len(prefix)], leftover...), func(key Prefix, item Item) error {
+			trie.opts.eviction.removed(key)
+			return nil
+		})
+	}
+	if trie.opts != nil && trie.opts.refs != nil {
+		root.walk(append(prefix[:len(prefix):len(prefix)], leftover...), func(key Prefix, item Item) error {
+			trie.opts.refs.release(item)
+			return nil
+		})
+	}
+
+	// If we are in the root of the trie, reset the trie.
+	if parent == nil {
+		trie.freeChildren(root)
+		root.reset()
+		return true
+	}
+
+	// Otherwise remove the root node from its parent.
+	parent.children.remove(root.prefix[0])
+
+	// update masks and item counts
+	for i := len(path) - 2; i >= 0; i-- {
+		path[i].updateMask(trie.opts.masks())
+		path[i].count -= root.count
+	}
+	trie.freeSubtree(root)
+
+	return true
+}
+
+// Equal returns true when both tries hold exactly the same keys with
+// the items deemed equal by itemsEqual, reflect.DeepEqual is used when
+// itemsEqual is nil. Only the contents are compared, not the node layout.
+func (trie *Trie) Equal(other *Trie, itemsEqual func(a, b Item) bool) bool {
+	if itemsEqual == nil {
+		itemsEqual = func(a, b Item) bool {
+			return reflect.DeepEqual(a, b)
+		}
+	}
+
+	if trie.Len() != other.Len() {
+		return false
+	}
+
+	err := trie.walk(nil, func(prefix Prefix, item Item) error {
+		otherItem, ok := other.get(prefix)
+		if !ok || !itemsEqual(item, otherItem) {
+			return errNotEqual
+		}
+		return nil
+	})
+	return err == nil
+}
+
+// DeletePrefixOrSubtree deletes the item stored under prefix. When there
+// is no such item, but prefix is an internal node and subtreeIfInternal is set,
+// the whole subtree is deleted instead. The number of items deleted is returned.
+func (trie *Trie) DeletePrefixOrSubtree(prefix Prefix, subtreeIfInternal bool) int {
+	switch trie.nodeKindExact(trie.foldKey(prefix)) {
+	case NodeItem:
+		if trie.Delete(prefix) {
+			return 1
+		}
+	case NodeInternal:
+		if subtreeIfInternal {
+			before := trie.Len()
+			trie.DeleteSubtree(prefix)
+			return before - trie.Len()
+		}
+	}
+	return 0
+}
+
+// PopMin removes the lexicographically smallest key from the trie and returns
+// it along with its item. False is returned when the trie is empty. Calling
+// PopMin repeatedly drains the trie in ascending order of the keys.
+func (trie *Trie) PopMin() (key Prefix, item Item, ok bool) {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil || trie.count == 0 {
+		return nil, nil, false
+	}
+
+	// The children are sorted, so the smallest key is reached by always
+	// descending into the first child until a node holding an item is found.
+	// The path is recorded, so the key is deleted without another descent.
+	node := trie
+	path := []*Trie{node}
+	key = append(Prefix{}, node.prefix...)
+	for !node.hasItem {
+		for _, child := range node.children.getChildren() {
+			// Skip the tombstones of lazily deleted keys.
+			if child.count != 0 {
+				node = child
+				break
+			}
+		}
+		path = append(path, node)
+		key = append(key, node.prefix...)
+	}
+
+	item = node.item
+	trie.deletePath(key, path)
+	return key, item, true
+}
+
+// DeleteSubtreeCollect works much like DeleteSubtree, but it returns
+// the entries deleted, sorted by their keys.
+func (trie *Trie) DeleteSubtreeCollect(prefix Prefix) []Entry {
+	// Nil prefix not allowed.
+	if prefix == nil {
+		panic(ErrNilPrefix)
+	}
+
+	var entries []Entry
+	trie.visitSubtreeExact(trie.foldKey(prefix), func(key Prefix, item Item) error {
+		entries = append(entries, Entry{append(Prefix(nil), key...), item})
+		return nil
+	})
+	trie.DeleteSubtree(prefix)
+	return entries
+}
+
+// Difference returns a new trie containing the entries of trie
+// whose keys are not present in other.
+// The result keeps the optional features of trie the same way Clone does.
+func (trie *Trie) Difference(other *Trie) *Trie {
+	return trie.filter(func(prefix Prefix, item Item) bool {
+		_, ok := other.get(prefix)
+		return !ok
+	})
+}
+
+// Intersection returns a new trie containing the entries of trie
+// whose keys are present in other as well.
+// The result keeps the optional features of trie the same way Clone does.
+func (trie *Trie) Intersection(other *Trie) *Trie {
+	return trie.filter(func(prefix Prefix, item Item) bool {
+		_, ok := other.get(prefix)
+		return ok
+	})
+}
+
+// filter returns a new trie containing the entries for which keep returns true.
+// The optional features of trie are kept the same way Clone keeps them.
+func (trie *Trie) filter(keep func(prefix Prefix, item Item) bool) *Trie {
+	result := NewTrie()
+	result.opts = trie.opts.cloneEmpty()
+	trie.walk(nil, func(prefix Prefix, item Item) error {
+		if keep(prefix, item) {
+			result.Insert(prefix, item)
+		}
+		return nil
+	})
+	return result
+}
+
+// DiffTries merges the keys of the tries a and b, calling cb on every key
+// stored in any of them in ascending lexicographic order. inA and inB tell
+// which of the tries store the key, itemA and itemB are the items stored,
+// nil for the trie not storing the key.
+//
+// Both tries are walked side by side in a single pass, so no lookups are
+// needed and the cost is linear in the size of the tries. If cb returns
+// an error, DiffTries stops and returns that error. The tries must not be
+// modified by cb.
+func DiffTries(a, b *Trie, cb func(key Prefix, inA, inB bool, itemA, itemB Item) error) error {
+	curA, curB := newSortedCursor(a), newSortedCursor(b)
+	okA, okB := curA.next(), curB.next()
+	for okA || okB {
+		var err error
+		switch cmp := compareCursors(curA, okA, curB, okB); {
+		case cmp < 0:
+			err = cb(append(Prefix{}, curA.key...), true, false, curA.item, nil)
+			okA = curA.next()
+		case cmp > 0:
+			err = cb(append(Prefix{}, curB.key...), false, true, nil, curB.item)
+			okB = curB.next()
+		default:
+			err = cb(append(Prefix{}, curA.key...), true, true, curA.item, curB.item)
+			okA, okB = curA.next(), curB.next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compareCursors compares the current keys of the cursors, an exhausted
+// cursor being greater than any key.
+func compareCursors(a *sortedCursor, okA bool, b *sortedCursor, okB bool) int {
+	switch {
+	case !okA:
+		return 1
+	case !okB:
+		return -1
+	}
+	return bytes.Compare(a.key, b.key)
+}
+
+// sortedCursor iterates over the items of a trie in ascending lexicographic
+// order of their keys.
+type sortedCursor struct {
+	stack []cursorFrame
+	key   Prefix
+	item  Item
+}
+
+// cursorFrame holds the children of a node yet to be visited
+// and the length of the key of the node.
+type cursorFrame struct {
+	children []*Trie
+	next     int
+	keyLen   int
+}
+
+func newSortedCursor(trie *Trie) *sortedCursor {
+	cursor := &sortedCursor{}
+	// Empty trie has nothing to iterate over.
+	if trie.prefix != nil {
+		cursor.stack = append(cursor.stack, cursorFrame{children: []*Trie{trie}})
+	}
+	return cursor
+}
+
+// next moves the cursor to the next item, false is returned when there are
+// no more items.
+func (cursor *sortedCursor) next() bool {
+	for len(cursor.stack) != 0 {
+		top := &cursor.stack[len(cursor.stack)-1]
+		if top.next == len(top.children) {
+			cursor.stack = cursor.stack[:len(cursor.stack)-1]
+			continue
+		}
+
+		node := top.children[top.next]
+		top.next++
+		// Skip the tombstones of lazily deleted keys.
+		if node.count == 0 {
+			continue
+		}
+
+		cursor.key = append(cursor.key[:top.keyLen], node.prefix...)
+		cursor.stack = append(cursor.stack, cursorFrame{
+			children: node.children.getChildren(),
+			keyLen:   len(cursor.key),
+		})
+		if node.hasItem {
+			cursor.item = node.item
+			return true
+		}
+	}
+	return false
+}
+
+// CommonAncestor returns the key of the deepest node lying on the paths to
+// both a and b, which is the branching point of the two keys. False is
+// returned unless both a and b are stored in the trie.
+func (trie *Trie) CommonAncestor(a, b Prefix) (Prefix, bool) {
+	pathA, ok := trie.itemPath(a)
+	if !ok {
+		return nil, false
+	}
+	pathB, ok := trie.itemPath(b)
+	if !ok {
+		return nil, false
+	}
+
+	var ancestor Prefix
+	for i := 0; i < len(pathA) && i < len(pathB) && pathA[i] == pathB[i]; i++ {
+		ancestor = append(ancestor, pathA[i].prefix...)
+	}
+	return ancestor, true
+}
+
+// ShortestUniquePrefix returns the shortest prefix of key that no other stored
+// key starts with, which is the shortest abbreviation identifying key. False is
+// returned when key is not stored. When key is a prefix of other stored keys,
+// key itself is returned, when it is the only key stored, the empty prefix
+// is returned. The prefix returned is a copy.
+func (trie *Trie) ShortestUniquePrefix(key Prefix) (Prefix, bool) {
+	key = trie.foldKey(key)
+	path, ok := trie.itemPath(key)
+	if !ok {
+		return nil, false
+	}
+
+	// The first node on the path with a single item in its subtree is where
+	// the path to key splits from the paths to all the other keys.
+	offset := 0
+	for i, node := range path {
+		if node.count == 1 {
+			if i != 0 {
+				offset++
+			}
+			return append(Prefix{}, key[:offset]...), true
+		}
+		offset += len(node.prefix)
+	}
+	return append(Prefix{}, key...), true
 }
 
-// VisitPrefixes visits only nodes that represent prefixes of key.
-// To say the obvious, returning SkipSubtree from visitor makes no sense here.
-func (trie *Trie) VisitPrefixes(key Prefix, caseInsensitive bool, visitor VisitorFunc) error {
-	// Nil key not allowed.
-	if key == nil {
+// BestPrefixMatches returns the keys sharing the longest common prefix with
+// query and the length of that prefix. It descends along query as far as
+// the stored keys allow and returns all the keys under the deepest node
+// reached, in the order Visit visits them. When some keys start with the whole
+// query, these are returned with commonLen being the length of query, so this
+// works as a fallback for the subtree searches finding nothing. Only an empty
+// trie returns no keys.
+func (trie *Trie) BestPrefixMatches(query Prefix) (commonLen int, matches []Prefix) {
+	// Nil prefix not allowed.
+	if query == nil {
 		panic(ErrNilPrefix)
 	}
+	query = trie.foldKey(query)
 
 	// Empty trie must be handled explicitly.
-	if trie.prefix == nil {
-		return nil
+	if trie.prefix == nil || trie.count == 0 {
+		return 0, nil
 	}
 
-	// Walk the path matching key prefixes.
+	var key Prefix
 	node := trie
-	prefix := key
-	offset := 0
 	for {
-		// Compute what part of prefix matches.
-		common := node.longestCommonPrefixLength(key, caseInsensitive)
-		key = key[common:]
-		offset += common
-
-		// Partial match means that there is no subtree matching prefix.
-		if common < len(node.prefix) {
-			return nil
-		}
-
-		// Call the visitor.
-		if item := node.item; item != nil {
-			if err := visitor(prefix[:offset], item); err != nil {
-				return err
-			}
-		}
-
-		if len(key) == 0 {
-			// This node represents key, we are finished.
-			return nil
+		common := node.longestCommonPrefixLength(query, false)
+		key = append(key, node.prefix...)
+		commonLen += common
+		query = query[common:]
+		if common < len(node.prefix) || len(query) == 0 {
+			break
 		}
 
-		// There is some key suffix left, move to the children.
-		child := node.children.next(key[0])
-		if child == nil {
-			// There is nowhere to continue, return.
-			return nil
+		// Skip the tombstones of lazily deleted keys.
+		child := node.children.next(query[0])
+		if child == nil || child.count == 0 {
+			break
 		}
-
 		node = child
 	}
+
+	node.walk(key, func(prefix Prefix, item Item) error {
+		matches = append(matches, prefix)
+		return nil
+	})
+	return commonLen, matches
 }
 
-// Delete deletes the item represented by the given prefix.
+// MovePrefix re-keys all the items stored under keys starting with from,
+// replacing the leading from bytes of every such key with to. The number
+// of items moved is returned.
 //
-// True is returned if the matching node was found and deleted.
-func (trie *Trie) Delete(key Prefix) (deleted bool) {
+// The moved items always win in case of conflicts, i.e. when a re-keyed key
+// is already present in the trie, the item stored there is replaced. When
+// the key validator rejects any of the re-keyed keys, nothing is moved
+// and 0 is returned, see WithKeyValidator.
+func (trie *Trie) MovePrefix(from, to Prefix) int {
 	// Nil prefix not allowed.
-	if key == nil {
+	if from == nil || to == nil {
 		panic(ErrNilPrefix)
 	}
 
-	// Empty trie must be handled explicitly.
-	if trie.prefix == nil {
-		return false
-	}
+	var entries []Entry
+	trie.visitSubtreeExact(trie.foldKey(from), func(prefix Prefix, item Item) error {
+		key := make(Prefix, 0, len(to)+len(prefix)-len(from))
+		key = append(key, to...)
+		key = append(key, prefix[len(from):]...)
+		entries = append(entries, Entry{key, item})
+		return nil
+	})
 
-	// Find the relevant node.
-	path, found, _ := trie.findSubtreePath(key)
-	if !found {
-		return false
+	if len(entries) == 0 {
+		return 0
 	}
-
-	node := path[len(path)-1]
-	var parent *Trie
-	if len(path) != 1 {
-		parent = path[len(path)-2]
+	for _, entry := range entries {
+		if trie.checkKey(entry.Key) != nil {
+			return 0
+		}
 	}
 
-	// If the item is already set to nil, there is nothing to do.
-	if node.item == nil {
-		return false
+	trie.DeleteSubtree(from)
+	for _, entry := range entries {
+		trie.Set(entry.Key, entry.Item)
 	}
 
-	// Delete the item.
-	node.item = nil
-
-	// Initialise i before goto.
-	// Will be used later in a loop.
-	i := len(path) - 1
+	return len(entries)
+}
 
-	// In case there are some child nodes, we cannot drop the whole subtree.
-	// We can try to compact nodes, though.
-	if node.children.length() != 0 {
-		goto Compact
-	}
+// RecomputeMasks walks the whole trie and recomputes the mask of every node
+// from its own prefix and the masks of its children.
+//
+// The masks are normally kept up to date by the methods modifying the trie,
+// so this is only needed to repair the trie after its nodes were restructured
+// directly.
+func (trie *Trie) RecomputeMasks() {
+	trie.recomputeMasks(trie.opts.masks())
+}
 
-	// In case we are at the root, just reset it and we are done.
-	if parent == nil {
-		node.reset()
-		return true
+// Normalize merges every node not holding an item into its only child as long
+// as the merged prefix fits into a single node, restoring the edge compression
+// of a trie whose keys were split into more nodes than necessary, e.g. a trie
+// built with a smaller maximum prefix length. Unlike Compact, the other nodes
+// and their child lists are left untouched and the tombstones of lazily
+// deleted keys are kept.
+func (trie *Trie) Normalize() {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return
 	}
+	trie.normalize(trie, nil)
+}
 
-	// We can drop a subtree.
-	// Find the first ancestor that has its value set or it has 2 or more child nodes.
-	// That will be the node where to drop the subtree at.
-	for ; i >= 0; i-- {
-		if current := path[i]; current.item != nil || current.children.length() >= 2 {
+// normalize merges the chains of nodes starting at node, prefix being the key
+// of the parent of node. trie must be the root.
+func (trie *Trie) normalize(node *Trie, prefix Prefix) {
+	merged := false
+	for !node.hasItem && node.children.length() == 1 {
+		child := node.children.head()
+		if len(node.prefix)+len(child.prefix) > maxPrefixPerNode {
 			break
 		}
-	}
 
-	// Handle the case when there is no such node.
-	// In other words, we can reset the whole tree.
-	if i == -1 {
-		path[0].reset()
-		return true
+		// A new slice is allocated since the prefixes can be borrowed.
+		concatenated := make(Prefix, 0, len(node.prefix)+len(child.prefix))
+		concatenated = append(append(concatenated, node.prefix...), child.prefix...)
+		node.prefix = concatenated
+		node.item, node.hasItem, node.weight = child.item, child.hasItem, child.weight
+		node.children = child.children
+		trie.freeNode(child)
+		merged = true
 	}
-
-	// We can just remove the subtree here.
-	node = path[i]
-	if i == 0 {
-		parent = nil
-	} else {
-		parent = path[i-1]
+	if merged {
+		trie.merged(prefix, node.prefix)
 	}
-	// i+1 is always a valid index since i is never pointing to the last node.
-	// The loop above skips at least the last node since we are sure that the item
-	// is set to nil and it has no children, othewise we would be compacting instead.
-	node.children.remove(path[i+1].prefix[0])
 
-	// lastly, the bitmasks of all of the parent nodes have to be updated again, since
-	// a child node of all of them has bin removed
-	for ; i >= 0; i-- {
-		n := path[i]
-		n.mask = n.children.combinedMask()
+	prefix = append(prefix, node.prefix...)
+	for _, child := range node.children.getChildren() {
+		trie.normalize(child, prefix)
 	}
+}
 
-Compact:
-	// The node is set to the first non-empty ancestor,
-	// so try to compact since that might be possible now.
-	if compacted := node.compact(); compacted != node {
-		if parent == nil {
-			*node = *compacted
-		} else {
-			parent.children.replace(node.prefix[0], compacted)
-			*parent = *parent.compact()
-		}
+func (trie *Trie) recomputeMasks(masks *charmapMasks) {
+	for _, child := range trie.children.getChildren() {
+		child.recomputeMasks(masks)
 	}
+	trie.updateMask(masks)
+}
 
-	return true
+// Internal helper methods -----------------------------------------------------
+
+func (trie *Trie) empty() bool {
+	return !trie.hasItem && trie.children.length() == 0
 }
 
-// DeleteSubtree finds the subtree exactly matching prefix and deletes it.
-//
-// True is returned if the subtree was found and deleted.
-func (trie *Trie) DeleteSubtree(prefix Prefix) (deleted bool) {
-	// Nil prefix not allowed.
-	if prefix == nil {
-		panic(ErrNilPrefix)
-	}
+func (trie *Trie) reset() {
+	trie.prefix = nil
+	trie.item = nil
+	trie.hasItem = false
+	trie.weight = 0
+	trie.mask = 0
+	trie.count = 0
+	trie.children = newSuperDenseChildList()
+}
 
-	// Empty trie must be handled explicitly.
-	if trie.prefix == nil {
-		return false
+// options returns the options of the trie, allocating them when necessary.
+func (trie *Trie) options() *trieOptions {
+	if trie.opts == nil {
+		trie.opts = &trieOptions{}
 	}
+	return trie.opts
+}
 
-	// Locate the relevant subtree.
-	parent, root, found, _ := trie.findSubtree(prefix)
-	path, _, _ := trie.findSubtreePath(prefix)
-	if !found {
-		return false
+// foldKey returns key folded to lower case when the trie is case-insensitive.
+func (trie *Trie) foldKey(key Prefix) Prefix {
+	if trie.opts == nil || !trie.opts.foldCase {
+		return key
 	}
 
-	// If we are in the root of the trie, reset the trie.
-	if parent == nil {
-		root.reset()
-		return true
+	for i, b := range key {
+		if b >= 'A' && b <= 'Z' {
+			folded := make(Prefix, len(key))
+			copy(folded, key[:i])
+			for j := i; j < len(key); j++ {
+				folded[j] = toLower(key[j])
+			}
+			return folded
+		}
 	}
+	return key
+}
 
-	// Otherwise remove the root node from its parent.
-	parent.children.remove(root.prefix[0])
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
 
-	// update masks
-	parent.mask = parent.children.combinedMask()
-	for i := len(path) - 1; i >= 0; i-- {
-		n := path[i]
-		n.mask = n.children.combinedMask()
+// addChild adds child to the children of node, bucketing the children
+// when there are more of them than allowed by MaxFanout.
+// trie must be the root.
+func (trie *Trie) addChild(node, child *Trie) {
+	node.children = node.children.add(child)
+	if trie.opts == nil || trie.opts.maxFanout == 0 || node.children.length() <= trie.opts.maxFanout {
+		return
+	}
+	if list, ok := node.children.(*superDenseChildList); ok {
+		node.children = newBucketedChildList(list)
 	}
+}
 
-	return true
+// checkKey validates key to be inserted using the key validator, if any.
+// The nil key is left for put to reject.
+func (trie *Trie) checkKey(key Prefix) error {
+	if key == nil || trie.opts == nil || trie.opts.validateKey == nil {
+		return nil
+	}
+	return trie.opts.validateKey(key)
 }
 
-// Internal helper methods -----------------------------------------------------
+// storedKey returns the key that is to be stored in the trie nodes,
+// which is a copy of key unless the keys are borrowed or interned.
+func (trie *Trie) storedKey(key Prefix) Prefix {
+	if trie.opts != nil && trie.opts.borrowKeys {
+		return key
+	}
+	if trie.opts != nil && trie.opts.interned != nil {
+		return trie.opts.interned.intern(key)
+	}
+	stored := make(Prefix, len(key))
+	copy(stored, key)
+	return stored
+}
 
-func (trie *Trie) empty() bool {
-	return trie.item == nil && trie.children.length() == 0
+// modified must be called on the root node whenever the trie is modified.
+func (trie *Trie) modified() {
+	if trie.opts != nil {
+		trie.opts.version++
+	}
 }
 
-func (trie *Trie) reset() {
-	trie.prefix = nil
-	trie.children = newSuperDenseChildList()
+// updateMask sets the mask of the node from its own prefix and the masks
+// of its children, which must already be up to date.
+func (trie *Trie) updateMask(masks *charmapMasks) {
+	trie.mask = masks.prefixMask(trie.prefix) | trie.children.combinedMask()
 }
 
 func makePrefixMask(key Prefix) uint64 {
@@ -628,34 +3206,54 @@ func caseInsensitiveMask(mask uint64) uint64 {
 
 var charmap = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
 
-func (trie *Trie) put(key Prefix, item Item, replace bool) (inserted bool) {
+// put inserts item under key and returns whether it was inserted and
+// the length of the common prefix of the node prefix that was split, if any.
+func (trie *Trie) put(key Prefix, item Item, replace bool, merge func(old, new Item) Item) (inserted bool, splitAt int) {
 	// Nil prefix not allowed.
 	if key == nil {
 		panic(ErrNilPrefix)
 	}
+	key = trie.foldKey(key)
 
 	var (
 		common int
 		node   = trie
 		child  *Trie
 		mask   uint64
+
+		fullKey = key
+		masks   = trie.opts.masks()
+
+		// path collects the nodes whose item counts are to be updated.
+		pathBuf [16]*Trie
+		path    = pathBuf[:0]
 	)
 
-	mask = makePrefixMask(key)
+	splitAt = -1
+	trie.modified()
+	if trie.opts != nil && trie.opts.bloom != nil {
+		trie.opts.bloom.add(key)
+	}
+
+	mask = masks.prefixMask(key)
 
 	if node.prefix == nil {
+		path = append(path, node)
 		node.mask |= mask
+		key = trie.storedKey(key)
 		if len(key) <= maxPrefixPerNode {
 			node.prefix = key
 			goto InsertItem
 		}
 		node.prefix = key[:maxPrefixPerNode]
 		key = key[maxPrefixPerNode:]
-		mask = makePrefixMask(key)
+		mask = masks.prefixMask(key)
 		goto AppendChild
 	}
 
 	for {
+		path = append(path, node)
+
 		// Compute the longest common prefix length.
 		common = node.longestCommonPrefixLength(key, false)
 		key = key[common:]
@@ -676,6 +3274,7 @@ func (trie *Trie) put(key Prefix, item Item, replace bool) (inserted bool) {
 		// Check children for matching prefix.
 		child = node.children.next(key[0])
 		if child == nil {
+			key = trie.storedKey(key)
 			goto AppendChild
 		}
 		node = child
@@ -683,44 +3282,84 @@ func (trie *Trie) put(key Prefix, item Item, replace bool) (inserted bool) {
 
 SplitPrefix:
 	// Split the prefix if necessary.
-	child = new(Trie)
+	splitAt = common
+	child = trie.newNode()
 	*child = *node
 	*node = *NewTrie()
+	node.opts, child.opts = child.opts, nil
 	node.prefix = child.prefix[:common]
 	child.prefix = child.prefix[common:]
-	child = child.compact()
-	node.children = node.children.add(child)
+	trie.split(fullKey[:len(fullKey)-len(key)], child.prefix)
+	if compacted := child.compact(); compacted != child {
+		trie.freeNode(child)
+		child = compacted
+		trie.merged(fullKey[:len(fullKey)-len(key)], child.prefix)
+	}
+	trie.addChild(node, child)
 	node.mask = child.mask
 	node.mask |= mask
-	mask = makePrefixMask(key)
+	node.count = child.count
+	mask = masks.prefixMask(key)
+	key = trie.storedKey(key)
 
 AppendChild:
 	// Keep appending children until whole prefix is inserted.
 	// This loop starts with empty node.prefix that needs to be filled.
 	for len(key) != 0 {
-		child := NewTrie()
+		child := trie.newNode()
 		child.mask = mask
 		if len(key) <= maxPrefixPerNode {
 			child.prefix = key
-			node.children = node.children.add(child)
+			trie.addChild(node, child)
 			node = child
+			path = append(path, node)
 			goto InsertItem
 		} else {
 			child.prefix = key[:maxPrefixPerNode]
 			key = key[maxPrefixPerNode:]
-			mask = makePrefixMask(key)
-			node.children = node.children.add(child)
+			mask = masks.prefixMask(key)
+			trie.addChild(node, child)
 			node = child
+			path = append(path, node)
 		}
 	}
 
 InsertItem:
 	// Try to insert the item if possible.
-	if replace || node.item == nil {
+	old := node.item
+	if merge != nil && node.hasItem {
+		node.item = merge(node.item, item)
+		inserted = true
+	} else if replace || !node.hasItem {
 		node.item = item
-		return true
+		inserted = true
 	}
-	return false
+
+	if inserted && trie.opts != nil && trie.opts.wal != nil {
+		trie.opts.wal.set(fullKey, node.item)
+	}
+
+	// Acquire the new item first, so replacing an item with itself
+	// does not release it.
+	if inserted && trie.opts != nil && trie.opts.refs != nil {
+		trie.opts.refs.acquire(node.item)
+		if node.hasItem {
+			trie.opts.refs.release(old)
+		}
+	}
+
+	// Keep the item counts up to date.
+	if inserted && !node.hasItem {
+		node.hasItem = true
+		for _, n := range path {
+			n.count++
+		}
+		if trie.opts != nil && trie.opts.eviction != nil {
+			trie.opts.eviction.inserted(fullKey)
+			trie.evict()
+		}
+	}
+	return
 }
 
 func (trie *Trie) compact() *Trie {
@@ -734,7 +3373,7 @@ func (trie *Trie) compact() *Trie {
 	// If any item is set, we cannot compact since we want to retain
 	// the ability to do searching by key. This makes compaction less usable,
 	// but that simply cannot be avoided.
-	if trie.item != nil || child.item != nil {
+	if trie.hasItem || child.hasItem {
 		return trie
 	}
 
@@ -744,11 +3383,11 @@ func (trie *Trie) compact() *Trie {
 	}
 
 	// Concatenate the prefixes, move the items.
-	child.prefix = append(trie.prefix, child.prefix...)
+	// A new slice is allocated since the prefixes can be borrowed.
+	prefix := make(Prefix, 0, len(trie.prefix)+len(child.prefix))
+	prefix = append(prefix, trie.prefix...)
+	child.prefix = append(prefix, child.prefix...)
 	child.mask = trie.mask
-	if trie.item != nil {
-		child.item = trie.item
-	}
 
 	return child
 }
@@ -823,6 +3462,44 @@ func (trie *Trie) findSubtreePath(prefix Prefix) (path []*Trie, found bool, left
 	}
 }
 
+// entryAt returns the i-th entry in the sorted order of the keys,
+// i must be a valid index.
+func (trie *Trie) entryAt(i int) (Prefix, Item) {
+	var key Prefix
+	node := trie
+	for {
+		key = append(key, node.prefix...)
+		if node.hasItem {
+			if i == 0 {
+				return key, node.item
+			}
+			i--
+		}
+
+		for _, child := range node.children.getChildren() {
+			if i < child.count {
+				node = child
+				break
+			}
+			i -= child.count
+		}
+	}
+}
+
+// itemPath returns the path to the node holding the item stored under key.
+func (trie *Trie) itemPath(key Prefix) (path []*Trie, ok bool) {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil, false
+	}
+
+	path, found, leftover := trie.findSubtreePath(key)
+	if !found || len(leftover) != 0 || !path[len(path)-1].hasItem {
+		return nil, false
+	}
+	return path, true
+}
+
 func (trie *Trie) walk(actualRootPrefix Prefix, visitor VisitorFunc) error {
 	var prefix Prefix
 	// Allocate a bit more space for prefix at the beginning.
@@ -837,9 +3514,9 @@ func (trie *Trie) walk(actualRootPrefix Prefix, visitor VisitorFunc) error {
 	}
 
 	// Visit the root first. Not that this works for empty trie as well since
-	// in that case item == nil && len(children) == 0.
-	if trie.item != nil {
-		if err := visitor(prefix, trie.item); err != nil {
+	// in that case hasItem == false && len(children) == 0.
+	if trie.hasItem {
+		if err := visitor(append(Prefix{}, prefix...), trie.item); err != nil {
 			if err == SkipSubtree {
 				return nil
 			}
@@ -851,6 +3528,61 @@ func (trie *Trie) walk(actualRootPrefix Prefix, visitor VisitorFunc) error {
 	return trie.children.walk(&prefix, visitor)
 }
 
+// walkNodes calls visitor on every node of the trie in preorder.
+// The depth of the root node is 0.
+func (trie *Trie) walkNodes(visitor func(prefix Prefix, node *Trie, depth int) error) error {
+	// Empty trie has no nodes to visit.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	return trie.walkNodesRecursive(&prefix, 0, visitor)
+}
+
+func (trie *Trie) walkNodesRecursive(prefix *Prefix, depth int, visitor func(prefix Prefix, node *Trie, depth int) error) error {
+	if err := visitor(*prefix, trie, depth); err != nil {
+		if err == SkipSubtree {
+			return nil
+		}
+		return err
+	}
+
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		err := child.walkNodesRecursive(prefix, depth+1, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (trie *Trie) walkSorted(prefix *Prefix, visitor VisitorFunc) error {
+	if trie.hasItem {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		err := child.walkSorted(prefix, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (trie *Trie) longestCommonPrefixLength(prefix Prefix, caseInsensitive bool) (i int) {
 	for ; i < len(prefix) && i < len(trie.prefix); i++ {
 		p := prefix[i]
@@ -869,6 +3601,13 @@ func (trie *Trie) longestCommonPrefixLength(prefix Prefix, caseInsensitive bool)
 	return
 }
 
+func matchByte(a, b byte, caseInsensitive bool) bool {
+	if caseInsensitive {
+		return matchCaseInsensitive(a, b)
+	}
+	return a == b
+}
+
 func matchCaseInsensitive(a byte, b byte) bool {
 	return a == b+32 || b == a+32 || a == b
 }
@@ -884,9 +3623,49 @@ func (trie *Trie) print(writer io.Writer, indent int) {
 	trie.children.print(writer, indent+2)
 }
 
+func (trie *Trie) printLimit(writer io.Writer, indent int, budget *int) bool {
+	if *budget <= 0 {
+		fmt.Fprintf(writer, "%s...\n", strings.Repeat(" ", indent))
+		return false
+	}
+	*budget--
+
+	marker := ""
+	if trie.hasItem {
+		marker = " *"
+	}
+	fmt.Fprintf(writer, "%s%q%s\n", strings.Repeat(" ", indent), trie.prefix, marker)
+
+	for _, child := range trie.children.getChildren() {
+		if !child.printLimit(writer, indent+2, budget) {
+			return false
+		}
+	}
+	return true
+}
+
 // Errors ----------------------------------------------------------------------
 
 var (
 	SkipSubtree  = errors.New("Skip this subtree")
 	ErrNilPrefix = errors.New("Nil prefix passed into a method call")
+
+	// errNotEqual stops the walk in Equal once a difference is found.
+	errNotEqual = errors.New("Tries not equal")
 )
+
+// VisitError wraps an error returned from a visitor together with the key
+// of the item being visited when the error occurred.
+type VisitError struct {
+	Key Prefix
+	Err error
+}
+
+func (err *VisitError) Error() string {
+	return fmt.Sprintf("visiting %q: %v", err.Key, err.Err)
+}
+
+// Unwrap returns the error returned from the visitor.
+func (err *VisitError) Unwrap() error {
+	return err.Err
+}
@@ -103,6 +103,29 @@ func TestTrie_InsertDenseDuplicatePrefixes(t *testing.T) {
 	}
 }
 
+func TestTrie_VisitPrefixesRetainKeysDense(t *testing.T) {
+	trie := NewTrie()
+	want := []string{"a", "ab", "abc", "abcd"}
+	for _, key := range want {
+		trie.Insert(Prefix(key), struct{}{})
+		// Give every node on the path plenty of siblings.
+		for b := byte('e'); b <= 'z'; b++ {
+			trie.Insert(append(Prefix(key[:len(key)-1]), b), struct{}{})
+		}
+	}
+
+	query := Prefix("abcdef")
+	var keys []Prefix
+	trie.VisitPrefixes(query, false, func(prefix Prefix, item Item) error {
+		keys = append(keys, prefix)
+		return nil
+	})
+
+	// The keys do not alias the query either.
+	copy(query, "~~~~~~")
+	checkIndependentKeys(t, "VisitPrefixes", keys, want)
+}
+
 func TestTrie_CloneDense(t *testing.T) {
 	trie := NewTrie()
 
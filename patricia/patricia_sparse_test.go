@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -132,6 +133,34 @@ func TestTrie_SetGet(t *testing.T) {
 	}
 }
 
+func TestTrie_InsertMerge(t *testing.T) {
+	trie := NewTrie()
+	sum := func(old, new Item) Item {
+		return old.(int) + new.(int)
+	}
+
+	data := []testData{
+		{"Pepa", 1, failure},
+		{"Honza", 2, failure},
+		{"Pepa", 3, success},
+		{"Pepa", 4, success},
+	}
+
+	for _, v := range data {
+		t.Logf("INSERT MERGE prefix=%v, item=%v, merged=%v", v.key, v.value, v.retVal)
+		if merged := trie.InsertMerge(Prefix(v.key), v.value, sum); merged != v.retVal {
+			t.Errorf("Unexpected return value, expected=%v, got=%v", v.retVal, merged)
+		}
+	}
+
+	if item := trie.Get(Prefix("Pepa")); item != 8 {
+		t.Errorf("Unexpected item, expected=8, got=%v", item)
+	}
+	if item := trie.Get(Prefix("Honza")); item != 2 {
+		t.Errorf("Unexpected item, expected=2, got=%v", item)
+	}
+}
+
 func TestTrie_Match(t *testing.T) {
 	trie := NewTrie()
 
@@ -246,6 +275,183 @@ func TestTrie_Visit(t *testing.T) {
 	}
 }
 
+func TestTrie_DifferenceIntersection(t *testing.T) {
+	trie := NewTrie()
+	for i, key := range []string{"a", "b", "c"} {
+		trie.Insert(Prefix(key), i)
+	}
+	other := NewTrie()
+	other.Insert(Prefix("b"), 42)
+	other.Insert(Prefix("d"), 43)
+
+	collect := func(trie *Trie) map[string]Item {
+		entries := make(map[string]Item)
+		trie.Visit(func(prefix Prefix, item Item) error {
+			entries[string(prefix)] = item
+			return nil
+		})
+		return entries
+	}
+
+	if got, want := collect(trie.Difference(other)), map[string]Item{"a": 0, "c": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected difference, expected=%v, got=%v", want, got)
+	}
+	if got, want := collect(trie.Intersection(other)), map[string]Item{"b": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected intersection, expected=%v, got=%v", want, got)
+	}
+	if got := trie.Intersection(NewTrie()).Len(); got != 0 {
+		t.Errorf("Unexpected intersection with an empty trie, got %d items", got)
+	}
+
+	// The options of the receiver are kept.
+	folded := NewCaseInsensitiveTrie()
+	folded.Insert(Prefix("Pepan"), 0)
+	folded.Insert(Prefix("Honza"), 1)
+	others := NewTrie()
+	others.Insert(Prefix("honza"), 2)
+	for name, result := range map[string]*Trie{
+		"difference":   folded.Difference(others),
+		"intersection": folded.Intersection(others),
+	} {
+		result.Insert(Prefix("KAREL"), 3)
+		if !result.Match(Prefix("karel")) || !result.Match(Prefix("Karel")) {
+			t.Errorf("The %s is not case-insensitive", name)
+		}
+	}
+	if !folded.Intersection(others).Match(Prefix("HONZA")) {
+		t.Error("Unexpected intersection of the case-insensitive trie")
+	}
+
+	bounded := NewBoundedTrie(2, nil)
+	bounded.Insert(Prefix("a"), 0)
+	bounded.Insert(Prefix("b"), 1)
+	result := bounded.Difference(NewTrie())
+	result.Insert(Prefix("c"), 2)
+	if result.Len() != 2 || result.Match(Prefix("a")) {
+		t.Errorf("Unexpected difference of the bounded trie, got=%v", result.SortedEntries())
+	}
+}
+
+func TestTrie_DiffTries(t *testing.T) {
+	a := NewTrie()
+	for i, key := range []string{"", "Pep", "Pepan", "Pepanek", "Honza", "Karel"} {
+		a.Insert(Prefix(key), i)
+	}
+	b := NewTrie()
+	for i, key := range []string{"Pe", "Pepan", "Pepin", "Honza", "Jenik", "Karela"} {
+		b.Insert(Prefix(key), 10+i)
+	}
+
+	var got []string
+	err := DiffTries(a, b, func(key Prefix, inA, inB bool, itemA, itemB Item) error {
+		switch {
+		case inA && inB:
+			got = append(got, fmt.Sprintf("both %s %v %v", key, itemA, itemB))
+		case inA:
+			got = append(got, fmt.Sprintf("A %s %v %v", key, itemA, itemB))
+		default:
+			got = append(got, fmt.Sprintf("B %s %v %v", key, itemA, itemB))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"A  0 <nil>",
+		"both Honza 4 13",
+		"B Jenik <nil> 14",
+		"A Karel 5 <nil>",
+		"B Karela <nil> 15",
+		"B Pe <nil> 10",
+		"A Pep 1 <nil>",
+		"both Pepan 2 11",
+		"A Pepanek 3 <nil>",
+		"B Pepin <nil> 12",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected diff, expected=%q, got=%q", want, got)
+	}
+
+	// An empty trie yields all the keys of the other one.
+	var n int
+	DiffTries(NewTrie(), b, func(key Prefix, inA, inB bool, itemA, itemB Item) error {
+		if inA || !inB {
+			t.Errorf("Unexpected classification of %q, inA=%v inB=%v", key, inA, inB)
+		}
+		n++
+		return nil
+	})
+	if n != b.Len() {
+		t.Errorf("Unexpected number of keys, expected=%d, got=%d", b.Len(), n)
+	}
+
+	stop := errors.New("stop")
+	if err := DiffTries(a, b, func(Prefix, bool, bool, Item, Item) error { return stop }); err != stop {
+		t.Errorf("Unexpected error, expected=%v, got=%v", stop, err)
+	}
+}
+
+func TestTrie_Reduce(t *testing.T) {
+	trie := NewTrie()
+
+	data := []testData{
+		{"Pepa", 1, success},
+		{"Pepa Zdepa", 2, success},
+		{"Pepa Kuchar", 3, success},
+		{"Honza", 4, success},
+		{"Jenik", 5, success},
+	}
+
+	for _, v := range data {
+		t.Logf("INSERT prefix=%v, item=%v, success=%v", v.key, v.value, v.retVal)
+		if ok := trie.Insert([]byte(v.key), v.value); ok != v.retVal {
+			t.Fatalf("Unexpected return value, expected=%v, got=%v", v.retVal, ok)
+		}
+	}
+
+	sum := trie.Reduce(0, func(acc interface{}, prefix Prefix, item Item) interface{} {
+		return acc.(int) + item.(int)
+	})
+	if sum != 15 {
+		t.Errorf("Unexpected sum, expected=15, got=%v", sum)
+	}
+
+	if acc := NewTrie().Reduce(42, nil); acc != 42 {
+		t.Errorf("Unexpected accumulator for an empty trie, expected=42, got=%v", acc)
+	}
+}
+
+func TestTrie_VisitNodes(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("abc"), 0)
+	trie.Insert(Prefix("abd"), 1)
+
+	type node struct {
+		hasItem    bool
+		childCount int
+	}
+
+	nodes := make(map[string]node)
+	if err := trie.VisitNodes(func(prefix Prefix, hasItem bool, childCount int, mask uint64) error {
+		t.Logf("VISITING prefix=%q, hasItem=%v, childCount=%v, mask=%b", prefix, hasItem, childCount, mask)
+		nodes[string(prefix)] = node{hasItem, childCount}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]node{
+		"ab":  {false, 2},
+		"abc": {true, 0},
+		"abd": {true, 0},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Unexpected nodes visited, expected=%v, got=%v", want, nodes)
+	}
+}
+
 func TestTrie_VisitSkipSubtree(t *testing.T) {
 	trie := NewTrie()
 
@@ -312,6 +518,43 @@ func TestTrie_VisitReturnError(t *testing.T) {
 	}
 }
 
+func TestTrie_VisitSubtreeE(t *testing.T) {
+	trie := NewTrie()
+
+	data := []testData{
+		{"Pepa", 0, success},
+		{"Pepa Zdepa", 1, success},
+		{"Pepa Kuchar", 2, success},
+		{"Honza", 3, success},
+	}
+
+	for _, v := range data {
+		t.Logf("INSERT prefix=%v, item=%v, success=%v", v.key, v.value, v.retVal)
+		if ok := trie.Insert([]byte(v.key), v.value); ok != v.retVal {
+			t.Fatalf("Unexpected return value, expected=%v, got=%v", v.retVal, ok)
+		}
+	}
+
+	someErr := errors.New("Something exploded")
+	err := trie.VisitSubtreeE(Prefix("Pep"), func(prefix Prefix, item Item) error {
+		if item.(int) == 1 {
+			return someErr
+		}
+		return nil
+	})
+
+	var visitErr *VisitError
+	if !errors.As(err, &visitErr) {
+		t.Fatalf("Unexpected error returned, expected *VisitError, got %v", err)
+	}
+	if string(visitErr.Key) != "Pepa Zdepa" {
+		t.Errorf("Unexpected key in the error, expected=%q, got=%q", "Pepa Zdepa", visitErr.Key)
+	}
+	if !errors.Is(err, someErr) {
+		t.Errorf("Unexpected wrapped error, expected=%v, got=%v", someErr, visitErr.Err)
+	}
+}
+
 func TestTrie_VisitSubtree(t *testing.T) {
 	trie := NewTrie()
 
@@ -353,6 +596,58 @@ func TestTrie_VisitSubtree(t *testing.T) {
 	}
 }
 
+func TestTrie_VisitSubtreeIncludeRoot(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"dir", "dir/a", "dir/b", "dirt"} {
+		trie.Insert(Prefix(key), key)
+	}
+
+	testQueries := []struct {
+		prefix      string
+		includeRoot bool
+		want        []string
+	}{
+		{"dir", true, []string{"dir", "dir/a", "dir/b", "dirt"}},
+		{"dir", false, []string{"dir/a", "dir/b", "dirt"}},
+		{"dir/", false, []string{"dir/a", "dir/b"}},
+		{"dir/a", false, nil},
+		{"dir/a", true, []string{"dir/a"}},
+	}
+
+	for _, data := range testQueries {
+		var got []string
+		err := trie.VisitSubtreeIncludeRoot(Prefix(data.prefix), data.includeRoot, func(prefix Prefix, item Item) error {
+			got = append(got, string(prefix))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, data.want) {
+			t.Errorf("Unexpected keys for %q (include root %v), expected=%v, got=%v",
+				data.prefix, data.includeRoot, data.want, got)
+		}
+	}
+}
+
+func TestTrie_VisitPrefixesRetainKeys(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"P", "Pe", "Pep", "Pepa", "Pepa Zdepa", "Honza"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	query := Prefix("Pepa Zdepa Kuchar")
+	var keys []Prefix
+	trie.VisitPrefixes(query, false, func(prefix Prefix, item Item) error {
+		keys = append(keys, prefix)
+		return nil
+	})
+
+	// The keys do not alias the query either.
+	copy(query, "~~~~~~~~~~~~~~~~~")
+	checkIndependentKeys(t, "VisitPrefixes", keys, []string{"P", "Pe", "Pep", "Pepa", "Pepa Zdepa"})
+}
+
 func TestTrie_VisitPrefixes(t *testing.T) {
 	trie := NewTrie()
 
@@ -393,6 +688,63 @@ func TestTrie_VisitPrefixes(t *testing.T) {
 	}
 }
 
+func TestTrie_VisitPrefixesMinLen(t *testing.T) {
+	trie := NewTrie()
+
+	data := []testData{
+		{"a", 0, success},
+		{"ab", 1, success},
+		{"abc", 2, success},
+	}
+
+	for _, v := range data {
+		t.Logf("INSERT prefix=%v, item=%v, success=%v", v.key, v.value, v.retVal)
+		if ok := trie.Insert([]byte(v.key), v.value); ok != v.retVal {
+			t.Fatalf("Unexpected return value, expected=%v, got=%v", v.retVal, ok)
+		}
+	}
+
+	var visited []string
+	if err := trie.VisitPrefixesMinLen(Prefix("abc"), 2, false, func(prefix Prefix, item Item) error {
+		t.Logf("VISITING prefix=%q, item=%v", prefix, item)
+		visited = append(visited, string(prefix))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"ab", "abc"}; !reflect.DeepEqual(visited, want) {
+		t.Errorf("Unexpected prefixes visited, expected=%v, got=%v", want, visited)
+	}
+}
+
+func TestTrie_FindAllIn(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("ep"), 0)
+	trie.Insert(Prefix("an"), 1)
+	trie.Insert(Prefix("a"), 2)
+	trie.Insert(Prefix("xyz"), 3)
+
+	type occurrence struct {
+		key string
+		pos int
+	}
+
+	var found []occurrence
+	if err := trie.FindAllIn(Prefix("Pepan"), func(key Prefix, item Item, pos int) error {
+		t.Logf("FOUND key=%q, item=%v, pos=%d", key, item, pos)
+		found = append(found, occurrence{string(key), pos})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []occurrence{{"ep", 1}, {"a", 3}, {"an", 3}}
+	if !reflect.DeepEqual(found, want) {
+		t.Errorf("Unexpected occurrences, expected=%v, got=%v", want, found)
+	}
+}
+
 func TestPatriciaTrie_CloneSparse(t *testing.T) {
 	trie := NewTrie()
 
@@ -598,6 +950,34 @@ func TestTrie_Dump(t *testing.T) {
 }
 */
 
+func TestTrie_String(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("Pepan"), 0)
+	trie.Insert(Prefix("Pepin"), 1)
+	trie.Insert(Prefix("Honza"), 2)
+
+	want := `""
+  "Honza" *
+  "Pep"
+    "an" *
+    "in" *
+`
+	if got := trie.String(); got != want {
+		t.Errorf("Unexpected string, expected\n%s\ngot\n%s", want, got)
+	}
+	if got := fmt.Sprint(trie); got != want {
+		t.Errorf("Unexpected formatted trie, expected\n%s\ngot\n%s", want, got)
+	}
+
+	want = `""
+  "Honza" *
+  ...
+`
+	if got := trie.StringLimit(2); got != want {
+		t.Errorf("Unexpected limited string, expected\n%s\ngot\n%s", want, got)
+	}
+}
+
 func TestTrie_compact(t *testing.T) {
 	trie := NewTrie()
 
@@ -776,16 +1156,16 @@ func ExampleTrie() {
 	// Output:
 	// "Pepa Novak" present? true
 	// Anybody called "Karel" here? true
+	// "Karel Hynek Macha": 4
+	// "Karel Macha": 3
 	// "Pepa Novak": 1
 	// "Pepa Sindelar": 2
-	// "Karel Macha": 3
-	// "Karel Hynek Macha": 4
 	// "Pepa Novak": 1
 	// "Pepa Sindelar": 2
 	// "Karel Hynek Macha": 10
 	// "Karel Hynek Macha": 10
-	// "Pepa Sindelar": 2
 	// "Karel Hynek Macha": 10
+	// "Pepa Sindelar": 2
 	// "Karel Hynek Macha": 10
 }
 
@@ -795,3 +1175,79 @@ func printItem(prefix Prefix, item Item) error {
 	fmt.Printf("%q: %v\n", prefix, item)
 	return nil
 }
+
+func TestTrie_MaxFanout(t *testing.T) {
+	trie := NewTrie(MaxFanout(16))
+	reference := NewTrie()
+	var keys []Prefix
+	for i := 0; i < 300; i++ {
+		key := Prefix{'k', 'e', 'y', byte(i % 256), byte(i / 256)}
+		keys = append(keys, key)
+		trie.Insert(key, i)
+		reference.Insert(key, i)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	if stats := reference.Stats(); stats.MaxFanout != 256 {
+		t.Errorf("Unexpected fan-out without the bound, expected=256, got=%d", stats.MaxFanout)
+	}
+	stats := trie.Stats()
+	if stats.MaxFanout > 16 {
+		t.Errorf("Unexpected fan-out, expected at most 16, got=%d", stats.MaxFanout)
+	}
+	if want := reference.Stats().NodeCount; stats.NodeCount != want {
+		t.Errorf("Unexpected node count, expected=%d, got=%d", want, stats.NodeCount)
+	}
+
+	for i, key := range keys {
+		if item := trie.Get(key); item != i {
+			t.Errorf("Unexpected item of %v, expected=%d, got=%v", key, i, item)
+		}
+	}
+	if !trie.Equal(reference, nil) {
+		t.Error("Bucketed trie differs from the reference trie")
+	}
+
+	// Rebuilding keeps the bound.
+	rebuilt := trie.Rebuild()
+	checkMasksRecursive(t, rebuilt)
+	checkCountsRecursive(t, rebuilt)
+	if fanout := rebuilt.Stats().MaxFanout; fanout > 16 {
+		t.Errorf("Unexpected fan-out of the rebuilt trie, expected at most 16, got=%d", fanout)
+	}
+	if !rebuilt.Equal(reference, nil) {
+		t.Error("Rebuilt bucketed trie differs from the reference trie")
+	}
+
+	// The children are still visited in order.
+	var got, want []string
+	trie.VisitSorted(func(prefix Prefix, item Item) error {
+		got = append(got, string(prefix))
+		return nil
+	})
+	reference.VisitSorted(func(prefix Prefix, item Item) error {
+		want = append(want, string(prefix))
+		return nil
+	})
+	if !reflect.DeepEqual(got, want) {
+		t.Error("Unexpected order of the keys of the bucketed trie")
+	}
+
+	for _, key := range keys[:200] {
+		trie.Delete(key)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+	if n := trie.Len(); n != 100 {
+		t.Errorf("Unexpected number of keys, expected=100, got=%d", n)
+	}
+	for i, key := range keys[200:] {
+		if item := trie.Get(key); item != 200+i {
+			t.Errorf("Unexpected item of %v, expected=%d, got=%v", key, 200+i, item)
+		}
+	}
+	if clone := trie.Clone(); !clone.Equal(trie, nil) {
+		t.Error("Clone of the bucketed trie differs")
+	}
+}
@@ -6,10 +6,18 @@
 package patricia
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	mrand "math/rand"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // Tests -----------------------------------------------------------------------
@@ -117,6 +125,179 @@ func TestTrie_DeleteAbsentPrefix(t *testing.T) {
 	}
 }
 
+func TestTrie_EmptyKey(t *testing.T) {
+	for _, keys := range [][]string{{"", "Pepan", "Pepin"}, {"Pepan", "Pepin", ""}, {"Pepan", ""}} {
+		trie := NewTrie()
+		for _, key := range keys {
+			if ok := trie.Insert(Prefix(key), key+"!"); !ok {
+				t.Errorf("Couldn't insert item %q", key)
+			}
+		}
+		checkMasksRecursive(t, trie)
+
+		if item := trie.Get(Prefix("")); item != "!" {
+			t.Errorf("Unexpected item, expected=%q, got=%v", "!", item)
+		}
+		if !trie.Match(Prefix("")) {
+			t.Error("Empty key not matched")
+		}
+
+		visited := make(map[string]bool)
+		trie.VisitSubstring(Prefix(""), false, func(prefix Prefix, item Item) error {
+			visited[string(prefix)] = true
+			return nil
+		})
+		for _, key := range keys {
+			if !visited[key] {
+				t.Errorf("item %q not found in result set %v", key, visited)
+			}
+		}
+
+		if ok := trie.Delete(Prefix("")); !ok {
+			t.Error("Couldn't delete the empty key")
+		}
+		if item := trie.Get(Prefix("")); item != nil {
+			t.Errorf("Unexpected item, expected=<nil>, got=%v", item)
+		}
+		for _, key := range keys[1:] {
+			if key == "" {
+				continue
+			}
+			if item := trie.Get(Prefix(key)); item != key+"!" {
+				t.Errorf("Unexpected item, expected=%q, got=%v", key+"!", item)
+			}
+		}
+		if ok := trie.Delete(Prefix("")); ok {
+			t.Error("Deleted the empty key twice")
+		}
+	}
+}
+
+func TestTrie_DeleteEmptySubtree(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix(""), 0)
+	trie.Insert(Prefix("Pepan"), 1)
+
+	if ok := trie.DeleteSubtree(Prefix("")); !ok {
+		t.Error("Couldn't delete the whole trie")
+	}
+	if item := trie.Get(Prefix("")); item != nil {
+		t.Errorf("Unexpected item, expected=<nil>, got=%v", item)
+	}
+}
+
+func TestTrie_DeleteInnerPrefix(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("Pepan"), 0)
+
+	if ok := trie.Delete(Prefix("Pep")); ok {
+		t.Error("Deleted a key that was never inserted")
+	}
+	if item := trie.Get(Prefix("Pepan")); item != 0 {
+		t.Errorf("Unexpected item, expected=0, got=%v", item)
+	}
+}
+
+func TestTrie_InsertCopiesKeys(t *testing.T) {
+	trie := NewTrie()
+
+	key := Prefix("Pepan")
+	trie.Insert(key, 0)
+	copy(key, "Honza")
+
+	if item := trie.Get(Prefix("Pepan")); item != 0 {
+		t.Errorf("Unexpected item, expected=0, got=%v", item)
+	}
+	if item := trie.Get(Prefix("Honza")); item != nil {
+		t.Errorf("Unexpected item, expected=<nil>, got=%v", item)
+	}
+}
+
+func TestTrie_InsertWithSplit(t *testing.T) {
+	trie := NewTrie()
+
+	testInserts := []struct {
+		key         string
+		wantOk      bool
+		wantSplitAt int
+	}{
+		{"abc", true, -1},
+		{"abd", true, 2},
+		{"abe", true, -1},
+		{"abd", false, -1},
+		{"a", true, 1},
+		{"xyz", true, 0},
+	}
+
+	for _, data := range testInserts {
+		ok, splitAt := trie.InsertWithSplit(Prefix(data.key), data.key)
+		if ok != data.wantOk || splitAt != data.wantSplitAt {
+			t.Errorf("Unexpected result of inserting %q, expected=%v %d, got=%v %d",
+				data.key, data.wantOk, data.wantSplitAt, ok, splitAt)
+		}
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+}
+
+func TestTrie_WithBorrowedKeys(t *testing.T) {
+	trie := NewTrie(WithBorrowedKeys())
+
+	keys := []Prefix{Prefix("Pepan"), Prefix("Pepin"), Prefix("Pepanek Zemlicka")}
+	for i, key := range keys {
+		trie.Insert(key, i)
+	}
+
+	for i, key := range keys {
+		if item := trie.Get(key); item != i {
+			t.Errorf("Unexpected item, expected=%v, got=%v", i, item)
+		}
+	}
+
+	// The root holds the prefix shared by all the keys, which is borrowed from the first key.
+	if &trie.prefix[0] != &keys[0][0] {
+		t.Error("Key was copied even though it should have been borrowed")
+	}
+}
+
+func TestTrie_CaseInsensitiveTrie(t *testing.T) {
+	trie := NewCaseInsensitiveTrie()
+
+	if ok := trie.Insert(Prefix("Pepan"), 0); !ok {
+		t.Error("Couldn't insert item Pepan")
+	}
+	if ok := trie.Insert(Prefix("PEPAN"), 1); ok {
+		t.Error("Inserted PEPAN even though Pepan is there")
+	}
+	trie.Insert(Prefix("Honza"), 2)
+
+	if item := trie.Get(Prefix("PEPAN")); item != 0 {
+		t.Errorf("Unexpected item, expected=0, got=%v", item)
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Unexpected number of items, expected=2, got=%d", trie.Len())
+	}
+	if !trie.MatchSubtree(Prefix("hON")) {
+		t.Error("Subtree hON not matched")
+	}
+
+	var keys []string
+	trie.VisitSubtree(Prefix("PEP"), func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []string{"pepan"}) {
+		t.Errorf("Unexpected keys visited, expected=[pepan], got=%v", keys)
+	}
+
+	if ok := trie.Delete(Prefix("pEpAn")); !ok {
+		t.Error("Couldn't delete pEpAn")
+	}
+	if trie.Len() != 1 {
+		t.Errorf("Unexpected number of items, expected=1, got=%d", trie.Len())
+	}
+}
+
 func reverse(s string) string {
 	runes := []rune(s)
 	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
@@ -142,6 +323,150 @@ func checkMasksRecursive(t *testing.T, root *Trie) {
 	}
 }
 
+func checkCountsRecursive(t *testing.T, root *Trie) {
+	if size := root.size(); root.count != size {
+		t.Errorf("invalid item count at prefix %q, expected=%d, got=%d", root.prefix, size, root.count)
+	}
+	for _, child := range root.children.getChildren() {
+		checkCountsRecursive(t, child)
+	}
+}
+
+// checkIndependentKeys checks that the keys retained from the visitor calls
+// of method are still valid and that none of them shares memory with another.
+func checkIndependentKeys(t *testing.T, method string, keys []Prefix, want []string) {
+	got := make([]string, len(keys))
+	for i, key := range keys {
+		got[i] = string(key)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys retained from %s, expected=%q, got=%q", method, want, got)
+		return
+	}
+
+	// Clobbering a key, including its spare capacity, must not affect the others.
+	for i, key := range keys {
+		_ = append(key, "~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~~"...)
+		for j := range key {
+			key[j] = '~'
+		}
+		for j := i + 1; j < len(keys); j++ {
+			if string(keys[j]) != want[j] {
+				t.Errorf("Key %q retained from %s clobbered by modifying %q", want[j], method, want[i])
+			}
+		}
+	}
+}
+
+func TestTrie_VisitorsRetainKeys(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pep"), struct{}{})
+
+	collect := func(keys *[]Prefix) VisitorFunc {
+		return func(prefix Prefix, item Item) error {
+			*keys = append(*keys, prefix)
+			return nil
+		}
+	}
+	collectFuzzy := func(keys *[]Prefix) FuzzyVisitorFunc {
+		return func(prefix Prefix, item Item, skipped int) error {
+			*keys = append(*keys, prefix)
+			return nil
+		}
+	}
+
+	var keys []Prefix
+	trie.Visit(collect(&keys))
+	checkIndependentKeys(t, "Visit", keys,
+		[]string{"Honza", "Jenak", "Jenik", "Karel", "Pep", "Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitSorted(collect(&keys))
+	checkIndependentKeys(t, "VisitSorted", keys,
+		[]string{"Honza", "Jenak", "Jenik", "Karel", "Pep", "Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitSubtree(Prefix("Pep"), collect(&keys))
+	checkIndependentKeys(t, "VisitSubtree", keys, []string{"Pep", "Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitGlob(Prefix("Pep*"), collect(&keys))
+	checkIndependentKeys(t, "VisitGlob", keys, []string{"Pep", "Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitHamming(Prefix("Jenek"), 1, func(prefix Prefix, item Item, dist int) error {
+		keys = append(keys, prefix)
+		return nil
+	})
+	checkIndependentKeys(t, "VisitHamming", keys, []string{"Jenak", "Jenik"})
+
+	keys = nil
+	trie.VisitNodes(func(prefix Prefix, hasItem bool, childCount int, mask uint64) error {
+		keys = append(keys, prefix)
+		return nil
+	})
+	checkIndependentKeys(t, "VisitNodes", keys,
+		[]string{"", "Honza", "Jen", "Jenak", "Jenik", "Karel", "Pep", "Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitFuzzy(Prefix("Pn"), false, collectFuzzy(&keys))
+	checkIndependentKeys(t, "VisitFuzzy", keys, []string{"Pepan", "Pepanek", "Pepin"})
+
+	keys = nil
+	trie.VisitSubstring(Prefix("an"), false, collect(&keys))
+	checkIndependentKeys(t, "VisitSubstring", keys, []string{"Pepan", "Pepanek"})
+}
+
+func TestTrie_ItemCounts(t *testing.T) {
+	trie := NewTrie()
+	keys := make([]Prefix, 500)
+	for i := range keys {
+		keys[i] = Prefix(fmt.Sprintf("%x", mrand.Intn(4096)))
+	}
+
+	for i, key := range keys {
+		switch i % 5 {
+		case 0, 1:
+			trie.Insert(key, i)
+		case 2:
+			trie.Set(key, i)
+		case 3:
+			trie.Delete(keys[mrand.Intn(i+1)])
+		case 4:
+			if i%25 == 4 {
+				trie.DeleteSubtree(key[:1])
+			} else {
+				trie.Set(key, nil)
+			}
+		}
+	}
+	checkCountsRecursive(t, trie)
+
+	if n := trie.size(); trie.Len() != n {
+		t.Errorf("Unexpected length, expected=%d, got=%d", n, trie.Len())
+	}
+}
+
+func TestTrie_VisitNodesSized(t *testing.T) {
+	trie := populateTrie(t)
+
+	sizes := make(map[string]int)
+	err := trie.VisitNodesSized(func(prefix Prefix, hasItem bool, subtreeSize int) error {
+		sizes[string(prefix)] = subtreeSize
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"": 7, "Pep": 3, "Pepan": 2, "Pepanek": 1, "Jen": 2, "Honza": 1}
+	for prefix, size := range want {
+		if got, ok := sizes[prefix]; !ok || got != size {
+			t.Errorf("Unexpected subtree size for %q, expected=%d, got=%d", prefix, size, got)
+		}
+	}
+}
+
 func TestTrie_AddCorrectMasks(t *testing.T) {
 	trie := NewTrie()
 	data := []testData{
@@ -206,30 +531,1554 @@ func TestTrie_DeleteCorrectMasks(t *testing.T) {
 			trie.Delete(Prefix(record.key))
 		}
 
-		checkMasksRecursive(t, trie)
+		checkMasksRecursive(t, trie)
+	}
+
+}
+
+func TestTrie_ConcurrentReaders(t *testing.T) {
+	for _, trie := range []*Trie{populateTrie(t), NewTrieWithQueryCache(4)} {
+		for _, key := range []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek"} {
+			trie.Set(Prefix(key), struct{}{})
+		}
+
+		query := Prefix("ep")
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					var count int
+					trie.VisitSubstring(query, j%2 == 0, func(prefix Prefix, item Item) error {
+						count++
+						return nil
+					})
+					if count != 3 {
+						t.Errorf("Unexpected number of substring matches, expected=3, got=%d", count)
+					}
+					trie.VisitSubtree(query[:1], func(prefix Prefix, item Item) error {
+						return nil
+					})
+					trie.VisitFuzzy(Prefix("Ppn"), false, func(prefix Prefix, item Item, skipped int) error {
+						return nil
+					})
+					if !trie.Match(Prefix("Pepan")) {
+						t.Error("Pepan not matched")
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+func TestTrie_RecomputeMasks(t *testing.T) {
+	trie := populateTrie(t)
+
+	// Corrupt the masks of the root and one of the inner nodes.
+	trie.mask = 0
+	node := trie.children.next('P')
+	node.mask = makePrefixMask(Prefix("x"))
+
+	trie.RecomputeMasks()
+	checkMasksRecursive(t, trie)
+
+	if want := makePrefixMask(Prefix("PepanikHonzaJenikKarelJenak")); trie.mask != want {
+		t.Errorf("Unexpected root mask, wanted: %b, got %b\n", want, trie.mask)
+	}
+
+	var found bool
+	trie.VisitFuzzy(Prefix("Ppnk"), false, func(prefix Prefix, item Item, skipped int) error {
+		found = found || string(prefix) == "Pepanek"
+		return nil
+	})
+	if !found {
+		t.Error("Pepanek not matched after recomputing the masks")
+	}
+}
+
+func TestTrie_DeleteKeepsPrefixMask(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"Pepek", "Pepan"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+	trie.Delete(Prefix("Pepek"))
+	checkMasksRecursive(t, trie)
+
+	var count int
+	trie.VisitFuzzy(Prefix("Pn"), false, func(prefix Prefix, item Item, skipped int) error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Errorf("Unexpected number of fuzzy matches, expected=1, got=%d", count)
+	}
+}
+
+func populateTrie(t *testing.T) *Trie {
+	data := []string{
+		"Pepan",
+		"Pepin",
+		"Honza",
+		"Jenik",
+		"Karel",
+		"Jenak",
+		"Pepanek",
+	}
+
+	trie := NewTrie()
+	for _, v := range data {
+		if ok := trie.Insert(Prefix(v), struct{}{}); !ok {
+			t.Errorf("Couldn't insert item %s", v)
+		}
+	}
+
+	return trie
+}
+
+func TestTrie_Fanout(t *testing.T) {
+	trie := NewTrie()
+	if fanout := trie.RootFanout(); fanout != 0 {
+		t.Errorf("Unexpected fanout of an empty trie, expected=0, got=%d", fanout)
+	}
+
+	trie.Insert(Prefix("Pepan"), struct{}{})
+	if fanout := trie.RootFanout(); fanout != 1 {
+		t.Errorf("Unexpected root fanout, expected=1, got=%d", fanout)
+	}
+
+	trie = populateTrie(t)
+	if fanout := trie.RootFanout(); fanout != 4 {
+		t.Errorf("Unexpected root fanout, expected=4, got=%d", fanout)
+	}
+
+	cases := []struct {
+		prefix string
+		fanout int
+	}{
+		{"Pep", 2},
+		{"Pe", 1},
+		{"Pepan", 1},
+		{"Pepanek", 0},
+		{"Jen", 2},
+		{"Tomas", 0},
+	}
+	for _, c := range cases {
+		if fanout := trie.FanoutAt(Prefix(c.prefix)); fanout != c.fanout {
+			t.Errorf("Unexpected fanout at %q, expected=%d, got=%d", c.prefix, c.fanout, fanout)
+		}
+	}
+}
+
+func TestTrie_ResolvePath(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("a"), map[string]string{"color": "red", "size": "small"})
+	trie.Insert(Prefix("a/b"), map[string]string{"size": "large"})
+	trie.Insert(Prefix("a/x"), map[string]string{"color": "blue"})
+	trie.Insert(Prefix("a/b/c/d"), map[string]string{"color": "green"})
+
+	overlay := func(acc, item Item) Item {
+		config := make(map[string]string)
+		for k, v := range acc.(map[string]string) {
+			config[k] = v
+		}
+		for k, v := range item.(map[string]string) {
+			config[k] = v
+		}
+		return config
+	}
+
+	got := trie.ResolvePath(Prefix("a/b/c"), overlay, map[string]string{"shape": "round"})
+	want := map[string]string{"color": "red", "size": "large", "shape": "round"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected resolved value, expected=%v, got=%v", want, got)
+	}
+
+	// The items are folded from the shortest prefix.
+	var order []string
+	trie.ResolvePath(Prefix("a/b/c/d"), func(acc, item Item) Item {
+		order = append(order, item.(map[string]string)["color"])
+		return acc
+	}, nil)
+	if want := []string{"red", "", "green"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Unexpected fold order, expected=%v, got=%v", want, order)
+	}
+
+	if got := trie.ResolvePath(Prefix("b"), overlay, nil); got != nil {
+		t.Errorf("Unexpected resolved value, expected=<nil>, got=%v", got)
+	}
+}
+
+func TestTrie_EstimateSubtreeCount(t *testing.T) {
+	trie := populateTrie(t)
+
+	for prefix, want := range map[string]int{"": 7, "Pep": 3, "Pepa": 2, "Pepanek": 1, "Jen": 2, "Xaver": 0} {
+		if got := trie.EstimateSubtreeCount(Prefix(prefix)); got != want {
+			t.Errorf("Unexpected count for %q, expected=%d, got=%d", prefix, want, got)
+		}
+	}
+	if got := NewTrie().EstimateSubtreeCount(Prefix("")); got != 0 {
+		t.Errorf("Unexpected count for an empty trie, expected=0, got=%d", got)
+	}
+}
+
+func TestTrie_EstimateFuzzyMatches(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pepa Zdepa"), struct{}{})
+	trie.Insert(Prefix("Kapr"), struct{}{})
+
+	for _, query := range []string{"", "Pn", "ek", "an", "nP", "aa", "K", "z", "xyz", "Zd", "e e"} {
+		var actual int
+		trie.VisitFuzzy(Prefix(query), false, func(prefix Prefix, item Item, skipped int) error {
+			actual++
+			return nil
+		})
+
+		if estimate := trie.EstimateFuzzyMatches(Prefix(query)); estimate < actual {
+			t.Errorf("Estimate for %q is not an upper bound, actual=%d, estimate=%d", query, actual, estimate)
+		}
+	}
+
+	// The masks rule the missing characters out.
+	if estimate := trie.EstimateFuzzyMatches(Prefix("xyz")); estimate != 0 {
+		t.Errorf("Unexpected estimate, expected=0, got=%d", estimate)
+	}
+	if estimate := trie.EstimateFuzzyMatches(Prefix("Zd")); estimate != 1 {
+		t.Errorf("Unexpected estimate, expected=1, got=%d", estimate)
+	}
+}
+
+func TestTrie_KeyLengthHistogram(t *testing.T) {
+	trie := populateTrie(t)
+
+	want := map[int]int{5: 6, 7: 1}
+	if got := trie.KeyLengthHistogram(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected histogram, expected=%v, got=%v", want, got)
+	}
+
+	if got := NewTrie().KeyLengthHistogram(); len(got) != 0 {
+		t.Errorf("Unexpected histogram of an empty trie: %v", got)
+	}
+}
+
+func TestTrie_Alphabet(t *testing.T) {
+	trie := populateTrie(t)
+
+	if got, want := string(trie.Alphabet()), "HJKPaeiklnoprz"; got != want {
+		t.Errorf("Unexpected alphabet, expected=%q, got=%q", want, got)
+	}
+
+	// Deleted keys do not contribute.
+	trie.Delete(Prefix("Honza"))
+	if got, want := string(trie.Alphabet()), "JKPaeiklnpr"; got != want {
+		t.Errorf("Unexpected alphabet, expected=%q, got=%q", want, got)
+	}
+
+	if got := NewTrie().Alphabet(); len(got) != 0 {
+		t.Errorf("Unexpected alphabet of an empty trie: %q", got)
+	}
+
+	// Neither do the tombstones of the deleted keys.
+	for _, other := range []*Trie{NewTrie(WithLazyDelete()), NewTrie()} {
+		other.Insert(Prefix("ab"), 0)
+		other.Insert(Prefix("xyz"), 1)
+		other.Delete(Prefix("xyz"))
+		if got, want := string(other.Alphabet()), "ab"; got != want {
+			t.Errorf("Unexpected alphabet after a deletion, expected=%q, got=%q", want, got)
+		}
+		subtree, _ := other.Subtree(Prefix(""))
+		if got, want := string(subtree.Alphabet()), "ab"; got != want {
+			t.Errorf("Unexpected alphabet of the subtree, expected=%q, got=%q", want, got)
+		}
+		other.Delete(Prefix("ab"))
+		if got := other.Alphabet(); len(got) != 0 {
+			t.Errorf("Unexpected alphabet after deleting all the keys: %q", got)
+		}
+	}
+}
+
+func TestTrie_Sample(t *testing.T) {
+	trie := populateTrie(t)
+	rng := mrand.New(mrand.NewSource(42))
+
+	seen := make(map[string]int)
+	for run := 0; run < 200; run++ {
+		sample := trie.Sample(3, rng)
+		if len(sample) != 3 {
+			t.Fatalf("Unexpected sample size, expected=3, got=%d", len(sample))
+		}
+
+		distinct := make(map[string]bool)
+		for _, key := range sample {
+			if !trie.Match(key) {
+				t.Errorf("Sampled key %q not present in the trie", key)
+			}
+			distinct[string(key)] = true
+			seen[string(key)]++
+		}
+		if len(distinct) != len(sample) {
+			t.Errorf("Sample contains duplicate keys: %q", sample)
+		}
+	}
+
+	if len(seen) != trie.Len() {
+		t.Errorf("Not all keys were sampled, got %v", seen)
+	}
+
+	if sample := trie.Sample(100, rng); len(sample) != trie.Len() {
+		t.Errorf("Unexpected sample size, expected=%d, got=%d", trie.Len(), len(sample))
+	}
+	if sample := NewTrie().Sample(1, rng); len(sample) != 0 {
+		t.Errorf("Unexpected sample of an empty trie: %q", sample)
+	}
+}
+
+func TestTrie_VisitDepthLimited(t *testing.T) {
+	trie := populateTrie(t)
+
+	type node struct {
+		hasItem   bool
+		truncated bool
+	}
+
+	nodes := make(map[string]node)
+	err := trie.VisitDepthLimited(1, func(prefix Prefix, item Item, truncated bool) error {
+		nodes[string(prefix)] = node{item != nil, truncated}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]node{
+		"":      {false, false},
+		"Pep":   {false, true},
+		"Honza": {true, false},
+		"Jen":   {false, true},
+		"Karel": {true, false},
+	}
+	if !reflect.DeepEqual(nodes, want) {
+		t.Errorf("Unexpected nodes visited, expected=%v, got=%v", want, nodes)
+	}
+}
+
+func TestTrie_TrimToDepth(t *testing.T) {
+	trie := populateTrie(t)
+	deep := Prefix("Jenik" + strings.Repeat("x", 100))
+	trie.Insert(deep, struct{}{})
+
+	if removed := trie.TrimToDepth(5); removed != 1 {
+		t.Errorf("Unexpected number of keys removed, expected=1, got=%d", removed)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	if trie.Match(deep) {
+		t.Error("deep key still present after the trim")
+	}
+	if trie.Len() != 7 {
+		t.Errorf("Unexpected number of items, expected=7, got=%d", trie.Len())
+	}
+
+	// Pepanek is stored 4 nodes deep, the other keys 2 or 3 nodes deep.
+	if removed := trie.TrimToDepth(3); removed != 1 || trie.Match(Prefix("Pepanek")) {
+		t.Errorf("Unexpected number of keys removed, expected=1, got=%d", removed)
+	}
+	if removed := trie.TrimToDepth(0); removed != 6 || trie.Len() != 0 {
+		t.Errorf("Unexpected number of keys removed, expected=6, got=%d", removed)
+	}
+}
+
+func TestTrie_SortedEntries(t *testing.T) {
+	trie := populateTrie(t)
+
+	entries := trie.SortedEntries()
+	if len(entries) != trie.Len() || len(entries) != 7 {
+		t.Fatalf("Unexpected number of entries, expected=7, got=%d", len(entries))
+	}
+
+	want := []string{"Honza", "Jenak", "Jenik", "Karel", "Pepan", "Pepanek", "Pepin"}
+	for i, entry := range entries {
+		if string(entry.Key) != want[i] {
+			t.Errorf("Unexpected key at %d, expected=%q, got=%q", i, want[i], entry.Key)
+		}
+		if entry.Item != trie.Get(entry.Key) {
+			t.Errorf("Unexpected item for %q, got=%v", entry.Key, entry.Item)
+		}
+	}
+
+	if entries := NewTrie().SortedEntries(); len(entries) != 0 {
+		t.Errorf("Unexpected entries in an empty trie: %v", entries)
+	}
+}
+
+func TestTrie_SortedEntriesLimit(t *testing.T) {
+	trie := populateTrie(t)
+
+	entries, truncated := trie.SortedEntriesLimit(2)
+	if len(entries) != 2 || !truncated {
+		t.Fatalf("Unexpected result, expected 2 entries truncated, got=%v, truncated=%v", entries, truncated)
+	}
+	if string(entries[0].Key) != "Honza" || string(entries[1].Key) != "Jenak" {
+		t.Errorf("Unexpected entries, expected=[Honza Jenak], got=%v", entries)
+	}
+
+	for _, limit := range []int{7, 100} {
+		if entries, truncated := trie.SortedEntriesLimit(limit); len(entries) != 7 || truncated {
+			t.Errorf("Unexpected result of limit %d, expected 7 entries, got=%d, truncated=%v", limit, len(entries), truncated)
+		}
+	}
+
+	if entries, truncated := trie.SortedEntriesLimit(0); len(entries) != 0 || !truncated {
+		t.Errorf("Unexpected result of limit 0, got=%v, truncated=%v", entries, truncated)
+	}
+	if entries, truncated := NewTrie().SortedEntriesLimit(0); len(entries) != 0 || truncated {
+		t.Errorf("Unexpected result of an empty trie, got=%v, truncated=%v", entries, truncated)
+	}
+}
+
+func TestTrie_GetWithDefault(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Nil"), nil)
+
+	if item := trie.GetWithDefault(Prefix("Nil"), "default"); item != nil {
+		t.Errorf("Unexpected return value, expected=<nil>, got=%v", item)
+	}
+	if item := trie.GetWithDefault(Prefix("Tomas"), "default"); item != "default" {
+		t.Errorf("Unexpected return value, expected=default, got=%v", item)
+	}
+	if item := trie.GetWithDefault(Prefix("Pep"), "default"); item != "default" {
+		t.Errorf("Unexpected return value for an internal node, expected=default, got=%v", item)
+	}
+	if item := trie.GetWithDefault(Prefix("Karel"), "default"); item != struct{}{} {
+		t.Errorf("Unexpected return value, expected=%v, got=%v", struct{}{}, item)
+	}
+
+	// The nil item is stored like any other item.
+	if !trie.Match(Prefix("Nil")) {
+		t.Error("nil item not matched")
+	}
+	if trie.Len() != 8 {
+		t.Errorf("Unexpected number of items, expected=8, got=%d", trie.Len())
+	}
+	if trie.Insert(Prefix("Nil"), 1) {
+		t.Error("nil item replaced by Insert")
+	}
+
+	if !trie.Delete(Prefix("Nil")) {
+		t.Fatal("nil item not deleted")
+	}
+	if item := trie.GetWithDefault(Prefix("Nil"), "default"); item != "default" {
+		t.Errorf("Unexpected return value after delete, expected=default, got=%v", item)
+	}
+	checkCountsRecursive(t, trie)
+}
+
+func TestTrie_DeletePrefixOrSubtree(t *testing.T) {
+	build := func() *Trie {
+		trie := NewTrie()
+		trie.Insert(Prefix("ab"), 1)
+		trie.Insert(Prefix("ac"), 2)
+		trie.Insert(Prefix("b"), 3)
+		return trie
+	}
+
+	trie := build()
+	if removed := trie.DeletePrefixOrSubtree(Prefix("a"), false); removed != 0 || trie.Len() != 3 {
+		t.Errorf("Unexpected number of items removed, expected=0, got=%d", removed)
+	}
+	if removed := trie.DeletePrefixOrSubtree(Prefix("a"), true); removed != 2 || trie.Len() != 1 {
+		t.Errorf("Unexpected number of items removed, expected=2, got=%d", removed)
+	}
+	if trie.Match(Prefix("ab")) || trie.Match(Prefix("ac")) || !trie.Match(Prefix("b")) {
+		t.Error("Unexpected items deleted")
+	}
+	checkMasksRecursive(t, trie)
+
+	trie = build()
+	if removed := trie.DeletePrefixOrSubtree(Prefix("ab"), true); removed != 1 || trie.Len() != 2 {
+		t.Errorf("Unexpected number of items removed, expected=1, got=%d", removed)
+	}
+	if removed := trie.DeletePrefixOrSubtree(Prefix("x"), true); removed != 0 || trie.Len() != 2 {
+		t.Errorf("Unexpected number of items removed, expected=0, got=%d", removed)
+	}
+}
+
+func TestTrie_KeyValidator(t *testing.T) {
+	errNotPrintable := errors.New("key not printable")
+	var calls int
+	trie := NewTrie(WithKeyValidator(func(key Prefix) error {
+		calls++
+		for _, b := range key {
+			if b < ' ' || b > '~' {
+				return errNotPrintable
+			}
+		}
+		return nil
+	}))
+
+	if ok, err := trie.InsertChecked(Prefix("Pepan"), 0); !ok || err != nil {
+		t.Errorf("Unexpected result for a valid key, expected=true <nil>, got=%v %v", ok, err)
+	}
+	if ok, err := trie.InsertChecked(Prefix("Pep\x00an"), 1); ok || err != errNotPrintable {
+		t.Errorf("Unexpected result for an invalid key, expected=false %v, got=%v %v", errNotPrintable, ok, err)
+	}
+	if trie.Insert(Prefix("Pep\nan"), 2) {
+		t.Error("Invalid key inserted")
+	}
+	trie.Set(Prefix("Pep\tan"), 3)
+	if trie.InsertMerge(Prefix("\x7f"), 4, LastWins) {
+		t.Error("Invalid key merged")
+	}
+	if n := trie.Len(); n != 1 {
+		t.Errorf("Unexpected number of keys, expected=1, got=%d", n)
+	}
+	if !trie.Insert(Prefix("Honza"), 5) {
+		t.Error("Valid key not inserted")
+	}
+
+	calls = 0
+	trie.Get(Prefix("Pep\x00an"))
+	trie.Match(Prefix("Honza"))
+	trie.Delete(Prefix("Pep\nan"))
+	trie.Delete(Prefix("Honza"))
+	if calls != 0 {
+		t.Errorf("Unexpected validator calls on lookups and deletions, expected=0, got=%d", calls)
+	}
+}
+
+func TestTrie_KeyValidatorMovePrefix(t *testing.T) {
+	errReserved := errors.New("key reserved")
+	trie := NewTrie(WithKeyValidator(func(key Prefix) error {
+		if len(key) != 0 && key[0] == 'x' {
+			return errReserved
+		}
+		return nil
+	}))
+	trie.Insert(Prefix("a1"), 1)
+	trie.Insert(Prefix("a2"), 2)
+
+	if n := trie.MovePrefix(Prefix("a"), Prefix("x")); n != 0 {
+		t.Errorf("Unexpected number of items moved, expected=0, got=%d", n)
+	}
+	if n := trie.Len(); n != 2 || trie.Get(Prefix("a1")) != 1 || trie.Get(Prefix("a2")) != 2 {
+		t.Errorf("Unexpected trie after a rejected move, got=%v", trie.SortedEntries())
+	}
+
+	if n := trie.MovePrefix(Prefix("a"), Prefix("b")); n != 2 {
+		t.Errorf("Unexpected number of items moved, expected=2, got=%d", n)
+	}
+	if trie.Get(Prefix("b1")) != 1 || trie.Get(Prefix("b2")) != 2 || trie.Len() != 2 {
+		t.Errorf("Unexpected trie after the move, got=%v", trie.SortedEntries())
+	}
+
+	// UnmarshalBinary returns the error of the validator.
+	source := NewTrie()
+	source.Insert(Prefix("b"), 1)
+	source.Insert(Prefix("x"), 2)
+	data, err := source.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trie.UnmarshalBinary(data); err != errReserved {
+		t.Errorf("Unexpected error, expected=%v, got=%v", errReserved, err)
+	}
+	if trie.Match(Prefix("x")) {
+		t.Error("Rejected key decoded")
+	}
+}
+
+func TestTrie_VisitWithDepth(t *testing.T) {
+	collect := func(trie *Trie) map[string]int {
+		depths := make(map[string]int)
+		trie.VisitWithDepth(func(prefix Prefix, item Item, depth int) error {
+			depths[string(prefix)] = depth
+			return nil
+		})
+		return depths
+	}
+
+	trie := NewTrie()
+	for _, key := range []string{"a", "ab", "abc"} {
+		trie.Insert(Prefix(key), 0)
+	}
+	if got, want := collect(trie), map[string]int{"a": 1, "ab": 2, "abc": 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected depths, expected=%v, got=%v", want, got)
+	}
+
+	trie.Insert(Prefix(""), 0)
+	trie.Insert(Prefix("abcdef"), 0)
+	want := map[string]int{"": 0, "a": 1, "ab": 2, "abc": 3, "abcdef": 4}
+	if got := collect(trie); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected depths, expected=%v, got=%v", want, got)
+	}
+}
+
+func TestTrie_BestPrefixMatches(t *testing.T) {
+	trie := populateTrie(t)
+
+	cases := []struct {
+		query     string
+		commonLen int
+		matches   []string
+	}{
+		{"Pepx", 3, []string{"Pepan", "Pepanek", "Pepin"}},
+		{"Pepa", 4, []string{"Pepan", "Pepanek"}},
+		{"Pepanekx", 7, []string{"Pepanek"}},
+		{"Jx", 1, []string{"Jenak", "Jenik"}},
+		{"Honza", 5, []string{"Honza"}},
+		{"x", 0, []string{"Honza", "Jenak", "Jenik", "Karel", "Pepan", "Pepanek", "Pepin"}},
+	}
+	for _, c := range cases {
+		commonLen, matches := trie.BestPrefixMatches(Prefix(c.query))
+		var got []string
+		for _, match := range matches {
+			got = append(got, string(match))
+		}
+		sort.Strings(got)
+		if commonLen != c.commonLen || !reflect.DeepEqual(got, c.matches) {
+			t.Errorf("Unexpected matches for %q, expected=%d %q, got=%d %q",
+				c.query, c.commonLen, c.matches, commonLen, got)
+		}
+	}
+
+	if commonLen, matches := NewTrie().BestPrefixMatches(Prefix("a")); commonLen != 0 || matches != nil {
+		t.Errorf("Unexpected matches in an empty trie, got=%d %q", commonLen, matches)
+	}
+}
+
+func TestTrie_Retain(t *testing.T) {
+	trie := populateTrie(t)
+	deleted := trie.Retain(func(prefix Prefix, item Item) bool {
+		return len(prefix) != 0 && prefix[0] == 'P'
+	})
+	if deleted != 4 {
+		t.Errorf("Unexpected number of deleted keys, expected=4, got=%d", deleted)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	var got []string
+	trie.Visit(func(prefix Prefix, item Item) error {
+		got = append(got, string(prefix))
+		return nil
+	})
+	if want := []string{"Pepan", "Pepanek", "Pepin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%q, got=%q", want, got)
+	}
+	if trie.mask&makePrefixMask(Prefix("H")) != 0 {
+		t.Errorf("Unexpected mask %b still contains the deleted keys", trie.mask)
+	}
+
+	if deleted := trie.Retain(func(Prefix, Item) bool { return false }); deleted != 3 || trie.Len() != 0 {
+		t.Errorf("Unexpected result of deleting everything, deleted=%d, len=%d", deleted, trie.Len())
+	}
+}
+
+func TestTrie_Normalize(t *testing.T) {
+	defer SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+	keys := []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek", "Jenikova"}
+
+	// Every node holds a single byte.
+	SetMaxPrefixPerNode(1)
+	trie := NewTrie()
+	for i, key := range keys {
+		trie.Insert(Prefix(key), i)
+	}
+	SetMaxPrefixPerNode(defaultMaxPrefixPerNode)
+
+	direct := NewTrie()
+	for i, key := range keys {
+		direct.Insert(Prefix(key), i)
+	}
+	if trie.Stats().NodeCount <= direct.Stats().NodeCount {
+		t.Fatalf("Byte-split trie not split, %d nodes", trie.Stats().NodeCount)
+	}
+
+	trie.Normalize()
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+	if got, want := trie.dump(), direct.dump(); got != want {
+		t.Errorf("Unexpected structure, expected:\n%s\ngot:\n%s", want, got)
+	}
+	if !trie.Equal(direct, nil) {
+		t.Error("Normalized trie differs from the directly built one")
+	}
+
+	// Normalizing a normalized trie changes nothing.
+	before := trie.dump()
+	trie.Normalize()
+	if after := trie.dump(); after != before {
+		t.Errorf("Unexpected structure change, expected:\n%s\ngot:\n%s", before, after)
+	}
+}
+
+func TestTrie_ExpireUnder(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	trie := NewTrie()
+	entries := map[string]time.Duration{
+		"session/a": -time.Hour,
+		"session/b": time.Hour,
+		"session/c": -time.Second,
+		"session":   -time.Hour,
+		"user/a":    -time.Hour,
+		"user/b":    time.Hour,
+	}
+	for key, ttl := range entries {
+		trie.Insert(Prefix(key), now.Add(ttl))
+	}
+
+	expiry := func(item Item) time.Time {
+		return item.(time.Time)
+	}
+	if n := trie.ExpireUnder(Prefix("session/"), now, expiry); n != 2 {
+		t.Errorf("Unexpected number of expired keys, expected=2, got=%d", n)
+	}
+	checkMasksRecursive(t, trie)
+	checkCountsRecursive(t, trie)
+
+	var got []string
+	trie.Visit(func(prefix Prefix, item Item) error {
+		got = append(got, string(prefix))
+		return nil
+	})
+	sort.Strings(got)
+	if want := []string{"session", "session/b", "user/a", "user/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%q, got=%q", want, got)
+	}
+
+	// The keys expiring exactly now are kept.
+	if n := trie.ExpireUnder(Prefix(""), now.Add(time.Hour), expiry); n != 2 {
+		t.Errorf("Unexpected number of expired keys, expected=2, got=%d", n)
+	}
+}
+
+func TestTrie_MapItems(t *testing.T) {
+	trie := NewTrie()
+	keys := []string{"", "Pep", "Pepan", "Pepin", "Honza", "Pepanek"}
+	for i, key := range keys {
+		trie.Insert(Prefix(key), i)
+	}
+	before := trie.dump()
+
+	trie.MapItems(func(prefix Prefix, item Item) Item {
+		return item.(int) * 2
+	})
+	for i, key := range keys {
+		if item := trie.Get(Prefix(key)); item != 2*i {
+			t.Errorf("Unexpected item of %q, expected=%d, got=%v", key, 2*i, item)
+		}
+	}
+
+	// Only the items are replaced.
+	trie.MapItems(func(prefix Prefix, item Item) Item {
+		return item.(int) / 2
+	})
+	if after := trie.dump(); after != before {
+		t.Errorf("Unexpected structure change, expected:\n%s\ngot:\n%s", before, after)
+	}
+}
+
+func TestTrie_PrefixChain(t *testing.T) {
+	trie := NewTrie()
+	for i, key := range []string{"a", "ab", "abc", "abd", "b"} {
+		trie.Insert(Prefix(key), i)
+	}
+
+	want := []Entry{{Prefix("abc"), 2}, {Prefix("ab"), 1}, {Prefix("a"), 0}}
+	if got := trie.PrefixChain(Prefix("abcd")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected chain, expected=%v, got=%v", want, got)
+	}
+	if got := trie.PrefixChain(Prefix("abc")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected chain, expected=%v, got=%v", want, got)
+	}
+	if got := trie.PrefixChain(Prefix("c")); got != nil {
+		t.Errorf("Unexpected chain, expected=nil, got=%v", got)
+	}
+}
+
+func TestTrie_GetMany(t *testing.T) {
+	check := func(trie *Trie, keys []Prefix) {
+		t.Helper()
+		items := trie.GetMany(keys)
+		if len(items) != len(keys) {
+			t.Fatalf("Unexpected number of items, expected=%d, got=%d", len(keys), len(items))
+		}
+		for i, key := range keys {
+			if want := trie.Get(key); items[i] != want {
+				t.Errorf("Unexpected item of %q, expected=%v, got=%v", key, want, items[i])
+			}
+		}
+	}
+
+	trie := populateTrie(t)
+	trie.Insert(Prefix(""), "root")
+	keys := []Prefix{Prefix("Pepan"), Prefix("Pep"), Prefix("Pepanek"), Prefix(""),
+		Prefix("Pepanekx"), Prefix("Pepin"), Prefix("Honza"), Prefix("Hon"), Prefix("Jenak"),
+		Prefix("Jenik"), Prefix("Karel"), Prefix("Pepan"), Prefix("X")}
+	check(trie, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	check(trie, keys)
+
+	rng := mrand.New(mrand.NewSource(11))
+	trie = NewTrie()
+	keys = nil
+	for i := 0; i < 2000; i++ {
+		key := make(Prefix, rng.Intn(10))
+		for j := range key {
+			key[j] = "abc"[rng.Intn(3)]
+		}
+		if rng.Intn(2) == 0 {
+			trie.Insert(key, i)
+		}
+		keys = append(keys, key)
+	}
+	check(trie, keys)
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	check(trie, keys)
+
+	// The root prefix is not empty.
+	trie = NewTrie()
+	trie.Insert(Prefix("abc"), 1)
+	trie.Insert(Prefix("abd"), 2)
+	check(trie, []Prefix{Prefix("abc"), Prefix("a"), Prefix("abd"), Prefix("b"), Prefix("abd")})
+
+	trie = NewCaseInsensitiveTrie()
+	trie.Insert(Prefix("Pepa"), 1)
+	if items := trie.GetMany([]Prefix{Prefix("PEPA"), Prefix("pepa")}); items[0] != 1 || items[1] != 1 {
+		t.Errorf("Unexpected items, expected=[1 1], got=%v", items)
+	}
+
+	if items := NewTrie().GetMany([]Prefix{Prefix("a")}); len(items) != 1 || items[0] != nil {
+		t.Errorf("Unexpected items of an empty trie, got=%v", items)
+	}
+}
+
+func TestTrie_VisitContainsAll(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Anna"), 0)
+	trie.Insert(Prefix("a+b"), 0)
+
+	collect := func(chars string) []string {
+		var keys []string
+		if err := trie.VisitContainsAll(Prefix(chars), func(prefix Prefix, item Item) error {
+			keys = append(keys, string(prefix))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	cases := []struct {
+		chars string
+		want  []string
+	}{
+		{"an", []string{"Anna", "Honza", "Jenak", "Pepan", "Pepanek"}},
+		{"na", []string{"Anna", "Honza", "Jenak", "Pepan", "Pepanek"}},
+		{"nn", []string{"Anna"}},
+		{"eek", []string{"Pepanek"}},
+		{"+", []string{"a+b"}},
+		{"x", nil},
+		{"z", []string{"Honza"}},
+	}
+	for _, c := range cases {
+		if got := collect(c.chars); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected keys of %q, expected=%v, got=%v", c.chars, c.want, got)
+		}
+	}
+
+	if got := collect(""); len(got) != trie.Len() {
+		t.Errorf("Unexpected number of keys matching nothing, expected=%d, got=%d", trie.Len(), len(got))
+	}
+}
+
+func TestTrie_MemoryUsage(t *testing.T) {
+	trie := NewTrie(WithLazyDelete())
+	empty := trie.MemoryUsage()
+	if empty <= 0 {
+		t.Fatalf("Unexpected memory usage of an empty trie, got=%d", empty)
+	}
+
+	keys := []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek", "Pep", "Karolina"}
+	last := empty
+	for _, key := range keys {
+		trie.Insert(Prefix(key), 0)
+		usage := trie.MemoryUsage()
+		if usage < last {
+			t.Errorf("Unexpected memory usage after inserting %s, expected at least %d, got=%d", key, last, usage)
+		}
+		last = usage
+	}
+	if last <= empty {
+		t.Errorf("Unexpected memory usage, expected more than %d, got=%d", empty, last)
+	}
+
+	// The tombstones are still there until the trie is compacted.
+	for _, key := range keys[:5] {
+		trie.Delete(Prefix(key))
+	}
+	if usage := trie.MemoryUsage(); usage != last {
+		t.Errorf("Unexpected memory usage of the tombstones, expected=%d, got=%d", last, usage)
+	}
+	trie.Compact()
+	if usage := trie.MemoryUsage(); usage >= last {
+		t.Errorf("Unexpected memory usage after Compact, expected less than %d, got=%d", last, usage)
+	}
+}
+
+func TestTrie_FuzzyMinMatched(t *testing.T) {
+	trie := populateTrie(t)
+	for _, key := range []string{"Pixy", "Pyz", "Pyx", "xylophone", "Zyx"} {
+		trie.Insert(Prefix(key), 0)
+	}
+
+	collect := func(query string, minMatched int, caseInsensitive bool) map[string]int {
+		resultMap := make(map[string]int)
+		err := trie.VisitFuzzyMinMatched(Prefix(query), minMatched, caseInsensitive, func(prefix Prefix, item Item, matched int) error {
+			resultMap[string(prefix)] = matched
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultMap
+	}
+
+	want := map[string]int{"Pixy": 3, "Pyz": 3, "Pyx": 2, "xylophone": 2}
+	if got := collect("Pxyz", 2, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+
+	want = map[string]int{"Pixy": 3, "Pyz": 3}
+	if got := collect("pxyz", 3, true); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected case-insensitive result set, expected=%v, got=%v", want, got)
+	}
+
+	// Requiring all the characters works like VisitFuzzy.
+	want = make(map[string]int)
+	trie.VisitFuzzy(Prefix("Pn"), false, func(prefix Prefix, item Item, skipped int) error {
+		want[string(prefix)] = 2
+		return nil
+	})
+	if got := collect("Pn", 2, false); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+
+	if got := collect("Pxyz", 5, false); len(got) != 0 {
+		t.Errorf("Unexpected result set, expected none, got=%v", got)
+	}
+}
+
+func TestTrie_VisitRelated(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"a", "a/b", "a/b/c", "a/bc", "a/x", "b"} {
+		trie.Insert(Prefix(key), key)
+	}
+
+	type related struct {
+		key      string
+		relation Relation
+	}
+	collect := func(query string, skip string) []related {
+		var got []related
+		err := trie.VisitRelated(Prefix(query), func(prefix Prefix, item Item, relation Relation) error {
+			if item != string(prefix) {
+				t.Errorf("Unexpected item of %s, expected=%s, got=%v", prefix, prefix, item)
+			}
+			got = append(got, related{string(prefix), relation})
+			if string(prefix) == skip {
+				return SkipSubtree
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	want := []related{{"a", Ancestor}, {"a/b", Exact}, {"a/b/c", Descendant}, {"a/bc", Descendant}}
+	if got := collect("a/b", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected related keys, expected=%v, got=%v", want, got)
+	}
+
+	// The query ends in the middle of a node and is not stored itself.
+	want = []related{{"a", Ancestor}, {"a/b", Descendant}, {"a/b/c", Descendant}, {"a/bc", Descendant}, {"a/x", Descendant}}
+	if got := collect("a/", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected related keys, expected=%v, got=%v", want, got)
+	}
+
+	want = []related{{"a", Ancestor}, {"a/b", Ancestor}}
+	if got := collect("a/b/d", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected related keys, expected=%v, got=%v", want, got)
+	}
+
+	want = []related{{"a", Ancestor}}
+	if got := collect("a/b", "a"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected related keys after skipping, expected=%v, got=%v", want, got)
+	}
+	want = []related{{"a", Ancestor}, {"a/b", Exact}}
+	if got := collect("a/b", "a/b"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected related keys after skipping, expected=%v, got=%v", want, got)
+	}
+
+	if got := collect("c", ""); len(got) != 0 {
+		t.Errorf("Unexpected related keys, expected none, got=%v", got)
+	}
+}
+
+func TestTrie_RankSelect(t *testing.T) {
+	trie := populateTrie(t)
+	keys := []string{"Honza", "Jenak", "Jenik", "Karel", "Pepan", "Pepanek", "Pepin"}
+
+	for i, want := range keys {
+		key, _, ok := trie.Select(i)
+		if !ok || string(key) != want {
+			t.Errorf("Unexpected key at %d, expected=%q, got=%q (ok %v)", i, want, key, ok)
+		}
+		if rank := trie.Rank(key); rank != i {
+			t.Errorf("Unexpected rank of %q, expected=%d, got=%d", key, i, rank)
+		}
+	}
+
+	for _, i := range []int{-1, len(keys)} {
+		if _, _, ok := trie.Select(i); ok {
+			t.Errorf("Unexpected key at %d", i)
+		}
+	}
+
+	// Keys that are not stored are ranked by the stored keys less than them.
+	for _, key := range []string{"", "A", "Hon", "Honzas", "Jen", "Jenb", "Pep", "Pepana", "Pepaneks", "Pepio", "Z"} {
+		want := sort.SearchStrings(keys, key)
+		if rank := trie.Rank(Prefix(key)); rank != want {
+			t.Errorf("Unexpected rank of %q, expected=%d, got=%d", key, want, rank)
+		}
+	}
+	if rank := NewTrie().Rank(Prefix("a")); rank != 0 {
+		t.Errorf("Unexpected rank in an empty trie, expected=0, got=%d", rank)
+	}
+}
+
+func TestTrie_PopMin(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix(""), 0)
+	trie.Insert(Prefix("Pep"), 1)
+
+	var got []string
+	for {
+		key, _, ok := trie.PopMin()
+		if !ok {
+			break
+		}
+		got = append(got, string(key))
+		checkMasksRecursive(t, trie)
+		checkCountsRecursive(t, trie)
+	}
+
+	want := []string{"", "Honza", "Jenak", "Jenik", "Karel", "Pep", "Pepan", "Pepanek", "Pepin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys popped, expected=%q, got=%q", want, got)
+	}
+	if trie.Len() != 0 {
+		t.Errorf("Unexpected number of items, expected=0, got=%d", trie.Len())
+	}
+
+	trie.Insert(Prefix("Karel"), 2)
+	if key, item, ok := trie.PopMin(); !ok || string(key) != "Karel" || item != 2 {
+		t.Errorf("Unexpected entry popped, expected=Karel 2 true, got=%s %v %v", key, item, ok)
+	}
+
+	// Popping leaves the same structure as deleting, tombstones included.
+	for _, options := range [][]Option{nil, {WithLazyDelete()}} {
+		popped, deleted := NewTrie(options...), NewTrie(options...)
+		for _, key := range []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek"} {
+			popped.Insert(Prefix(key), 0)
+			deleted.Insert(Prefix(key), 0)
+		}
+		for i := 0; i < 4; i++ {
+			key, _, _ := popped.PopMin()
+			deleted.Delete(key)
+			if got, want := popped.dump(), deleted.dump(); got != want {
+				t.Errorf("Unexpected structure after popping %s, expected=\n%s\ngot=\n%s", key, want, got)
+			}
+		}
+	}
+}
+
+func TestTrie_DeleteSubtreeCollect(t *testing.T) {
+	trie := populateTrie(t)
+
+	entries := trie.DeleteSubtreeCollect(Prefix("Pep"))
+	want := []Entry{
+		{Prefix("Pepan"), struct{}{}},
+		{Prefix("Pepanek"), struct{}{}},
+		{Prefix("Pepin"), struct{}{}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Unexpected entries, expected=%v, got=%v", want, entries)
+	}
+
+	for _, entry := range want {
+		if trie.Match(entry.Key) {
+			t.Errorf("item %s still present after the delete", entry.Key)
+		}
+	}
+	if trie.Len() != 4 {
+		t.Errorf("Unexpected number of items, expected=4, got=%d", trie.Len())
+	}
+	checkMasksRecursive(t, trie)
+
+	if entries := trie.DeleteSubtreeCollect(Prefix("Pep")); len(entries) != 0 {
+		t.Errorf("Unexpected entries deleted twice: %v", entries)
+	}
+}
+
+func TestTrie_GetEntry(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Set(Prefix("Pepan"), 1)
+
+	key, item, ok := trie.GetEntry(Prefix("Pepan"))
+	if !ok || !bytes.Equal(key, Prefix("Pepan")) || item != 1 {
+		t.Errorf("Unexpected entry, expected=Pepan 1 true, got=%s %v %v", key, item, ok)
+	}
+	if _, _, ok := trie.GetEntry(Prefix("Pep")); ok {
+		t.Error("entry returned for an internal node")
+	}
+	if _, _, ok := trie.GetEntry(Prefix("Tomas")); ok {
+		t.Error("entry returned for an absent key")
+	}
+
+	// The key is a copy.
+	key[0] = 'X'
+	if !trie.Match(Prefix("Pepan")) {
+		t.Error("modifying the returned key modified the trie")
+	}
+
+	folded := NewCaseInsensitiveTrie()
+	folded.Insert(Prefix("Pepan"), 1)
+	key, _, ok = folded.GetEntry(Prefix("PEPAN"))
+	if !ok || !bytes.Equal(key, Prefix("pepan")) {
+		t.Errorf("Unexpected stored key, expected=pepan, got=%s", key)
+	}
+}
+
+func TestTrie_NodeKind(t *testing.T) {
+	trie := NewTrie()
+	if kind := trie.NodeKind(Prefix("")); kind != NodeAbsent {
+		t.Errorf("Unexpected node kind in an empty trie, expected=%v, got=%v", NodeAbsent, kind)
+	}
+
+	trie.Insert(Prefix("ab"), 1)
+	trie.Insert(Prefix("ac"), 2)
+	trie.Insert(Prefix("axyz"), 3)
+
+	cases := []struct {
+		prefix string
+		kind   NodeKind
+	}{
+		{"", NodeInternal},
+		{"a", NodeInternal},
+		{"ab", NodeItem},
+		{"ac", NodeItem},
+		{"ad", NodeAbsent},
+		{"abc", NodeAbsent},
+		{"axy", NodeInternal},
+		{"axyz", NodeItem},
+		{"axz", NodeAbsent},
+	}
+	for _, c := range cases {
+		if kind := trie.NodeKind(Prefix(c.prefix)); kind != c.kind {
+			t.Errorf("Unexpected node kind for %q, expected=%v, got=%v", c.prefix, c.kind, kind)
+		}
+	}
+}
+
+func TestTrie_Equal(t *testing.T) {
+	trie := populateTrie(t)
+	clone := trie.Clone()
+
+	if !trie.Equal(clone, nil) || !clone.Equal(trie, nil) {
+		t.Error("trie not equal to its clone")
+	}
+
+	clone.Insert(Prefix("Tomas"), struct{}{})
+	if trie.Equal(clone, nil) || clone.Equal(trie, nil) {
+		t.Error("tries with different keys reported equal")
+	}
+
+	clone.Delete(Prefix("Tomas"))
+	clone.Set(Prefix("Karel"), 1)
+	if trie.Equal(clone, nil) {
+		t.Error("tries with different items reported equal")
+	}
+
+	sameType := func(a, b Item) bool {
+		return reflect.TypeOf(a) == reflect.TypeOf(b)
+	}
+	clone.Set(Prefix("Karel"), struct{}{})
+	if !trie.Equal(clone, sameType) {
+		t.Error("tries with equal items reported different")
+	}
+
+	// The layout does not matter.
+	other := NewTrie()
+	for _, key := range []string{"Pepanek", "Karel", "Jenak", "Pepin", "Jenik", "Honza", "Pepan"} {
+		other.Insert(Prefix(key), struct{}{})
+	}
+	if !trie.Equal(other, nil) {
+		t.Error("tries with the same contents reported different")
+	}
+}
+
+func TestTrie_Rebuild(t *testing.T) {
+	trie := NewTrie()
+
+	rng := mrand.New(mrand.NewSource(7))
+	for i := 0; i < 5000; i++ {
+		key := make(Prefix, 1+rng.Intn(12))
+		for j := range key {
+			key[j] = "abcd"[rng.Intn(4)]
+		}
+		if rng.Intn(3) == 0 {
+			trie.Delete(key)
+		} else {
+			trie.Insert(key, i)
+		}
+	}
+
+	rebuilt := trie.Rebuild()
+	checkMasksRecursive(t, rebuilt)
+	checkCountsRecursive(t, rebuilt)
+
+	if !rebuilt.Equal(trie, nil) {
+		t.Error("rebuilt trie differs from the original")
+	}
+	if before, after := trie.Stats().NodeCount, rebuilt.Stats().NodeCount; after > before {
+		t.Errorf("Unexpected node count, expected at most %d, got=%d", before, after)
+	}
+
+	// The tries do not share any state.
+	rebuilt.DeleteSubtree(Prefix("a"))
+	if trie.Equal(rebuilt, nil) {
+		t.Error("modifying the rebuilt trie modified the original")
+	}
+}
+
+func TestTrie_Subtree(t *testing.T) {
+	trie := populateTrie(t)
+
+	subtree, ok := trie.Subtree(Prefix("Pep"))
+	if !ok {
+		t.Fatal("Unexpected return value, expected=true, got=false")
+	}
+	checkMasksRecursive(t, subtree)
+	checkCountsRecursive(t, subtree)
+
+	var keys []string
+	subtree.VisitSorted(func(prefix Prefix, item Item) error {
+		keys = append(keys, string(prefix))
+		return nil
+	})
+	if want := []string{"an", "anek", "in"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", want, keys)
+	}
+	if item := subtree.Get(Prefix("anek")); item != trie.Get(Prefix("Pepanek")) {
+		t.Errorf("Unexpected item, expected=%v, got=%v", trie.Get(Prefix("Pepanek")), item)
+	}
+
+	// The tries do not share any state.
+	subtree.Delete(Prefix("an"))
+	subtree.Insert(Prefix("ik"), 0)
+	if !trie.Match(Prefix("Pepan")) || trie.Match(Prefix("Pepik")) {
+		t.Error("modifying the subtree modified the original")
+	}
+
+	// The prefix can end in the middle of a node.
+	subtree, ok = trie.Subtree(Prefix("Pe"))
+	if !ok || !subtree.Match(Prefix("pin")) || subtree.Len() != 3 {
+		t.Errorf("Unexpected subtree for a partial prefix, got=%v", subtree)
+	}
+
+	if _, ok := trie.Subtree(Prefix("Pepo")); ok {
+		t.Error("Unexpected return value, expected=false, got=true")
+	}
+	if _, ok := NewTrie().Subtree(Prefix("")); ok {
+		t.Error("Unexpected return value for an empty trie, expected=false, got=true")
+	}
+}
+
+func TestTrie_SubtreeOptions(t *testing.T) {
+	trie := NewTrieWithBloom(100, 0.01)
+	for _, key := range []string{"dir/a", "dir/b", "other/c"} {
+		trie.Insert(Prefix(key), key)
+	}
+
+	subtree, ok := trie.Subtree(Prefix("dir/"))
+	if !ok {
+		t.Fatal("Unexpected return value, expected=true, got=false")
+	}
+	for _, key := range []string{"a", "b"} {
+		if item := subtree.Get(Prefix(key)); item != "dir/"+key {
+			t.Errorf("Unexpected item for %s, expected=%v, got=%v", key, "dir/"+key, item)
+		}
+	}
+
+	bounded := NewBoundedTrie(3, nil)
+	for _, key := range []string{"dir/a", "other/c", "dir/b"} {
+		bounded.Insert(Prefix(key), key)
+	}
+	subtree, _ = bounded.Subtree(Prefix("dir/"))
+	subtree.Insert(Prefix("c"), nil)
+	subtree.Insert(Prefix("d"), nil)
+	if subtree.Match(Prefix("a")) || !subtree.Match(Prefix("b")) {
+		t.Error("the eviction order of the subtree does not follow the insertions")
+	}
+}
+
+func TestTrie_ReplaceWith(t *testing.T) {
+	trie := populateTrie(t)
+
+	other := NewTrie()
+	other.Insert(Prefix("Tomas"), 1)
+	other.Insert(Prefix("Tonda"), 2)
+
+	trie.ReplaceWith(other)
+	checkMasksRecursive(t, trie)
+
+	for _, key := range []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek"} {
+		if trie.Match(Prefix(key)) {
+			t.Errorf("item %s still present after the replacement", key)
+		}
+		if !other.Match(Prefix(key)) {
+			t.Errorf("item %s not swapped into the other trie", key)
+		}
+	}
+	if item := trie.Get(Prefix("Tonda")); item != 2 {
+		t.Errorf("Unexpected return value, expected=%v, got=%v", 2, item)
+	}
+	if trie.Len() != 2 {
+		t.Errorf("Unexpected number of items, expected=2, got=%d", trie.Len())
+	}
+	if other.Len() != 7 {
+		t.Errorf("Unexpected number of items, expected=7, got=%d", other.Len())
+	}
+}
+
+func TestTrie_MovePrefix(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Zepin"), "old")
+
+	if moved := trie.MovePrefix(Prefix("Pep"), Prefix("Zep")); moved != 3 {
+		t.Errorf("Unexpected number of items moved, expected=3, got=%d", moved)
+	}
+	checkMasksRecursive(t, trie)
+
+	for _, key := range []string{"Pepan", "Pepin", "Pepanek"} {
+		if trie.Match(Prefix(key)) {
+			t.Errorf("item %s still present after the move", key)
+		}
+		moved := "Z" + key[1:]
+		if !trie.Match(Prefix(moved)) {
+			t.Errorf("item %s not present after the move", moved)
+		}
+	}
+	if item := trie.Get(Prefix("Zepin")); item == "old" {
+		t.Error("conflicting item Zepin not replaced")
+	}
+	if trie.Len() != 7 {
+		t.Errorf("Unexpected number of items, expected=7, got=%d", trie.Len())
+	}
+
+	var count int
+	trie.VisitFuzzy(Prefix("Zn"), false, func(prefix Prefix, item Item, skipped int) error {
+		count++
+		return nil
+	})
+	if count != 3 {
+		t.Errorf("Unexpected number of fuzzy matches, expected=3, got=%d", count)
+	}
+
+	if moved := trie.MovePrefix(Prefix("Xyz"), Prefix("Abc")); moved != 0 {
+		t.Errorf("Unexpected number of items moved, expected=0, got=%d", moved)
+	}
+}
+
+func TestTrie_VisitGlob(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pe"), struct{}{})
+
+	testQueries := []struct {
+		pattern     string
+		wantResults []string
+	}{
+		{"Pe*n", []string{"Pepan", "Pepin"}},
+		{"Pep?n", []string{"Pepan", "Pepin"}},
+		{"Pe*", []string{"Pe", "Pepan", "Pepanek", "Pepin"}},
+		{"Pe**", []string{"Pe", "Pepan", "Pepanek", "Pepin"}},
+		{"*a*", []string{"Honza", "Jenak", "Karel", "Pepan", "Pepanek"}},
+		{"J?n?k", []string{"Jenak", "Jenik"}},
+		{"Karel", []string{"Karel"}},
+		{"Kar", nil},
+		{"Pe?", nil},
+	}
+
+	for _, data := range testQueries {
+		var got []string
+		err := trie.VisitGlob(Prefix(data.pattern), func(prefix Prefix, item Item) error {
+			got = append(got, string(prefix))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, data.wantResults) {
+			t.Errorf("Unexpected result set for %q, expected=%v, got=%v", data.pattern, data.wantResults, got)
+		}
+	}
+}
+
+func TestTrie_VisitRegexp(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("xPep"), struct{}{})
+
+	testQueries := []struct {
+		pattern     string
+		wantResults []string
+		wantPrefix  string
+	}{
+		{"^Pep", []string{"Pepan", "Pepanek", "Pepin"}, "Pep"},
+		{`\APep`, []string{"Pepan", "Pepanek", "Pepin"}, "Pep"},
+		{"an$", []string{"Pepan"}, ""},
+		{"Pep", []string{"Pepan", "Pepanek", "Pepin", "xPep"}, ""},
+		{"^Je.a?k$", []string{"Jenak"}, "Je"},
+		{"^(Karel|Honza)$", []string{"Honza", "Karel"}, ""},
+		{"(?m)^Pep", []string{"Pepan", "Pepanek", "Pepin"}, ""},
+		{"^Xaver", nil, "Xaver"},
+	}
+
+	for _, data := range testQueries {
+		re := regexp.MustCompile(data.pattern)
+		if prefix := regexpLiteralPrefix(re); string(prefix) != data.wantPrefix {
+			t.Errorf("Unexpected literal prefix of %q, expected=%q, got=%q", data.pattern, data.wantPrefix, prefix)
+		}
+
+		var got []string
+		err := trie.VisitRegexp(re, func(prefix Prefix, item Item) error {
+			got = append(got, string(prefix))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, data.wantResults) {
+			t.Errorf("Unexpected result set for %q, expected=%v, got=%v", data.pattern, data.wantResults, got)
+		}
+	}
+}
+
+func TestTrie_VisitHamming(t *testing.T) {
+	trie := NewTrie()
+	for _, code := range []string{"AB123", "AB124", "AC123", "XB123", "AB12", "AB1234", "ZZ999"} {
+		trie.Insert(Prefix(code), code)
+	}
+
+	testQueries := []struct {
+		query       string
+		maxDist     int
+		wantResults []string
+	}{
+		{"AB123", 0, []string{"AB123:0"}},
+		{"AB123", 1, []string{"AB123:0", "AB124:1", "AC123:1", "XB123:1"}},
+		{"AB129", 1, []string{"AB123:1", "AB124:1"}},
+		{"XC124", 1, nil},
+		{"XC124", 2, []string{"AB124:2", "AC123:2", "XB123:2"}},
+		{"AB12", 1, []string{"AB12:0"}},
+	}
+
+	for _, data := range testQueries {
+		var got []string
+		err := trie.VisitHamming(Prefix(data.query), data.maxDist, func(prefix Prefix, item Item, dist int) error {
+			got = append(got, fmt.Sprintf("%s:%d", prefix, dist))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(got, data.wantResults) {
+			t.Errorf("Unexpected result set for %q within %d, expected=%v, got=%v",
+				data.query, data.maxDist, data.wantResults, got)
+		}
+	}
+}
+
+func TestTrie_ShortestUniquePrefix(t *testing.T) {
+	trie := populateTrie(t)
+
+	testQueries := []struct {
+		key    string
+		want   string
+		wantOk bool
+	}{
+		{"Pepan", "Pepan", true},
+		{"Pepanek", "Pepane", true},
+		{"Pepin", "Pepi", true},
+		{"Jenik", "Jeni", true},
+		{"Honza", "H", true},
+		{"Karel", "K", true},
+		{"Pep", "", false},
+		{"Xaver", "", false},
+	}
+
+	for _, data := range testQueries {
+		got, ok := trie.ShortestUniquePrefix(Prefix(data.key))
+		if ok != data.wantOk || string(got) != data.want {
+			t.Errorf("Unexpected shortest unique prefix of %q, expected=%q %v, got=%q %v",
+				data.key, data.want, data.wantOk, got, ok)
+		}
 	}
 
+	trie = NewTrie()
+	trie.Insert(Prefix("Pepan"), 0)
+	if got, _ := trie.ShortestUniquePrefix(Prefix("Pepan")); string(got) != "" {
+		t.Errorf("Unexpected shortest unique prefix, expected=%q, got=%q", "", got)
+	}
+	trie.Insert(Prefix("Pepin"), 1)
+	if got, _ := trie.ShortestUniquePrefix(Prefix("Pepan")); string(got) != "Pepa" {
+		t.Errorf("Unexpected shortest unique prefix, expected=%q, got=%q", "Pepa", got)
+	}
 }
 
-func populateTrie(t *testing.T) *Trie {
-	data := []string{
-		"Pepan",
-		"Pepin",
-		"Honza",
-		"Jenik",
-		"Karel",
-		"Jenak",
-		"Pepanek",
+func TestTrie_CommonAncestor(t *testing.T) {
+	trie := populateTrie(t)
+
+	testQueries := []struct {
+		a, b   string
+		want   string
+		wantOk bool
+	}{
+		{"Pepan", "Pepin", "Pep", true},
+		{"Pepan", "Pepanek", "Pepan", true},
+		{"Jenik", "Jenak", "Jen", true},
+		{"Pepan", "Honza", "", true},
+		{"Karel", "Karel", "Karel", true},
+		{"Pepan", "Pep", "", false},
+		{"Xaver", "Pepan", "", false},
 	}
 
-	trie := NewTrie()
-	for _, v := range data {
-		if ok := trie.Insert(Prefix(v), struct{}{}); !ok {
-			t.Errorf("Couldn't insert item %s", v)
+	for _, data := range testQueries {
+		got, ok := trie.CommonAncestor(Prefix(data.a), Prefix(data.b))
+		if ok != data.wantOk || string(got) != data.want {
+			t.Errorf("Unexpected common ancestor of %q and %q, expected=%q %v, got=%q %v",
+				data.a, data.b, data.want, data.wantOk, got, ok)
 		}
 	}
-
-	return trie
 }
 
 func TestTrie_FuzzyCollect(t *testing.T) {
@@ -321,6 +2170,465 @@ func TestTrie_FuzzyCollect(t *testing.T) {
 	}
 }
 
+func TestTrie_FuzzyRetainedPrefixes(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix(""), struct{}{})
+
+	for _, query := range []string{"", "e", "Pn", "jk"} {
+		var retained, copies []Prefix
+		trie.VisitFuzzy(Prefix(query), true, func(prefix Prefix, item Item, skipped int) error {
+			retained = append(retained, prefix)
+			copies = append(copies, append(Prefix(nil), prefix...))
+			return nil
+		})
+
+		if len(retained) == 0 {
+			t.Errorf("Nothing matched for query %q", query)
+		}
+		for i := range retained {
+			if !bytes.Equal(retained[i], copies[i]) {
+				t.Errorf("Retained key %q mutated into %q by later visits", copies[i], retained[i])
+			}
+		}
+
+		// Scribbling over the visited keys must not affect the trie either.
+		trie.VisitFuzzy(Prefix(query), true, func(prefix Prefix, item Item, skipped int) error {
+			if !trie.Match(prefix) {
+				t.Errorf("Visited key %q not present in the trie", prefix)
+			}
+			for i := range prefix {
+				prefix[i] = '#'
+			}
+			return nil
+		})
+	}
+}
+
+func TestTrie_FuzzyAnchorStart(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Honza Pepan"), struct{}{})
+
+	resultMap := make(map[string]int)
+	opts := FuzzyOptions{CaseInsensitive: true, AnchorStart: true}
+	err := trie.VisitFuzzyWithOptions(Prefix("pn"), opts, func(prefix Prefix, item Item, skipped int) error {
+		resultMap[string(prefix)] = skipped
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("got result set %v\n", resultMap)
+
+	want := map[string]int{"Pepan": 3, "Pepin": 3, "Pepanek": 3}
+	if !reflect.DeepEqual(resultMap, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, resultMap)
+	}
+
+	// Without anchoring, the keys not starting with p match as well.
+	opts.AnchorStart = false
+	err = trie.VisitFuzzyWithOptions(Prefix("pn"), opts, func(prefix Prefix, item Item, skipped int) error {
+		resultMap[string(prefix)] = skipped
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := resultMap["Honza Pepan"]; !ok {
+		t.Error("item Honza Pepan not found in result set")
+	}
+}
+
+func TestTrie_FuzzySkipQueryPrefix(t *testing.T) {
+	trie := populateTrie(t)
+
+	collect := func(opts FuzzyOptions) map[string]int {
+		resultMap := make(map[string]int)
+		err := trie.VisitFuzzyWithOptions(Prefix("XPepan"), opts, func(prefix Prefix, item Item, skipped int) error {
+			if _, ok := resultMap[string(prefix)]; ok {
+				t.Errorf("item %s visited more than once", prefix)
+			}
+			resultMap[string(prefix)] = skipped
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultMap
+	}
+
+	if got := collect(FuzzyOptions{}); len(got) != 0 {
+		t.Errorf("Unexpected result set without dropping, got=%v", got)
+	}
+
+	want := map[string]int{"Pepan": 1, "Pepanek": 1}
+	if got := collect(FuzzyOptions{SkipQueryPrefix: 1}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+	if got := collect(FuzzyOptions{SkipQueryPrefix: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+}
+
+func TestTrie_DeterministicOrder(t *testing.T) {
+	data := []string{"Pepan", "Pepin", "Honza", "Jenik", "Karel", "Jenak", "Pepanek", "Pepa", "Jan"}
+
+	forward := NewTrie()
+	for _, key := range data {
+		forward.Insert(Prefix(key), struct{}{})
+	}
+	backward := NewTrie()
+	for i := len(data) - 1; i >= 0; i-- {
+		backward.Insert(Prefix(data[i]), struct{}{})
+	}
+
+	type query struct {
+		name string
+		run  func(trie *Trie, visitor VisitorFunc) error
+	}
+	queries := []query{
+		{"Visit", func(trie *Trie, visitor VisitorFunc) error {
+			return trie.Visit(visitor)
+		}},
+		{"VisitFuzzy", func(trie *Trie, visitor VisitorFunc) error {
+			return trie.VisitFuzzy(Prefix("pn"), true, func(prefix Prefix, item Item, skipped int) error {
+				return visitor(prefix, item)
+			})
+		}},
+		{"VisitSubstring", func(trie *Trie, visitor VisitorFunc) error {
+			return trie.VisitSubstring(Prefix("a"), false, visitor)
+		}},
+	}
+
+	for _, q := range queries {
+		var results [2][]string
+		for i, trie := range []*Trie{forward, backward} {
+			err := q.run(trie, func(prefix Prefix, item Item) error {
+				results[i] = append(results[i], string(prefix))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(results[0]) == 0 {
+			t.Errorf("%s: nothing visited", q.name)
+		}
+		if !reflect.DeepEqual(results[0], results[1]) {
+			t.Errorf("%s: order depends on insertion order, %v != %v", q.name, results[0], results[1])
+		}
+		if !sort.StringsAreSorted(results[0]) {
+			t.Errorf("%s: keys not visited in ascending order: %v", q.name, results[0])
+		}
+	}
+}
+
+func TestTrie_FuzzyMaxGap(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pokemon"), struct{}{})
+	trie.Insert(Prefix("Paaaaaa Pan"), struct{}{})
+
+	collect := func(opts FuzzyOptions) map[string]int {
+		resultMap := make(map[string]int)
+		err := trie.VisitFuzzyWithOptions(Prefix("Pn"), opts, func(prefix Prefix, item Item, skipped int) error {
+			resultMap[string(prefix)] = skipped
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultMap
+	}
+
+	want := map[string]int{"Pepan": 3, "Pepin": 3, "Pepanek": 3, "Paaaaaa Pan": 1}
+	if got := collect(FuzzyOptions{MaxGap: 3}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+
+	want = map[string]int{"Paaaaaa Pan": 1}
+	if got := collect(FuzzyOptions{MaxGap: 2}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+
+	if got := collect(FuzzyOptions{}); len(got) != 5 {
+		t.Errorf("Unexpected result set without a gap limit, got=%v", got)
+	}
+
+	want = map[string]int{"Pepan": 3, "Pepin": 3, "Pepanek": 3}
+	if got := collect(FuzzyOptions{MaxGap: 3, AnchorStart: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected anchored result set, expected=%v, got=%v", want, got)
+	}
+}
+
+func TestTrie_FuzzyIgnoreLeadingSkips(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pokemon"), struct{}{})
+	trie.Insert(Prefix("Paaaaaa Pan"), struct{}{})
+
+	collect := func(query string, opts FuzzyOptions) map[string]int {
+		resultMap := make(map[string]int)
+		err := trie.VisitFuzzyWithOptions(Prefix(query), opts, func(prefix Prefix, item Item, skipped int) error {
+			resultMap[string(prefix)] = skipped
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultMap
+	}
+
+	cases := []struct {
+		query string
+		opts  FuzzyOptions
+		want  map[string]int
+	}{
+		{"Ha", FuzzyOptions{}, map[string]int{"Honza": 3}},
+		{"Ha", FuzzyOptions{IgnoreLeadingSkips: true}, map[string]int{"Honza": 0}},
+		{"Hna", FuzzyOptions{}, map[string]int{"Honza": 2}},
+		{"Hna", FuzzyOptions{IgnoreLeadingSkips: true}, map[string]int{"Honza": 1}},
+		{"Pn", FuzzyOptions{MaxGap: 3, IgnoreLeadingSkips: true},
+			map[string]int{"Pepan": 0, "Pepin": 0, "Pepanek": 0, "Paaaaaa Pan": 0}},
+		{"Pen", FuzzyOptions{MaxGap: 3, IgnoreLeadingSkips: true},
+			map[string]int{"Pepan": 2, "Pepin": 2, "Pepanek": 2, "Pokemon": 2}},
+	}
+
+	for _, c := range cases {
+		if got := collect(c.query, c.opts); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected result set for %q %+v, expected=%v, got=%v", c.query, c.opts, c.want, got)
+		}
+	}
+
+	// A single rune query has no skips to ignore.
+	trie.Insert(Prefix("čaj"), struct{}{})
+	for _, opts := range []FuzzyOptions{
+		{RuneAware: true, MaxGap: 2, IgnoreLeadingSkips: true},
+		{RuneAware: true, IgnoreLeadingSkips: true},
+		{RuneAware: true, MaxGap: 2},
+	} {
+		if got, want := collect("č", opts), map[string]int{"čaj": 0}; !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected result set for %+v, expected=%v, got=%v", opts, want, got)
+		}
+	}
+}
+
+func TestTrie_FuzzyRuneAware(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"čokoláda", "čaj", "Ã¡", "á", "\xffčád"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	collect := func(query string, opts FuzzyOptions) map[string]int {
+		resultMap := make(map[string]int)
+		err := trie.VisitFuzzyWithOptions(Prefix(query), opts, func(prefix Prefix, item Item, skipped int) error {
+			resultMap[string(prefix)] = skipped
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resultMap
+	}
+
+	// The skipped characters are counted in bytes by default.
+	want := map[string]int{"čokoláda": 6, "\xffčád": 2}
+	if got := collect("čd", FuzzyOptions{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected byte result set, expected=%v, got=%v", want, got)
+	}
+
+	// The key that is not valid UTF-8 is still matched byte by byte.
+	want = map[string]int{"čokoláda": 5, "\xffčád": 2}
+	if got := collect("čd", FuzzyOptions{RuneAware: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected rune result set, expected=%v, got=%v", want, got)
+	}
+
+	// The bytes of á can be found in Ã¡, but not the rune.
+	want = map[string]int{"á": 0, "čokoláda": 0, "\xffčád": 0}
+	if got := collect("á", FuzzyOptions{RuneAware: true}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected rune result set, expected=%v, got=%v", want, got)
+	}
+	if got := collect("á", FuzzyOptions{}); len(got) != 4 {
+		t.Errorf("Unexpected byte result set, got=%v", got)
+	}
+
+	// The gaps are counted in runes as well, l, á and d are 4 bytes.
+	want = map[string]int{"čokoláda": 3}
+	if got := collect("oa", FuzzyOptions{RuneAware: true, MaxGap: 3}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected rune result set with a gap limit, expected=%v, got=%v", want, got)
+	}
+	if got := collect("oa", FuzzyOptions{MaxGap: 3}); len(got) != 0 {
+		t.Errorf("Unexpected byte result set with a gap limit, got=%v", got)
+	}
+}
+
+func TestTrie_FuzzyBudget(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pepxan"), struct{}{})
+
+	resultMap := make(map[string]int)
+	err := trie.VisitFuzzyBudget(Prefix("Ppn"), false, 2, func(prefix Prefix, item Item, skipped int) error {
+		resultMap[string(prefix)] = skipped
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("got result set %v\n", resultMap)
+
+	for _, want := range []string{"Pepan", "Pepin", "Pepanek"} {
+		if got, ok := resultMap[want]; !ok {
+			t.Errorf("item %s not found in result set\n", want)
+		} else if got != 2 {
+			t.Errorf("got wrong skipped value, wanted 2, got %d\n", got)
+		}
+	}
+	if _, ok := resultMap["Pepxan"]; ok {
+		t.Error("item Pepxan exceeds the budget but was found in result set")
+	}
+}
+
+func TestTrie_FuzzyTiered(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pxepxxxxan"), struct{}{})
+
+	tiers := make(map[string]int)
+	err := trie.VisitFuzzyTiered(Prefix("Pepan"), false, func(prefix Prefix, item Item, tier int) error {
+		tiers[string(prefix)] = tier
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"Pepan": 0, "Pepanek": 0, "Pxepxxxxan": 2}
+	if !reflect.DeepEqual(tiers, want) {
+		t.Errorf("Unexpected tiers, expected=%v, got=%v", want, tiers)
+	}
+
+	tiers = make(map[string]int)
+	trie.VisitFuzzyTiered(Prefix("Pean"), false, func(prefix Prefix, item Item, tier int) error {
+		tiers[string(prefix)] = tier
+		return nil
+	})
+	if tier, ok := tiers["Pepan"]; !ok || tier != 1 {
+		t.Errorf("Unexpected tier of Pepan, expected=1, got=%v (found %v)", tier, ok)
+	}
+}
+
+func TestTrie_FuzzyCompiled(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("pepa"), struct{}{})
+	other := NewTrie()
+	other.Insert(Prefix("Kapr"), struct{}{})
+	other.Insert(Prefix("Pepa"), struct{}{})
+
+	collect := func(visit func(visitor FuzzyVisitorFunc) error) []string {
+		var results []string
+		err := visit(func(prefix Prefix, item Item, skipped int) error {
+			results = append(results, fmt.Sprintf("%s:%d", prefix, skipped))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	for _, query := range []string{"Pn", "pa", "ek", "Ka", "", "xyz"} {
+		for _, caseInsensitive := range []bool{false, true} {
+			q := CompileFuzzyQuery(Prefix(query), caseInsensitive)
+			for _, trie := range []*Trie{trie, other} {
+				want := collect(func(visitor FuzzyVisitorFunc) error {
+					return trie.VisitFuzzy(Prefix(query), caseInsensitive, visitor)
+				})
+				got := collect(func(visitor FuzzyVisitorFunc) error {
+					return trie.VisitCompiled(q, visitor)
+				})
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("Unexpected result set for %q (case-insensitive %v), expected=%v, got=%v",
+						query, caseInsensitive, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestTrie_FuzzyTokens(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"Honza Novak", "Novak Jan", "Jan Honzik", "Pepa Novak", "Karel"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	testQueries := []struct {
+		query           string
+		caseInsensitive bool
+		wantResults     []string
+	}{
+		{"novak honza", true, []string{"Honza Novak"}},
+		{"novak honza", false, nil},
+		{"Novak Honza", false, []string{"Honza Novak"}},
+		{"nvk jn", true, []string{"Novak Jan"}},
+		{"hnz  ", true, []string{"Honza Novak", "Jan Honzik"}},
+		{"ak", true, []string{"Honza Novak", "Jan Honzik", "Novak Jan", "Pepa Novak"}},
+		{" ", false, []string{"Honza Novak", "Jan Honzik", "Karel", "Novak Jan", "Pepa Novak"}},
+	}
+
+	for _, data := range testQueries {
+		var got []string
+		err := trie.VisitFuzzyTokens(Prefix(data.query), ' ', data.caseInsensitive, func(prefix Prefix, item Item) error {
+			got = append(got, string(prefix))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, data.wantResults) {
+			t.Errorf("Unexpected result set for %q (case-insensitive %v), expected=%v, got=%v",
+				data.query, data.caseInsensitive, data.wantResults, got)
+		}
+	}
+}
+
+func TestTrie_FuzzyDetailed(t *testing.T) {
+	trie := populateTrie(t)
+
+	type testResult struct {
+		skipped int
+		matched int
+	}
+
+	resultMap := make(map[string]testResult)
+	query := Prefix("Pxpn")
+	err := trie.VisitFuzzyDetailed(query, false, func(prefix Prefix, item Item, skipped, matched int) error {
+		resultMap[string(prefix)] = testResult{skipped, matched}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("got result set %v\n", resultMap)
+
+	got, ok := resultMap["Pepan"]
+	if !ok {
+		t.Fatal("item Pepan not found in result set")
+	}
+	if want := (testResult{2, 3}); got != want {
+		t.Errorf("Unexpected result for Pepan, wanted %v, got %v", want, got)
+	}
+	if got := resultMap["Honza"]; got.matched != 1 {
+		t.Errorf("Unexpected matched count for Honza, wanted 1, got %d", got.matched)
+	}
+	if _, ok := resultMap["Karel"]; ok {
+		t.Error("item Karel should not be in the result set")
+	}
+	for key, r := range resultMap {
+		if r.matched > len(query) {
+			t.Errorf("Matched more characters than there are in the query for %s", key)
+		}
+	}
+}
+
 func TestTrie_SubstringCollect(t *testing.T) {
 	trie := populateTrie(t)
 
@@ -421,6 +2729,58 @@ func TestTrie_SubstringCollect(t *testing.T) {
 	}
 }
 
+func TestTrie_SubstringWord(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"Honza an", "Honza", "Pepan", "an Pepan", "pan-an-ek", "Jan,an", "banana", "an"} {
+		trie.Insert(Prefix(key), struct{}{})
+	}
+
+	var got []string
+	err := trie.VisitSubstringWord(Prefix("an"), []byte(" -"), func(prefix Prefix, item Item) error {
+		got = append(got, string(prefix))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Honza an", "an", "an Pepan", "pan-an-ek"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected result set, expected=%v, got=%v", want, got)
+	}
+}
+
+func TestTrie_SubstringSpans(t *testing.T) {
+	trie := populateTrie(t)
+
+	spans := make(map[string][]Span)
+	err := trie.VisitSubstringSpans(Prefix("e"), false, func(prefix Prefix, item Item, s []Span) error {
+		spans[string(prefix)] = s
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Span{{0, 1, false}, {1, 2, true}, {2, 5, false}, {5, 6, true}, {6, 7, false}}
+	if got := spans["Pepanek"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected spans for Pepanek, expected=%v, got=%v", want, got)
+	}
+
+	want = []Span{{0, 3, false}, {3, 4, true}, {4, 5, false}}
+	if got := spans["Karel"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected spans for Karel, expected=%v, got=%v", want, got)
+	}
+
+	if _, ok := spans["Honza"]; ok {
+		t.Error("item Honza should not be in the result set")
+	}
+
+	if got, want := substringSpans(Prefix("PEPAN"), Prefix("pa"), true), []Span{{0, 2, false}, {2, 4, true}, {4, 5, false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected case-insensitive spans, expected=%v, got=%v", want, got)
+	}
+}
+
 func Test_makePrefixMask(t *testing.T) {
 	type testData struct {
 		key    Prefix
@@ -546,6 +2906,64 @@ func BenchmarkFuzzyCaseInsensitiveSuperDense(b *testing.B) {
 	benchmarkVisitFuzzy(true, b)
 }
 
+func benchmarkInsert(options []Option, b *testing.B) {
+	keys := make([]Prefix, amountWords)
+	for i := range keys {
+		keys[i] = Prefix(mrandBytes(wordLength))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		trie := NewTrie(options...)
+		for _, key := range keys {
+			trie.Insert(key, struct{}{})
+		}
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	benchmarkInsert(nil, b)
+}
+func BenchmarkInsertBorrowedKeys(b *testing.B) {
+	benchmarkInsert([]Option{WithBorrowedKeys()}, b)
+}
+
+func benchmarkGetMany(many bool, b *testing.B) {
+	trie := NewTrie()
+	var keys []Prefix
+	for i := 0; i < amountWords/10; i++ {
+		for _, field := range []string{"email", "name", "password", "settings/theme", "settings/locale"} {
+			key := Prefix(fmt.Sprintf("users/%08d/%s", i*7919%100000, field))
+			trie.Insert(key, struct{}{})
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if many {
+			trie.GetMany(keys)
+			continue
+		}
+		items := make([]Item, len(keys))
+		for j, key := range keys {
+			items[j] = trie.Get(key)
+		}
+	}
+}
+
+func BenchmarkGetManySorted(b *testing.B) {
+	benchmarkGetMany(true, b)
+}
+
+func BenchmarkGetManyLoop(b *testing.B) {
+	benchmarkGetMany(false, b)
+}
+
 func mrandBytes(length int) []byte {
 	bytes := make([]byte, length)
 	for i := 0; i < length; i++ {
@@ -0,0 +1,177 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"sync/atomic"
+)
+
+// QueryProfile holds the cumulative counters of a single query type.
+type QueryProfile struct {
+	// Queries is the number of queries run.
+	Queries uint64
+	// NodesVisited is the number of nodes examined by the queries.
+	NodesVisited uint64
+	// PruneHits is the number of subtrees skipped thanks to the node masks.
+	PruneHits uint64
+	// VisitorCalls is the number of times the visitors were called.
+	VisitorCalls uint64
+}
+
+// ProfileStats reports the counters collected since profiling was enabled.
+type ProfileStats struct {
+	Fuzzy     QueryProfile
+	Substring QueryProfile
+}
+
+// ProfileEnabled turns query profiling on or off. The counters are reset
+// when profiling is turned on, turning it off drops the counters.
+//
+// Only the fuzzy and substring searches are profiled. No counters are touched
+// unless profiling is enabled, so there is no overhead otherwise. The counters
+// are updated atomically, the queries can still run concurrently, but
+// ProfileEnabled itself modifies the trie.
+func (trie *Trie) ProfileEnabled(enabled bool) {
+	switch {
+	case enabled && (trie.opts == nil || trie.opts.profile == nil):
+		trie.options().profile = &queryProfiles{}
+	case !enabled && trie.opts != nil:
+		trie.opts.profile = nil
+	}
+}
+
+// ProfileSnapshot returns the current values of the profiling counters.
+// Zero stats are returned when profiling is not enabled.
+func (trie *Trie) ProfileSnapshot() ProfileStats {
+	if trie.opts == nil || trie.opts.profile == nil {
+		return ProfileStats{}
+	}
+	return ProfileStats{
+		Fuzzy:     trie.opts.profile.fuzzy.snapshot(),
+		Substring: trie.opts.profile.substring.snapshot(),
+	}
+}
+
+// PruneReport compares the work done by a fuzzy search with and without
+// the node masks, see FuzzyPruneReport.
+type PruneReport struct {
+	// NodesVisited is the number of nodes the search examines.
+	NodesVisited int
+	// PruneHits is the number of subtrees the search skips thanks to the masks.
+	PruneHits int
+	// NodesVisitedUnmasked is the number of nodes the search would examine
+	// if the masks were not consulted.
+	NodesVisitedUnmasked int
+}
+
+// FuzzyPruneReport runs the fuzzy search for query the way VisitFuzzy does,
+// but instead of visiting the matching keys it counts the nodes examined,
+// once using the node masks to prune the subtrees and once without them.
+// The nodes of the subtrees visited as matching, which are walked the same way
+// in both cases, are not counted. Running the report over a sample of queries
+// tells how much the masks help with the keys stored.
+func (trie *Trie) FuzzyPruneReport(query Prefix, caseInsensitive bool) PruneReport {
+	var report PruneReport
+	if len(query) == 0 {
+		return report
+	}
+
+	q := compileFuzzyQuery(query, fuzzyParams{FuzzyOptions{CaseInsensitive: caseInsensitive}, -1}, trie.opts.masks())
+	report.NodesVisited, report.PruneHits = trie.countFuzzyNodes(q, 0, true)
+	report.NodesVisitedUnmasked, _ = trie.countFuzzyNodes(q, 0, false)
+	return report
+}
+
+// countFuzzyNodes counts the nodes the fuzzy search examines in the subtree,
+// idx being the number of query characters already matched.
+func (trie *Trie) countFuzzyNodes(q *FuzzyQuery, idx int, useMasks bool) (visited, pruned int) {
+	visited = 1
+	if useMasks {
+		m, cmp := q.masks[idx], trie.mask
+		if q.params.CaseInsensitive {
+			cmp = q.charmap.foldMask(cmp)
+		}
+		if cmp&m != m {
+			return visited, 1
+		}
+	}
+
+	matchCount, _ := fuzzyMatchCount(trie.prefix, q.partial[idx:], idx, q.params.lead(), q.params.CaseInsensitive)
+	idx += matchCount
+	if idx == len(q.partial) {
+		return visited, 0
+	}
+
+	for _, child := range trie.children.getChildren() {
+		childVisited, childPruned := child.countFuzzyNodes(q, idx, useMasks)
+		visited += childVisited
+		pruned += childPruned
+	}
+	return visited, pruned
+}
+
+type queryProfiles struct {
+	fuzzy     queryCounters
+	substring queryCounters
+}
+
+// queryCounters are updated atomically, a nil *queryCounters means
+// that profiling is disabled and all the methods do nothing.
+type queryCounters struct {
+	queries      uint64
+	nodesVisited uint64
+	pruneHits    uint64
+	visitorCalls uint64
+}
+
+func (counters *queryCounters) query() {
+	if counters != nil {
+		atomic.AddUint64(&counters.queries, 1)
+	}
+}
+
+func (counters *queryCounters) nodeVisited() {
+	if counters != nil {
+		atomic.AddUint64(&counters.nodesVisited, 1)
+	}
+}
+
+func (counters *queryCounters) pruneHit() {
+	if counters != nil {
+		atomic.AddUint64(&counters.pruneHits, 1)
+	}
+}
+
+func (counters *queryCounters) visitorCall() {
+	if counters != nil {
+		atomic.AddUint64(&counters.visitorCalls, 1)
+	}
+}
+
+func (counters *queryCounters) snapshot() QueryProfile {
+	return QueryProfile{
+		Queries:      atomic.LoadUint64(&counters.queries),
+		NodesVisited: atomic.LoadUint64(&counters.nodesVisited),
+		PruneHits:    atomic.LoadUint64(&counters.pruneHits),
+		VisitorCalls: atomic.LoadUint64(&counters.visitorCalls),
+	}
+}
+
+// fuzzyCounters returns the fuzzy search counters, nil when not profiling.
+func (trie *Trie) fuzzyCounters() *queryCounters {
+	if trie.opts == nil || trie.opts.profile == nil {
+		return nil
+	}
+	return &trie.opts.profile.fuzzy
+}
+
+// substringCounters returns the substring search counters, nil when not profiling.
+func (trie *Trie) substringCounters() *queryCounters {
+	if trie.opts == nil || trie.opts.profile == nil {
+		return nil
+	}
+	return &trie.opts.profile.substring
+}
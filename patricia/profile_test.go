@@ -0,0 +1,134 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	mrand "math/rand"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_ProfileFuzzy(t *testing.T) {
+	trie := populateTrie(t)
+	trie.ProfileEnabled(true)
+
+	trie.VisitFuzzy(Prefix("Hx"), false, func(prefix Prefix, item Item, skipped int) error {
+		t.Errorf("Unexpected match %s", prefix)
+		return nil
+	})
+
+	stats := trie.ProfileSnapshot()
+	t.Logf("after absent query: %+v", stats)
+	if stats.Fuzzy.Queries != 1 {
+		t.Errorf("Unexpected number of queries, expected=1, got=%d", stats.Fuzzy.Queries)
+	}
+	if stats.Fuzzy.PruneHits == 0 {
+		t.Error("no prune hits counted for a query with absent characters")
+	}
+	if stats.Fuzzy.NodesVisited == 0 {
+		t.Error("no visited nodes counted")
+	}
+
+	var calls uint64
+	trie.VisitFuzzy(Prefix("pn"), true, func(prefix Prefix, item Item, skipped int) error {
+		calls++
+		return nil
+	})
+
+	stats = trie.ProfileSnapshot()
+	if stats.Fuzzy.VisitorCalls != calls {
+		t.Errorf("Unexpected number of visitor calls, expected=%d, got=%d", calls, stats.Fuzzy.VisitorCalls)
+	}
+	if stats.Substring != (QueryProfile{}) {
+		t.Errorf("Unexpected substring counters: %+v", stats.Substring)
+	}
+}
+
+func TestTrie_ProfileSubstring(t *testing.T) {
+	trie := populateTrie(t)
+	trie.ProfileEnabled(true)
+
+	var calls uint64
+	trie.VisitSubstring(Prefix("e"), false, func(prefix Prefix, item Item) error {
+		calls++
+		return nil
+	})
+
+	stats := trie.ProfileSnapshot()
+	if stats.Substring.Queries != 1 {
+		t.Errorf("Unexpected number of queries, expected=1, got=%d", stats.Substring.Queries)
+	}
+	if stats.Substring.VisitorCalls != calls || calls != 6 {
+		t.Errorf("Unexpected number of visitor calls, expected=6, got=%d (%d counted)", calls, stats.Substring.VisitorCalls)
+	}
+	if stats.Substring.PruneHits == 0 {
+		t.Error("no prune hits counted, node Honza cannot contain the substring")
+	}
+}
+
+func TestTrie_ProfileDisabled(t *testing.T) {
+	trie := populateTrie(t)
+	trie.ProfileEnabled(true)
+	trie.VisitFuzzy(Prefix("pn"), true, func(prefix Prefix, item Item, skipped int) error {
+		return nil
+	})
+
+	trie.ProfileEnabled(false)
+	trie.VisitFuzzy(Prefix("pn"), true, func(prefix Prefix, item Item, skipped int) error {
+		return nil
+	})
+	if stats := trie.ProfileSnapshot(); stats != (ProfileStats{}) {
+		t.Errorf("Unexpected stats with profiling disabled: %+v", stats)
+	}
+
+	// Enabling the profiling again starts from zero.
+	trie.ProfileEnabled(true)
+	if stats := trie.ProfileSnapshot(); stats != (ProfileStats{}) {
+		t.Errorf("Unexpected stats after enabling the profiling: %+v", stats)
+	}
+}
+
+func TestTrie_FuzzyPruneReport(t *testing.T) {
+	trie := NewTrie()
+	rng := mrand.New(mrand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		key := make(Prefix, 8)
+		for j := range key {
+			key[j] = byte(rng.Intn(25) + 'a')
+		}
+		trie.Insert(key, i)
+	}
+	trie.Insert(Prefix("jzx"), 0)
+
+	for _, caseInsensitive := range []bool{false, true} {
+		report := trie.FuzzyPruneReport(Prefix("zx"), caseInsensitive)
+		t.Logf("report (case-insensitive %v): %+v", caseInsensitive, report)
+		if report.NodesVisited*10 > report.NodesVisitedUnmasked {
+			t.Errorf("Masks do not prune enough, visited %d nodes out of %d",
+				report.NodesVisited, report.NodesVisitedUnmasked)
+		}
+		if report.PruneHits == 0 {
+			t.Error("no prune hits reported for a query with a rare character")
+		}
+
+		// The masked count matches what the search itself examines.
+		trie.ProfileEnabled(true)
+		trie.VisitFuzzy(Prefix("zx"), caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+			return nil
+		})
+		stats := trie.ProfileSnapshot()
+		trie.ProfileEnabled(false)
+		if stats.Fuzzy.NodesVisited != uint64(report.NodesVisited) || stats.Fuzzy.PruneHits != uint64(report.PruneHits) {
+			t.Errorf("Unexpected report, expected %d visited and %d pruned, got=%+v",
+				stats.Fuzzy.NodesVisited, stats.Fuzzy.PruneHits, report)
+		}
+	}
+
+	if report := trie.FuzzyPruneReport(Prefix(""), false); report != (PruneReport{}) {
+		t.Errorf("Unexpected report for an empty query, got=%+v", report)
+	}
+}
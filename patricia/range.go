@@ -0,0 +1,282 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+// errPageFull stops the walk of Page once the page is filled.
+var errPageFull = errors.New("Page full")
+
+// VisitUint64Range visits the keys encoding numbers between lo and hi,
+// both inclusive, in ascending numeric order.
+//
+// The keys are assumed to be exactly 8 bytes long, holding the numbers encoded
+// big-endian, e.g. using binary.BigEndian.PutUint64, so that the lexicographic
+// order of the keys is the numeric order. Only the subtrees that can contain
+// keys in the range are walked. Keys of any other length are skipped.
+// The error handling works like in Visit.
+func (trie *Trie) VisitUint64Range(lo, hi uint64, visitor func(n uint64, item Item) error) error {
+	if lo > hi {
+		return nil
+	}
+
+	var loKey, hiKey [8]byte
+	binary.BigEndian.PutUint64(loKey[:], lo)
+	binary.BigEndian.PutUint64(hiKey[:], hi)
+	return trie.walkRange(loKey[:], hiKey[:], func(prefix Prefix, item Item) error {
+		if len(prefix) != 8 {
+			return nil
+		}
+		return visitor(binary.BigEndian.Uint64(prefix), item)
+	})
+}
+
+// Page returns up to limit entries in ascending lexicographic order of their
+// keys, starting with the first key strictly greater than after, so that
+// the pages can be fetched one by one passing the next cursor returned
+// from the previous call as after. A nil after starts at the first key,
+// the empty key included.
+//
+// next is the key of the last entry of the page, or after when the page is
+// empty. done tells that there are no more entries after the page. Only the
+// subtrees that can contain keys greater than after are walked, so fetching
+// a page does not visit the keys of the previous pages.
+func (trie *Trie) Page(after Prefix, limit int) (entries []Entry, next Prefix, done bool) {
+	if after != nil {
+		after = trie.foldKey(after)
+	}
+
+	lo := after
+	if lo == nil {
+		lo = Prefix{}
+	}
+	err := trie.walkRange(lo, nil, func(prefix Prefix, item Item) error {
+		if after != nil && bytes.Equal(prefix, after) {
+			return nil
+		}
+		if len(entries) == limit {
+			return errPageFull
+		}
+		entries = append(entries, Entry{prefix, item})
+		return nil
+	})
+
+	next = after
+	if len(entries) != 0 {
+		next = append(Prefix{}, entries[len(entries)-1].Key...)
+	}
+	return entries, next, err != errPageFull
+}
+
+// walkRange visits the keys between lo and hi, both inclusive,
+// in ascending lexicographic order. A nil hi means there is no upper bound.
+func (trie *Trie) walkRange(lo, hi Prefix, visitor VisitorFunc) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	return trie.walkRangeRecursive(&prefix, lo, hi, visitor)
+}
+
+func (trie *Trie) walkRangeRecursive(prefix *Prefix, lo, hi Prefix, visitor VisitorFunc) error {
+	// All the keys in the subtree start with the prefix, so the subtree
+	// can be skipped when the prefix is greater than hi or when it is less
+	// than lo without being a prefix of lo.
+	if hi != nil && bytes.Compare(*prefix, hi) > 0 {
+		return nil
+	}
+	if bytes.Compare(*prefix, lo) < 0 && !bytes.HasPrefix(lo, *prefix) {
+		return nil
+	}
+
+	if trie.hasItem && bytes.Compare(*prefix, lo) >= 0 {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+	}
+
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		err := child.walkRangeRecursive(prefix, lo, hi, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The ordered operations below compare the keys case-insensitively, folding
+// the ASCII letters, so that "apple" and "Apple" sort next to each other
+// before "banana". The keys whose folded forms collide are ordered by their
+// bytes, i.e. "APPLE" < "Apple" < "apple". The bounds match all the keys
+// colliding with them.
+
+// VisitRangeFold visits the keys between lo and hi, both inclusive, compared
+// case-insensitively, in ascending case-insensitive order. A nil lo means
+// there is no lower bound and a nil hi means there is no upper bound.
+//
+// Only the subtrees that can contain keys in the range are walked, but the keys
+// in the range are collected and sorted before being visited. Any error
+// returned from the visitor, SkipSubtree included, stops the visit
+// and it is returned.
+func (trie *Trie) VisitRangeFold(lo, hi Prefix, visitor VisitorFunc) error {
+	bounds := foldRange{lo: foldPrefix(lo)}
+	if hi != nil {
+		bounds.hi = foldPrefix(hi)
+	}
+
+	var entries []Entry
+	trie.walkRangeFold(&bounds, func(prefix Prefix, item Item) error {
+		entries = append(entries, Entry{prefix, item})
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return compareFold(entries[i].Key, entries[j].Key) < 0
+	})
+
+	for _, entry := range entries {
+		if err := visitor(entry.Key, entry.Item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FloorFold returns the greatest key less than or equal to key compared
+// case-insensitively. When more keys collide with key, the greatest one
+// of them is returned.
+func (trie *Trie) FloorFold(key Prefix) (floor Prefix, item Item, ok bool) {
+	// Nil key not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+
+	bounds := foldRange{lo: Prefix{}, hi: foldPrefix(key)}
+	trie.walkRangeFold(&bounds, func(prefix Prefix, it Item) error {
+		if !ok || compareFold(prefix, floor) > 0 {
+			floor, item, ok = prefix, it, true
+			// Nothing less than the floor found so far can be the floor.
+			bounds.lo = foldPrefix(prefix)
+		}
+		return nil
+	})
+	return
+}
+
+// CeilingFold returns the least key greater than or equal to key compared
+// case-insensitively. When more keys collide with key, the least one
+// of them is returned.
+func (trie *Trie) CeilingFold(key Prefix) (ceiling Prefix, item Item, ok bool) {
+	// Nil key not allowed.
+	if key == nil {
+		panic(ErrNilPrefix)
+	}
+
+	bounds := foldRange{lo: foldPrefix(key)}
+	trie.walkRangeFold(&bounds, func(prefix Prefix, it Item) error {
+		if !ok || compareFold(prefix, ceiling) < 0 {
+			ceiling, item, ok = prefix, it, true
+			// Nothing greater than the ceiling found so far can be the ceiling.
+			bounds.hi = foldPrefix(prefix)
+		}
+		return nil
+	})
+	return
+}
+
+// foldRange holds the folded bounds of walkRangeFold,
+// a nil hi meaning there is no upper bound.
+type foldRange struct {
+	lo, hi Prefix
+}
+
+// walkRangeFold visits the keys with the folded forms between the bounds,
+// both inclusive, in no particular order. The visitor may narrow the bounds.
+func (trie *Trie) walkRangeFold(bounds *foldRange, visitor VisitorFunc) error {
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil {
+		return nil
+	}
+
+	prefix := make(Prefix, len(trie.prefix), 32+len(trie.prefix))
+	copy(prefix, trie.prefix)
+	folded := foldPrefix(trie.prefix)
+	return trie.walkRangeFoldRecursive(&prefix, &folded, bounds, visitor)
+}
+
+func (trie *Trie) walkRangeFoldRecursive(prefix, folded *Prefix, bounds *foldRange, visitor VisitorFunc) error {
+	// Folding keeps the order of the keys sharing a prefix with respect
+	// to the folded prefix, so the subtrees are pruned like in walkRange.
+	if bounds.hi != nil && bytes.Compare(*folded, bounds.hi) > 0 {
+		return nil
+	}
+	if bytes.Compare(*folded, bounds.lo) < 0 && !bytes.HasPrefix(bounds.lo, *folded) {
+		return nil
+	}
+
+	if trie.hasItem && bytes.Compare(*folded, bounds.lo) >= 0 {
+		if err := visitor(append(Prefix{}, *prefix...), trie.item); err != nil {
+			return err
+		}
+	}
+
+	for _, child := range trie.children.getChildren() {
+		*prefix = append(*prefix, child.prefix...)
+		for _, b := range child.prefix {
+			*folded = append(*folded, toLower(b))
+		}
+		err := child.walkRangeFoldRecursive(prefix, folded, bounds, visitor)
+		*prefix = (*prefix)[:len(*prefix)-len(child.prefix)]
+		*folded = (*folded)[:len(*folded)-len(child.prefix)]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// foldPrefix returns a copy of key with the ASCII letters folded to lower case.
+func foldPrefix(key Prefix) Prefix {
+	folded := make(Prefix, len(key))
+	for i, b := range key {
+		folded[i] = toLower(b)
+	}
+	return folded
+}
+
+// compareFold compares the keys case-insensitively,
+// comparing their bytes when the folded keys are equal.
+func compareFold(a, b Prefix) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if ca, cb := toLower(a[i]), toLower(b[i]); ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func uint64Key(n uint64) Prefix {
+	key := make(Prefix, 8)
+	binary.BigEndian.PutUint64(key, n)
+	return key
+}
+
+func TestTrie_VisitUint64Range(t *testing.T) {
+	trie := NewTrie()
+	for _, n := range []uint64{0, 7, 255, 256, 1000, 65535, 65536, 1 << 40, 1<<64 - 1} {
+		trie.Insert(uint64Key(n), n)
+	}
+	// Keys of other lengths are ignored.
+	trie.Insert(Prefix{0, 0, 0, 0, 0, 0, 1}, "short")
+	trie.Insert(Prefix{0, 0, 0, 0, 0, 0, 1, 0, 0}, "long")
+
+	collect := func(lo, hi uint64) []uint64 {
+		var got []uint64
+		err := trie.VisitUint64Range(lo, hi, func(n uint64, item Item) error {
+			if item != n {
+				t.Errorf("Unexpected item of %d, expected=%d, got=%v", n, n, item)
+			}
+			got = append(got, n)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	cases := []struct {
+		lo, hi uint64
+		want   []uint64
+	}{
+		{7, 65536, []uint64{7, 255, 256, 1000, 65535, 65536}},
+		{8, 65535, []uint64{255, 256, 1000, 65535}},
+		{256, 256, []uint64{256}},
+		{257, 999, nil},
+		{1 << 20, 1<<64 - 1, []uint64{1 << 40, 1<<64 - 1}},
+		{0, 1<<64 - 1, []uint64{0, 7, 255, 256, 1000, 65535, 65536, 1 << 40, 1<<64 - 1}},
+		{1000, 7, nil},
+	}
+	for _, c := range cases {
+		if got := collect(c.lo, c.hi); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected numbers in [%d, %d], expected=%v, got=%v", c.lo, c.hi, c.want, got)
+		}
+	}
+
+	// Errors are passed on.
+	stop := errors.New("stop")
+	var visited int
+	err := trie.VisitUint64Range(0, 1000, func(n uint64, item Item) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("Unexpected result, expected=%v after 1 visit, got=%v after %d", stop, err, visited)
+	}
+}
+
+func TestTrie_Page(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix(""), 0)
+	trie.Insert(Prefix("Pep"), 1)
+	want := []string{"", "Honza", "Jenak", "Jenik", "Karel", "Pep", "Pepan", "Pepanek", "Pepin"}
+
+	for _, limit := range []int{1, 2, 4, len(want), 100} {
+		var (
+			got   []string
+			after Prefix
+			pages int
+		)
+		for {
+			entries, next, done := trie.Page(after, limit)
+			if len(entries) > limit {
+				t.Fatalf("Unexpected page size, expected at most %d, got=%d", limit, len(entries))
+			}
+			for _, entry := range entries {
+				got = append(got, string(entry.Key))
+			}
+			pages++
+			if done {
+				break
+			}
+			if len(entries) != limit {
+				t.Fatalf("Unexpected size of a page that is not the last, expected=%d, got=%d", limit, len(entries))
+			}
+			after = next
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Unexpected keys with limit %d, expected=%q, got=%q", limit, want, got)
+		}
+		if wantPages := (len(want) + limit - 1) / limit; pages != wantPages {
+			t.Errorf("Unexpected number of pages with limit %d, expected=%d, got=%d", limit, wantPages, pages)
+		}
+	}
+
+	// The cursor need not be a stored key.
+	entries, next, done := trie.Page(Prefix("Jenb"), 2)
+	if len(entries) != 2 || string(entries[0].Key) != "Jenik" || string(next) != "Karel" || done {
+		t.Errorf("Unexpected page, got=%v, next=%q, done=%v", entries, next, done)
+	}
+	entries, next, done = trie.Page(Prefix("Pepin"), 2)
+	if len(entries) != 0 || string(next) != "Pepin" || !done {
+		t.Errorf("Unexpected last page, got=%v, next=%q, done=%v", entries, next, done)
+	}
+}
+
+func TestTrie_CeilingFloorFold(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("Apple"), 1)
+	trie.Insert(Prefix("banana"), 2)
+
+	for _, query := range []string{"b", "B", "Apples", "APPLEZ"} {
+		if key, item, ok := trie.CeilingFold(Prefix(query)); !ok || string(key) != "banana" || item != 2 {
+			t.Errorf("Unexpected ceiling of %s, expected=banana, got=%s", query, key)
+		}
+		if key, _, ok := trie.FloorFold(Prefix(query)); !ok || string(key) != "Apple" {
+			t.Errorf("Unexpected floor of %s, expected=Apple, got=%s", query, key)
+		}
+	}
+
+	if _, _, ok := trie.CeilingFold(Prefix("BANANAS")); ok {
+		t.Error("Unexpected ceiling past the last key")
+	}
+	if _, _, ok := trie.FloorFold(Prefix("a")); ok {
+		t.Error("Unexpected floor before the first key")
+	}
+
+	// The colliding keys are ordered by their bytes.
+	trie.Insert(Prefix("apple"), 3)
+	trie.Insert(Prefix("APPLE"), 4)
+	if key, _, _ := trie.CeilingFold(Prefix("apple")); string(key) != "APPLE" {
+		t.Errorf("Unexpected ceiling of apple, expected=APPLE, got=%s", key)
+	}
+	if key, _, _ := trie.FloorFold(Prefix("APPLE")); string(key) != "apple" {
+		t.Errorf("Unexpected floor of APPLE, expected=apple, got=%s", key)
+	}
+}
+
+func TestTrie_VisitRangeFold(t *testing.T) {
+	trie := NewTrie()
+	for _, key := range []string{"apple", "Apricot", "Banana", "apple pie", "Apple", "cherry", "b"} {
+		trie.Insert(Prefix(key), nil)
+	}
+
+	collect := func(lo, hi Prefix) []string {
+		var keys []string
+		if err := trie.VisitRangeFold(lo, hi, func(prefix Prefix, item Item) error {
+			keys = append(keys, string(prefix))
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	want := []string{"Apple", "apple", "apple pie", "Apricot", "b", "Banana", "cherry"}
+	if got := collect(nil, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", want, got)
+	}
+
+	want = []string{"Apple", "apple", "apple pie", "Apricot", "b"}
+	if got := collect(Prefix("APPLE"), Prefix("B")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%v, got=%v", want, got)
+	}
+
+	errStop := errors.New("stop")
+	if err := trie.VisitRangeFold(nil, nil, func(prefix Prefix, item Item) error {
+		return errStop
+	}); err != errStop {
+		t.Errorf("Unexpected error, expected=%v, got=%v", errStop, err)
+	}
+}
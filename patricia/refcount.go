@@ -0,0 +1,71 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+)
+
+// WithRefCounting makes the trie count the keys referencing every item,
+// so the items shared by many keys can be released once they are no longer
+// stored in the trie. Whenever the last key referencing an item is deleted
+// or its item is replaced with a different one, onZero is called with the item.
+//
+// The items are compared using ==, so pointers are compared by identity.
+// Nil items and items that are not comparable, e.g. slices or structs holding
+// a slice in an interface field, are not counted.
+// onZero is called from within the modifying method, so it must not modify
+// the trie. Clones of the trie do not count the references.
+func WithRefCounting(onZero func(Item)) Option {
+	return func(trie *Trie) {
+		trie.options().refs = &refCounter{
+			counts: make(map[Item]int),
+			onZero: onZero,
+		}
+	}
+}
+
+// RefCount returns the number of keys item is stored under, it is always 0
+// for a trie not constructed using WithRefCounting.
+func (trie *Trie) RefCount(item Item) int {
+	if trie.opts == nil || trie.opts.refs == nil || !refCounted(item) {
+		return 0
+	}
+	return trie.opts.refs.counts[item]
+}
+
+// refCounter keeps the number of references to every item stored.
+type refCounter struct {
+	counts map[Item]int
+	onZero func(Item)
+}
+
+// refCounted tells whether item can be used as a map key. The value is
+// checked rather than its type, a comparable type still panics when hashed
+// if one of its interface fields holds a value that is not comparable.
+func refCounted(item Item) bool {
+	return item != nil && reflect.ValueOf(item).Comparable()
+}
+
+func (refs *refCounter) acquire(item Item) {
+	if refs == nil || !refCounted(item) {
+		return
+	}
+	refs.counts[item]++
+}
+
+func (refs *refCounter) release(item Item) {
+	if refs == nil || !refCounted(item) {
+		return
+	}
+	if refs.counts[item]--; refs.counts[item] > 0 {
+		return
+	}
+	delete(refs.counts, item)
+	if refs.onZero != nil {
+		refs.onZero(item)
+	}
+}
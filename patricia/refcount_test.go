@@ -0,0 +1,100 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+type sharedItem struct {
+	name string
+}
+
+func TestTrie_RefCountingDelete(t *testing.T) {
+	var released []Item
+	trie := NewTrie(WithRefCounting(func(item Item) {
+		released = append(released, item)
+	}))
+
+	shared := &sharedItem{"shared"}
+	trie.Insert(Prefix("Pepan"), shared)
+	trie.Insert(Prefix("Pepin"), shared)
+	if count := trie.RefCount(shared); count != 2 {
+		t.Errorf("Unexpected reference count, expected=2, got=%d", count)
+	}
+
+	trie.Delete(Prefix("Pepan"))
+	if len(released) != 0 {
+		t.Errorf("Unexpected released items, expected=[], got=%v", released)
+	}
+
+	trie.Delete(Prefix("Pepin"))
+	if want := []Item{shared}; !reflect.DeepEqual(released, want) {
+		t.Errorf("Unexpected released items, expected=%v, got=%v", want, released)
+	}
+	if count := trie.RefCount(shared); count != 0 {
+		t.Errorf("Unexpected reference count, expected=0, got=%d", count)
+	}
+}
+
+func TestTrie_RefCountingIdentity(t *testing.T) {
+	var released []Item
+	trie := NewTrie(WithRefCounting(func(item Item) {
+		released = append(released, item)
+	}))
+
+	// Equal items that are not identical are counted separately.
+	a, b := &sharedItem{"same"}, &sharedItem{"same"}
+	trie.Insert(Prefix("a"), a)
+	trie.Insert(Prefix("b"), b)
+	if count := trie.RefCount(a); count != 1 {
+		t.Errorf("Unexpected reference count, expected=1, got=%d", count)
+	}
+
+	// Replacing an item with itself keeps it referenced.
+	trie.Set(Prefix("a"), a)
+	if len(released) != 0 {
+		t.Errorf("Unexpected released items, expected=[], got=%v", released)
+	}
+
+	// Replacing it with a different one releases it.
+	trie.Set(Prefix("a"), b)
+	if len(released) != 1 || released[0] != a {
+		t.Errorf("Unexpected released items, expected=[%v], got=%v", a, released)
+	}
+	if count := trie.RefCount(b); count != 2 {
+		t.Errorf("Unexpected reference count, expected=2, got=%d", count)
+	}
+
+	// Deleting a subtree releases all the items in it.
+	trie.Insert(Prefix("c"), []int{1})
+	trie.DeleteSubtree(Prefix(""))
+	if len(released) != 2 || released[1] != b {
+		t.Errorf("Unexpected released items, expected=[%v %v], got=%v", a, b, released)
+	}
+}
+
+func TestTrie_RefCountingUnhashable(t *testing.T) {
+	var released []Item
+	trie := NewTrie(WithRefCounting(func(item Item) {
+		released = append(released, item)
+	}))
+
+	// The type is comparable, but hashing the value would panic.
+	item := struct{ a, b interface{} }{[]int{1}, 2}
+	trie.Insert(Prefix("a"), item)
+	if count := trie.RefCount(item); count != 0 {
+		t.Errorf("Unexpected reference count, expected=0, got=%d", count)
+	}
+	trie.Set(Prefix("a"), 3)
+	trie.Delete(Prefix("a"))
+	if want := []Item{3}; !reflect.DeepEqual(released, want) {
+		t.Errorf("Unexpected released items, expected=%v, got=%v", want, released)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// Scorer scores the keys matched by a fuzzy search, see VisitFuzzyScored.
+type Scorer interface {
+	// Score returns the score of candidate matched by query skipping
+	// skipped characters. Higher scores mean better matches.
+	Score(query, candidate Prefix, skipped int) float64
+}
+
+// ScoredVisitorFunc is the type of functions passed to VisitFuzzyScored.
+type ScoredVisitorFunc func(prefix Prefix, item Item, score float64) error
+
+// DefaultScorer is the Scorer used when none is given. The score is the ratio
+// of the query length to the length of the matched part of the key including
+// the skipped characters, so a contiguous match scores 1 and the score drops
+// towards 0 as more characters are skipped.
+type DefaultScorer struct{}
+
+// Score implements Scorer.
+func (DefaultScorer) Score(query, candidate Prefix, skipped int) float64 {
+	if len(query) == 0 {
+		return 1
+	}
+	return float64(len(query)) / float64(len(query)+skipped)
+}
+
+// weightedScore scores candidate the way VisitFuzzyScored does when it is given
+// weights. Every query character weighs weights[i], 1 for the characters with
+// no weight given, and every key character skipped right before matching
+// a query character costs the weight of that query character. The score is
+// the total weight divided by the total weight plus the total cost, so with
+// uniform weights it is the DefaultScorer score.
+func weightedScore(query, candidate Prefix, weights []float64, caseInsensitive bool) float64 {
+	if len(query) == 0 {
+		return 1
+	}
+
+	var total, cost float64
+	gap, i := 0, 0
+	for _, b := range candidate {
+		if i == len(query) {
+			break
+		}
+		if !matchByte(b, query[i], caseInsensitive) {
+			// The characters before the first match are not skipped.
+			if i != 0 {
+				gap++
+			}
+			continue
+		}
+
+		weight := 1.0
+		if i < len(weights) {
+			weight = weights[i]
+		}
+		total += weight
+		cost += weight * float64(gap)
+		gap = 0
+		i++
+	}
+
+	if i != len(query) || total <= 0 {
+		return 0
+	}
+	return total / (total + cost)
+}
+
+// VisitFuzzyScored works much like VisitFuzzy, but the visitor receives the
+// score computed by scorer instead of the number of skipped characters.
+// The keys are visited in the usual order, the visitor is expected to collect
+// and sort them when necessary.
+//
+// When scorer is nil, the keys are scored using weights aligned to partial,
+// making some query characters more important than the others: matching
+// a character with a higher weight contributes more to the score and skipping
+// key characters right before it costs more. Nil weights mean uniform weights,
+// which is the DefaultScorer score. The weights are ignored when scorer is given.
+func (trie *Trie) VisitFuzzyScored(partial Prefix, caseInsensitive bool, weights []float64, scorer Scorer, visitor ScoredVisitorFunc) error {
+	if scorer == nil && weights != nil {
+		return trie.VisitFuzzy(partial, caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+			return visitor(prefix, item, weightedScore(partial, prefix, weights, caseInsensitive))
+		})
+	}
+	if scorer == nil {
+		scorer = DefaultScorer{}
+	}
+
+	return trie.VisitFuzzy(partial, caseInsensitive, func(prefix Prefix, item Item, skipped int) error {
+		return visitor(prefix, item, scorer.Score(partial, prefix, skipped))
+	})
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+type keyLengthScorer struct{}
+
+func (keyLengthScorer) Score(query, candidate Prefix, skipped int) float64 {
+	return -float64(len(candidate))
+}
+
+type scoredKey struct {
+	key   string
+	score float64
+}
+
+func collectScored(t *testing.T, trie *Trie, query string, weights []float64, scorer Scorer) []scoredKey {
+	var results []scoredKey
+	err := trie.VisitFuzzyScored(Prefix(query), true, weights, scorer, func(prefix Prefix, item Item, score float64) error {
+		results = append(results, scoredKey{string(prefix), score})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score > results[j].score
+	})
+	return results
+}
+
+func TestTrie_FuzzyScoredCustomScorer(t *testing.T) {
+	trie := populateTrie(t)
+	trie.Insert(Prefix("Pan"), struct{}{})
+
+	results := collectScored(t, trie, "pn", nil, keyLengthScorer{})
+
+	var keys []string
+	for _, r := range results {
+		keys = append(keys, r.key)
+	}
+	want := []string{"Pan", "Pepan", "Pepin", "Pepanek"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("Unexpected ranking, expected=%v, got=%v", want, keys)
+	}
+	if results[0].score != -3 {
+		t.Errorf("Unexpected score, expected=%v, got=%v", -3, results[0].score)
+	}
+}
+
+func TestTrie_FuzzyScoredDefaultScorer(t *testing.T) {
+	trie := populateTrie(t)
+
+	results := collectScored(t, trie, "Pepan", nil, nil)
+	if len(results) != 2 {
+		t.Fatalf("Unexpected number of results, expected=2, got=%d", len(results))
+	}
+	for _, r := range results {
+		if r.score != 1 {
+			t.Errorf("Unexpected score for %s, expected=1, got=%v", r.key, r.score)
+		}
+	}
+
+	results = collectScored(t, trie, "pn", nil, nil)
+	for _, r := range results {
+		if r.score <= 0 || r.score >= 1 {
+			t.Errorf("Unexpected score for %s, got=%v", r.key, r.score)
+		}
+	}
+}
+
+func TestTrie_FuzzyScoredWeights(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("Pxxan"), struct{}{})
+	trie.Insert(Prefix("Paxn"), struct{}{})
+
+	// Uniform weights score just like the default scorer.
+	uniform := collectScored(t, trie, "pan", []float64{1, 1, 1}, nil)
+	defaults := collectScored(t, trie, "pan", nil, nil)
+	if !reflect.DeepEqual(uniform, defaults) {
+		t.Errorf("Unexpected uniform scores, expected=%v, got=%v", defaults, uniform)
+	}
+	if uniform[0].key != "Paxn" {
+		t.Errorf("Unexpected best match, expected=Paxn, got=%s", uniform[0].key)
+	}
+
+	// Boosting 'n' ranks the key matching it right after 'a' first.
+	boosted := collectScored(t, trie, "pan", []float64{1, 1, 5}, nil)
+	if boosted[0].key != "Pxxan" {
+		t.Errorf("Unexpected best match, expected=Pxxan, got=%v", boosted)
+	}
+	if want := 7.0 / 9.0; boosted[0].score != want {
+		t.Errorf("Unexpected score, expected=%v, got=%v", want, boosted[0].score)
+	}
+
+	// A custom scorer ignores the weights.
+	custom := collectScored(t, trie, "pan", []float64{1, 1, 5}, keyLengthScorer{})
+	if custom[0].key != "Paxn" || custom[0].score != -4 {
+		t.Errorf("Unexpected best match, expected=Paxn -4, got=%v", custom)
+	}
+}
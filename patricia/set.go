@@ -0,0 +1,77 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+// Set is a sorted set of keys backed by a trie storing no items.
+//
+// Set is not thread-safe, the same rules as for Trie apply.
+type Set struct {
+	trie *Trie
+}
+
+// NewSet constructs a new empty set, the options are passed on
+// to the underlying trie.
+func NewSet(options ...Option) *Set {
+	return &Set{NewTrie(options...)}
+}
+
+// Add adds key to the set, false is returned when it was already there.
+func (set *Set) Add(key Prefix) bool {
+	return set.trie.Insert(key, struct{}{})
+}
+
+// Contains returns true when key is in the set.
+func (set *Set) Contains(key Prefix) bool {
+	return set.trie.Match(key)
+}
+
+// Remove removes key from the set, false is returned when it was not there.
+func (set *Set) Remove(key Prefix) bool {
+	return set.trie.Delete(key)
+}
+
+// Len returns the number of keys in the set.
+func (set *Set) Len() int {
+	return set.trie.Len()
+}
+
+// Visit calls visitor on every key in the set in ascending lexicographic
+// order. The error handling works like in Trie.Visit.
+func (set *Set) Visit(visitor func(key Prefix) error) error {
+	return set.trie.VisitSorted(func(prefix Prefix, item Item) error {
+		return visitor(prefix)
+	})
+}
+
+// Keys returns all the keys in the set in ascending lexicographic order.
+func (set *Set) Keys() []Prefix {
+	keys := make([]Prefix, 0, set.Len())
+	set.Visit(func(key Prefix) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys
+}
+
+// Union returns a new set containing the keys found in any of the sets.
+func (set *Set) Union(other *Set) *Set {
+	union := &Set{set.trie.Clone()}
+	other.Visit(func(key Prefix) error {
+		union.Add(key)
+		return nil
+	})
+	return union
+}
+
+// Intersect returns a new set containing the keys found in both sets.
+func (set *Set) Intersect(other *Set) *Set {
+	return &Set{set.trie.Intersection(other.trie)}
+}
+
+// Difference returns a new set containing the keys of set not found in other.
+func (set *Set) Difference(other *Set) *Set {
+	return &Set{set.trie.Difference(other.trie)}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func newTestSet(keys ...string) *Set {
+	set := NewSet()
+	for _, key := range keys {
+		set.Add(Prefix(key))
+	}
+	return set
+}
+
+func setKeys(set *Set) []string {
+	keys := []string{}
+	for _, key := range set.Keys() {
+		keys = append(keys, string(key))
+	}
+	return keys
+}
+
+func TestSet_Basics(t *testing.T) {
+	set := NewSet()
+	if !set.Add(Prefix("Pepan")) || !set.Add(Prefix("Honza")) || !set.Add(Prefix("")) {
+		t.Error("New keys not added")
+	}
+	if set.Add(Prefix("Pepan")) {
+		t.Error("Duplicate key added")
+	}
+	if n := set.Len(); n != 3 {
+		t.Errorf("Unexpected length, expected=3, got=%d", n)
+	}
+
+	for key, want := range map[string]bool{"Pepan": true, "Honza": true, "": true, "Pep": false, "Pepanek": false} {
+		if got := set.Contains(Prefix(key)); got != want {
+			t.Errorf("Unexpected membership of %q, expected=%v, got=%v", key, want, got)
+		}
+	}
+
+	if !set.Remove(Prefix("Pepan")) || set.Remove(Prefix("Pepan")) {
+		t.Error("Unexpected result of removing a key")
+	}
+	if got, want := setKeys(set), []string{"", "Honza"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%q, got=%q", want, got)
+	}
+}
+
+func TestSet_Operations(t *testing.T) {
+	a := newTestSet("Pepan", "Pepin", "Honza", "Karel")
+	b := newTestSet("Pepan", "Jenik", "Karel", "Pepanek")
+
+	cases := []struct {
+		name string
+		set  *Set
+		want []string
+	}{
+		{"union", a.Union(b), []string{"Honza", "Jenik", "Karel", "Pepan", "Pepanek", "Pepin"}},
+		{"intersection", a.Intersect(b), []string{"Karel", "Pepan"}},
+		{"difference", a.Difference(b), []string{"Honza", "Pepin"}},
+		{"reverse difference", b.Difference(a), []string{"Jenik", "Pepanek"}},
+		{"union with empty", a.Union(NewSet()), []string{"Honza", "Karel", "Pepan", "Pepin"}},
+		{"intersection with empty", a.Intersect(NewSet()), []string{}},
+	}
+	for _, c := range cases {
+		if got := setKeys(c.set); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("Unexpected %s, expected=%q, got=%q", c.name, c.want, got)
+		}
+	}
+
+	// The operands are left intact.
+	if got, want := setKeys(a), []string{"Honza", "Karel", "Pepan", "Pepin"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected keys, expected=%q, got=%q", want, got)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// The write-ahead log starts with a header consisting of the magic bytes and
+// the format version. Every record is then encoded as the payload length
+// written as a uvarint, the CRC-32 checksum of the length bytes, the payload
+// and the CRC-32 checksum of the payload. The length has its own checksum,
+// so a damaged length is told apart from a torn record without trusting it.
+// The payload is the operation byte followed by the key length, the key and
+// for the set operation the item encoded the same way as in the binary format.
+
+const (
+	walMagic   = "PWAL"
+	walVersion = 1
+)
+
+const (
+	walOpSet byte = iota + 1
+	walOpDelete
+	walOpDeleteSubtree
+)
+
+// AttachWAL starts logging all the subsequent modifications of the trie into w.
+// The current contents of the trie are logged first, so replaying the log
+// using ReplayWAL reconstructs the whole trie. Any previously attached log
+// is replaced.
+//
+// The modifying methods do not return errors, so once writing a record fails,
+// logging stops and the error is reported by WALError.
+func (trie *Trie) AttachWAL(w io.Writer) error {
+	wal := &walWriter{w: w}
+	if _, err := io.WriteString(w, walMagic); err != nil {
+		return err
+	}
+	wal.writeUvarint(walVersion)
+
+	trie.VisitSorted(func(prefix Prefix, item Item) error {
+		wal.set(prefix, item)
+		return wal.err
+	})
+	if wal.err != nil {
+		return wal.err
+	}
+
+	trie.options().wal = wal
+	return nil
+}
+
+// WALError returns the error that made the attached log stop, if any.
+func (trie *Trie) WALError() error {
+	if trie.opts == nil || trie.opts.wal == nil {
+		return nil
+	}
+	return trie.opts.wal.err
+}
+
+// ReplayWAL reconstructs a trie from a log written by a trie with AttachWAL.
+//
+// A torn final record, the result of a crash in the middle of writing it,
+// is detected and skipped, so is a final record with a damaged payload.
+// ErrInvalidEncoding is returned when a record other than the final one
+// is damaged and when the length of any record is damaged, even when it makes
+// the record appear to run until the end of the log.
+func ReplayWAL(r io.Reader) (*Trie, error) {
+	br := bufio.NewReader(r)
+	for i := 0; i < len(walMagic); i++ {
+		if b, err := br.ReadByte(); err != nil || b != walMagic[i] {
+			return nil, ErrInvalidEncoding
+		}
+	}
+	if version, err := binary.ReadUvarint(br); err != nil || version != walVersion {
+		return nil, ErrInvalidEncoding
+	}
+
+	trie := NewTrie()
+	for {
+		payload, err := readWALRecord(br)
+		if err == io.EOF {
+			return trie, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// A torn final record.
+			return trie, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err := trie.replayWALRecord(payload); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readWALRecord returns the payload of the next record. io.EOF is returned
+// at the end of the log, io.ErrUnexpectedEOF when the final record is torn.
+func readWALRecord(r *bufio.Reader) ([]byte, error) {
+	var header [binary.MaxVarintLen64 + 4]byte
+	k := 0
+	for {
+		b, err := r.ReadByte()
+		switch {
+		case err == io.EOF && k == 0:
+			return nil, io.EOF
+		case err == io.EOF:
+			// The log ends in the middle of the length.
+			return nil, io.ErrUnexpectedEOF
+		case err != nil:
+			return nil, err
+		}
+		header[k] = b
+		k++
+		if b < 0x80 {
+			break
+		}
+		if k == binary.MaxVarintLen64 {
+			return nil, ErrInvalidEncoding
+		}
+	}
+
+	if _, err := io.ReadFull(r, header[k:k+4]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[k:]) != crc32.ChecksumIEEE(header[:k]) {
+		return nil, ErrInvalidEncoding
+	}
+	n, m := binary.Uvarint(header[:k])
+	if m <= 0 || n > math.MaxInt64-4 {
+		return nil, ErrInvalidEncoding
+	}
+
+	// The length is checked, but do not trust it too much when allocating.
+	var record bytes.Buffer
+	if _, err := io.CopyN(&record, r, int64(n)+4); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	payload, sum := record.Bytes()[:n], record.Bytes()[n:]
+	if binary.LittleEndian.Uint32(sum) != crc32.ChecksumIEEE(payload) {
+		// A damaged record is only fine at the very end of the log.
+		if _, err := r.Peek(1); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, ErrInvalidEncoding
+	}
+	return payload, nil
+}
+
+func (trie *Trie) replayWALRecord(payload []byte) error {
+	r := bytes.NewReader(payload)
+	op, err := r.ReadByte()
+	if err != nil {
+		return ErrInvalidEncoding
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return ErrInvalidEncoding
+	}
+	key := make(Prefix, n)
+	r.Read(key)
+
+	switch op {
+	case walOpSet:
+		item, err := decodeItem(payload[len(payload)-r.Len():])
+		if err != nil {
+			return err
+		}
+		trie.Set(key, item)
+	case walOpDelete:
+		trie.Delete(key)
+	case walOpDeleteSubtree:
+		trie.DeleteSubtree(key)
+	default:
+		return ErrInvalidEncoding
+	}
+	return nil
+}
+
+// walWriter writes the log records, it keeps the first error encountered.
+type walWriter struct {
+	w       io.Writer
+	err     error
+	payload bytes.Buffer
+}
+
+func (wal *walWriter) set(key Prefix, item Item) {
+	wal.record(walOpSet, key, item)
+}
+
+func (wal *walWriter) delete(key Prefix) {
+	wal.record(walOpDelete, key, nil)
+}
+
+func (wal *walWriter) deleteSubtree(prefix Prefix) {
+	wal.record(walOpDeleteSubtree, prefix, nil)
+}
+
+func (wal *walWriter) record(op byte, key Prefix, item Item) {
+	if wal.err != nil {
+		return
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	wal.payload.Reset()
+	wal.payload.WriteByte(op)
+	wal.payload.Write(buf[:binary.PutUvarint(buf[:], uint64(len(key)))])
+	wal.payload.Write(key)
+	if op == walOpSet {
+		if err := encodeItem(&wal.payload, item); err != nil {
+			wal.err = err
+			return
+		}
+	}
+
+	// Write the whole record at once, so it is torn only by a crash.
+	var sum [4]byte
+	length := buf[:binary.PutUvarint(buf[:], uint64(wal.payload.Len()))]
+	record := make([]byte, 0, len(length)+4+wal.payload.Len()+4)
+	record = append(record, length...)
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(length))
+	record = append(record, sum[:]...)
+	record = append(record, wal.payload.Bytes()...)
+	binary.LittleEndian.PutUint32(sum[:], crc32.ChecksumIEEE(wal.payload.Bytes()))
+	record = append(record, sum[:]...)
+
+	_, wal.err = wal.w.Write(record)
+}
+
+func (wal *walWriter) writeUvarint(x uint64) {
+	if wal.err != nil {
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	_, wal.err = wal.w.Write(buf[:binary.PutUvarint(buf[:], x)])
+}
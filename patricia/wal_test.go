@@ -0,0 +1,144 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func TestTrie_WALReplay(t *testing.T) {
+	trie := NewTrie()
+	trie.Insert(Prefix("Honza"), 0)
+
+	var log bytes.Buffer
+	if err := trie.AttachWAL(&log); err != nil {
+		t.Fatal(err)
+	}
+
+	trie.Insert(Prefix("Pepan"), 1)
+	trie.Insert(Prefix("Pepin"), 2)
+	trie.Insert(Prefix("Pepanek"), 3)
+	trie.Insert(Prefix("Karel"), 4)
+	trie.Insert(Prefix("Pepan"), 5) // Not replaced.
+	trie.Set(Prefix("Karel"), 6)
+	trie.Delete(Prefix("Pepin"))
+	trie.Delete(Prefix("Tomas")) // Not present.
+	trie.Insert(Prefix("Jenik"), 7)
+	trie.Insert(Prefix("Jenak"), 8)
+	trie.DeleteSubtree(Prefix("Jen"))
+	trie.Insert(Prefix("Jenak"), nil)
+
+	if err := trie.WALError(); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed, err := ReplayWAL(bytes.NewReader(log.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed.Equal(trie, nil) {
+		t.Errorf("Unexpected replayed contents, expected=%v, got=%v",
+			trie.SortedEntries(), replayed.SortedEntries())
+	}
+	if !replayed.Match(Prefix("Jenak")) {
+		t.Error("nil item not replayed")
+	}
+}
+
+func TestTrie_WALTornRecord(t *testing.T) {
+	trie := NewTrie()
+
+	var log bytes.Buffer
+	if err := trie.AttachWAL(&log); err != nil {
+		t.Fatal(err)
+	}
+	first := log.Len()
+	trie.Insert(Prefix("Pepan"), 1)
+	trie.Insert(Prefix("Pepin"), 2)
+	complete := log.Len()
+	trie.Insert(Prefix("Honza"), 3)
+
+	// Every way of tearing the final record must be detected.
+	for n := complete; n < log.Len(); n++ {
+		replayed, err := ReplayWAL(bytes.NewReader(log.Bytes()[:n]))
+		if err != nil {
+			t.Fatalf("Unexpected error for a log torn at %d: %v", n, err)
+		}
+		if replayed.Len() != 2 || replayed.Match(Prefix("Honza")) {
+			t.Errorf("Unexpected replayed contents for a log torn at %d: %v", n, replayed.SortedEntries())
+		}
+	}
+
+	// A damaged final record is skipped as well.
+	damaged := append([]byte(nil), log.Bytes()...)
+	damaged[len(damaged)-1] ^= 0xff
+	replayed, err := ReplayWAL(bytes.NewReader(damaged))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Len() != 2 {
+		t.Errorf("Unexpected number of items, expected=2, got=%d", replayed.Len())
+	}
+
+	// A damaged record in the middle is an error.
+	damaged = append([]byte(nil), log.Bytes()...)
+	damaged[complete-1] ^= 0xff
+	if _, err := ReplayWAL(bytes.NewReader(damaged)); err != ErrInvalidEncoding {
+		t.Errorf("Unexpected error, expected=%v, got=%v", ErrInvalidEncoding, err)
+	}
+
+	// So is any damaged length, even when the record appears to run until
+	// the end of the log. The lengths fit into a single byte.
+	for _, at := range []int{first, complete} {
+		for length := 0; length < 0x80; length++ {
+			if length == int(log.Bytes()[at]) {
+				continue
+			}
+			damaged = append([]byte(nil), log.Bytes()...)
+			damaged[at] = byte(length)
+			if _, err := ReplayWAL(bytes.NewReader(damaged)); err != ErrInvalidEncoding {
+				t.Errorf("Unexpected error for the length %d at %d, expected=%v, got=%v", length, at, ErrInvalidEncoding, err)
+			}
+		}
+	}
+
+	if _, err := ReplayWAL(bytes.NewReader([]byte("garbage"))); err != ErrInvalidEncoding {
+		t.Errorf("Unexpected error, expected=%v, got=%v", ErrInvalidEncoding, err)
+	}
+}
+
+type failingWriter struct {
+	budget int
+}
+
+var errWriteFailed = errors.New("write failed")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.budget {
+		return 0, errWriteFailed
+	}
+	w.budget -= len(p)
+	return len(p), nil
+}
+
+func TestTrie_WALWriteError(t *testing.T) {
+	trie := NewTrie()
+	if err := trie.AttachWAL(&failingWriter{budget: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	trie.Insert(Prefix("Pepan"), 1)
+	if err := trie.WALError(); err != errWriteFailed {
+		t.Errorf("Unexpected error, expected=%v, got=%v", errWriteFailed, err)
+	}
+	if !trie.Match(Prefix("Pepan")) {
+		t.Error("item not inserted when failing to log it")
+	}
+}
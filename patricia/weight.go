@@ -0,0 +1,92 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"sort"
+)
+
+// Every stored key carries a weight, e.g. the popularity of a completion.
+// The weight starts at 0 when the key is inserted, it is kept when the item
+// is replaced and it is dropped along with the key when the key is deleted.
+// Clone copies the weights, the binary format and the log do not store them.
+
+// WeightedEntry is a key, the item stored under that key and its weight.
+type WeightedEntry struct {
+	Key    Prefix
+	Item   Item
+	Weight float64
+}
+
+// AddWeight adds delta to the weight of key, so the key ranks higher in
+// TopPrefixes. False is returned when key is not stored.
+func (trie *Trie) AddWeight(key Prefix, delta float64) (ok bool) {
+	path, ok := trie.itemPath(trie.foldKey(key))
+	if !ok {
+		return false
+	}
+	path[len(path)-1].weight += delta
+	return true
+}
+
+// Weight returns the weight of key, 0 when key is not stored.
+func (trie *Trie) Weight(key Prefix) float64 {
+	path, ok := trie.itemPath(trie.foldKey(key))
+	if !ok {
+		return 0
+	}
+	return path[len(path)-1].weight
+}
+
+// DecayWeights multiplies the weights of all the keys by factor in a single
+// walk. Calling it periodically with a factor between 0 and 1 makes the older
+// weights decay exponentially, so the recently added weight ranks higher.
+func (trie *Trie) DecayWeights(factor float64) {
+	trie.walkNodes(func(prefix Prefix, node *Trie, depth int) error {
+		node.weight *= factor
+		return nil
+	})
+}
+
+// TopPrefixes returns at most n keys starting with prefix, the heaviest ones
+// first. The keys with the same weight are returned in lexicographic order.
+func (trie *Trie) TopPrefixes(prefix Prefix, n int) []WeightedEntry {
+	// Nil prefix not allowed.
+	if prefix == nil {
+		panic(ErrNilPrefix)
+	}
+	prefix = trie.foldKey(prefix)
+
+	// Empty trie must be handled explicitly.
+	if trie.prefix == nil || n <= 0 {
+		return nil
+	}
+
+	// Locate the relevant subtree.
+	_, root, found, leftover := trie.findSubtree(prefix)
+	if !found {
+		return nil
+	}
+	key := make(Prefix, 0, len(prefix)+len(leftover)+32)
+	key = append(append(key, prefix...), leftover...)
+
+	var entries []WeightedEntry
+	root.walkNodesRecursive(&key, 0, func(key Prefix, node *Trie, depth int) error {
+		if node.hasItem {
+			entries = append(entries, WeightedEntry{append(Prefix{}, key...), node.item, node.weight})
+		}
+		return nil
+	})
+
+	// The keys are collected in lexicographic order already.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Weight > entries[j].Weight
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2014 The go-patricia AUTHORS
+//
+// Use of this source code is governed by The MIT License
+// that can be found in the LICENSE file.
+
+package patricia
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Tests -----------------------------------------------------------------------
+
+func topKeys(entries []WeightedEntry) []string {
+	var keys []string
+	for _, entry := range entries {
+		keys = append(keys, string(entry.Key))
+	}
+	return keys
+}
+
+func TestTrie_TopPrefixes(t *testing.T) {
+	trie := populateTrie(t)
+	trie.AddWeight(Prefix("Pepin"), 3)
+	trie.AddWeight(Prefix("Pepanek"), 1)
+	trie.AddWeight(Prefix("Honza"), 5)
+	if trie.AddWeight(Prefix("Pep"), 1) {
+		t.Error("weight added to a key not stored")
+	}
+
+	if got, want := topKeys(trie.TopPrefixes(Prefix("Pep"), 2)), []string{"Pepin", "Pepanek"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+	if got, want := topKeys(trie.TopPrefixes(Prefix("Pe"), 10)), []string{"Pepin", "Pepanek", "Pepan"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+	if got := trie.TopPrefixes(Prefix("Xaver"), 10); len(got) != 0 {
+		t.Errorf("Unexpected top keys, expected=[], got=%v", topKeys(got))
+	}
+
+	// Replacing the item keeps the weight, deleting the key drops it.
+	trie.Set(Prefix("Honza"), 1)
+	if weight := trie.Weight(Prefix("Honza")); weight != 5 {
+		t.Errorf("Unexpected weight, expected=5, got=%v", weight)
+	}
+	trie.Delete(Prefix("Honza"))
+	trie.Insert(Prefix("Honza"), 2)
+	if weight := trie.Weight(Prefix("Honza")); weight != 0 {
+		t.Errorf("Unexpected weight, expected=0, got=%v", weight)
+	}
+}
+
+func TestTrie_DecayWeights(t *testing.T) {
+	trie := populateTrie(t)
+	trie.AddWeight(Prefix("Pepan"), 10)
+	trie.AddWeight(Prefix("Pepin"), 4)
+
+	if top := trie.TopPrefixes(Prefix(""), 1); len(top) != 1 || string(top[0].Key) != "Pepan" {
+		t.Fatalf("Unexpected top keys, expected=[Pepan], got=%v", topKeys(top))
+	}
+
+	trie.DecayWeights(0.5)
+	trie.AddWeight(Prefix("Pepin"), 4)
+
+	top := trie.TopPrefixes(Prefix(""), 2)
+	if got, want := topKeys(top), []string{"Pepin", "Pepan"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected top keys, expected=%v, got=%v", want, got)
+	}
+	if top[1].Weight != 5 {
+		t.Errorf("Unexpected weight, expected=5, got=%v", top[1].Weight)
+	}
+}